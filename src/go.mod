@@ -4,6 +4,7 @@ require (
 	github.com/gin-gonic/gin v1.5.0
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/matthewljsmith/govalidator v0.0.0-20190125002538-23cce9d52e64
 	github.com/nanobox-io/golang-scribble v0.0.0-20190309225732-aa3e7c118975
 	github.com/onsi/gomega v1.4.3
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -17,10 +21,27 @@ type InjectData struct {
 	Rows    [][]interface{} `json:"rows"`
 }
 
+// ScenarioData simple struct for the PUT scenario payload, fields that aren't passed are left alone
+type ScenarioData struct {
+	State      *string `json:"state"`
+	PerSession *bool   `json:"perSession"`
+}
+
 func main() {
 
 	// define some flags that get passed in
 	var verbose = flag.Bool("verbose", false, "verbose - pass this to set the debug level to Debug instead of Info")
+	var tlsCert = flag.String("tls-cert", "", "tls-cert - PEM certificate file, enables TLS when passed with --tls-key")
+	var tlsKey = flag.String("tls-key", "", "tls-key - PEM private key file for --tls-cert")
+	var scram = flag.StringToString("scram", nil, "scram - user=password pairs, requires SCRAM-SHA-256 authentication when set")
+	var channelBinding = flag.Bool("scram-channel-binding", true, "scram-channel-binding - offer SCRAM-SHA-256-PLUS on TLS connections")
+	var databases = flag.StringSlice("databases", nil, "databases - the databases that exist, any database is accepted when not set")
+	var roles = flag.StringToInt("roles", nil, "roles - role=connection limit pairs ( -1 for no limit ), any role is accepted when not set")
+	var maxConnections = flag.Int("max-connections", 0, "max-connections - the most concurrent connections allowed, 0 for no limit")
+	var unmatched = flag.String("unmatched", "error", "unmatched - what to do with queries no fixture matches: error, empty, passthrough, block, hold or webhook")
+	var upstream = flag.String("upstream", "", "upstream - host:port of the server unmatched queries are passed through to")
+	var webhook = flag.String("webhook", "", "webhook - the url unmatched queries are POSTed to for an answer")
+	var journalSize = flag.Int("journal-size", pgmock.DefaultJournalSize, "journal-size - how many received messages the journal keeps")
 	flag.Parse()
 
 	// if verbose set log verbosity
@@ -33,6 +54,40 @@ func main() {
 	// new up the mocking server
 	mock := pgmock.NewServer()
 
+	// switch on tls if we have a certificate
+	if *tlsCert != "" && *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("unable to load tls certificate, err: %s", err)
+		}
+		mock.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	// and authentication if we have some users
+	if len(*scram) > 0 {
+		binding := pgmock.ChannelBindingOffer
+		if !*channelBinding {
+			binding = pgmock.ChannelBindingDisable
+		}
+		mock.SetSCRAMAuthentication(*scram, binding)
+	}
+
+	// and restrict who can connect to what
+	if len(*databases) > 0 {
+		mock.SetDatabases(*databases)
+	}
+	if len(*roles) > 0 {
+		mock.SetRoles(*roles)
+	}
+	mock.SetMaxConnections(*maxConnections)
+	mock.SetJournalSize(*journalSize)
+
+	// and what happens to queries we don't have an answer for
+	err := mock.SetUnmatchedPolicy("", pgmock.UnmatchedPolicy{Action: pgmock.UnmatchedAction(*unmatched), Upstream: *upstream, URL: *webhook})
+	if err != nil {
+		log.Fatalf("invalid unmatched policy, err: %s", err)
+	}
+
 	// kick of the mocking instance
 	log.Infof("starting pgmock -> 127.0.0.1:9999")
 	go mock.ListenAndServe(fmt.Sprintf("127.0.0.1:9999"))
@@ -53,5 +108,177 @@ func main() {
 		}
 		c.Status(200)
 	})
+	dl.PUT("/fixtures", func(c *gin.Context) {
+		var fixture pgmock.Fixture
+		err := c.MustBindWith(&fixture, binding.JSON)
+		if err != nil {
+			return
+		}
+		id, err := mock.AddFixture(fixture)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		c.JSON(200, gin.H{"id": id})
+	})
+	dl.GET("/scenarios", func(c *gin.Context) {
+		c.JSON(200, mock.Scenarios())
+	})
+	dl.PUT("/scenarios/:name", func(c *gin.Context) {
+		var payload ScenarioData
+		err := c.MustBindWith(&payload, binding.JSON)
+		if err != nil {
+			return
+		}
+		if payload.PerSession != nil {
+			mock.SetScenarioPerSession(c.Param("name"), *payload.PerSession)
+		}
+		if payload.State != nil {
+			mock.SetScenarioState(c.Param("name"), *payload.State)
+		}
+		c.Status(200)
+	})
+	dl.DELETE("/scenarios", func(c *gin.Context) {
+		mock.ResetScenarios()
+		c.Status(200)
+	})
+	dl.DELETE("/scenarios/:name", func(c *gin.Context) {
+		mock.ResetScenarios(c.Param("name"))
+		c.Status(200)
+	})
+	dl.GET("/verify", func(c *gin.Context) {
+		c.JSON(200, mock.Verify())
+	})
+	dl.GET("/journal", func(c *gin.Context) {
+		filter, err := journalFilter(c)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		entries, err := mock.Journal(filter)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		c.JSON(200, entries)
+	})
+	dl.GET("/journal/wait", func(c *gin.Context) {
+		filter, err := journalFilter(c)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		times, err := strconv.Atoi(c.DefaultQuery("times", "1"))
+		if err != nil {
+			c.AbortWithError(400, fmt.Errorf("invalid times %s", c.Query("times")))
+			return
+		}
+		timeout, err := strconv.Atoi(c.DefaultQuery("timeout", "30000"))
+		if err != nil {
+			c.AbortWithError(400, fmt.Errorf("invalid timeout %s", c.Query("timeout")))
+			return
+		}
+		// only a bad pattern comes back without any entries
+		entries, err := mock.WaitForQuery(filter, times, time.Duration(timeout)*time.Millisecond)
+		if entries == nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		if err != nil {
+			c.JSON(408, gin.H{"error": err.Error(), "entries": entries})
+			return
+		}
+		c.JSON(200, entries)
+	})
+	dl.DELETE("/journal", func(c *gin.Context) {
+		mock.ClearJournal()
+		c.Status(200)
+	})
+	dl.GET("/events", func(c *gin.Context) {
+		types := []pgmock.EventType{}
+		for _, t := range c.QueryArray("type") {
+			types = append(types, pgmock.EventType(t))
+		}
+		events, unsubscribe := mock.Subscribe(types...)
+		defer unsubscribe()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-events:
+				if ok {
+					c.SSEvent(string(event.Type), event)
+				}
+				return ok
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+	dl.GET("/pending", func(c *gin.Context) {
+		c.JSON(200, mock.Pending())
+	})
+	dl.PUT("/pending/:id", func(c *gin.Context) {
+		var answer pgmock.PendingAnswer
+		err := c.MustBindWith(&answer, binding.JSON)
+		if err != nil {
+			return
+		}
+		err = mock.AnswerPending(c.Param("id"), answer)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		c.Status(200)
+	})
+	dl.PUT("/unmatched", func(c *gin.Context) {
+		setUnmatchedPolicy(c, mock, "")
+	})
+	dl.PUT("/unmatched/:database", func(c *gin.Context) {
+		setUnmatchedPolicy(c, mock, c.Param("database"))
+	})
 	dl.Run("127.0.0.1:9998")
 }
+
+// setUnmatchedPolicy sets the unmatched policy in the request body for the database
+func setUnmatchedPolicy(c *gin.Context, mock pgmock.Server, database string) {
+	var policy pgmock.UnmatchedPolicy
+	err := c.MustBindWith(&policy, binding.JSON)
+	if err != nil {
+		return
+	}
+	err = mock.SetUnmatchedPolicy(database, policy)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	c.Status(200)
+}
+
+// journalFilter builds the journal filter from the query string: session ( process id ), sql ( regex ), fixture ( id ),
+// since and until ( RFC 3339 ) and matched ( true or false )
+func journalFilter(c *gin.Context) (pgmock.JournalFilter, error) {
+	filter := pgmock.JournalFilter{SQL: c.Query("sql"), FixtureID: c.Query("fixture")}
+	if session := c.Query("session"); session != "" {
+		processID, err := strconv.ParseInt(session, 10, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid session %s", session)
+		}
+		filter.ProcessID = int32(processID)
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %s", param, value)
+			}
+			*t = parsed
+		}
+	}
+	if value := c.Query("matched"); value != "" {
+		matched, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid matched %s", value)
+		}
+		filter.Matched = &matched
+	}
+	return filter, nil
+}
@@ -0,0 +1,229 @@
+package pgmock
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Authenticator decides whether a client is allowed to connect once its startup message has been read. Returning nil
+// lets the client in, returning a *PgError sends that error to the client, any other error sends the usual
+// "password authentication failed" FATAL.
+type Authenticator interface {
+	Authenticate(exchange AuthExchange) error
+}
+
+// AuthenticatorFunc adapts a plain function to an Authenticator
+type AuthenticatorFunc func(exchange AuthExchange) error
+
+// Authenticate calls f(exchange)
+func (f AuthenticatorFunc) Authenticate(exchange AuthExchange) error {
+	return f(exchange)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// AuthExchange gives an Authenticator the details of the connecting client and a way to swap authentication messages
+// with it
+type AuthExchange interface {
+
+	// Parameters returns the startup parameters sent by the client, user and database amongst them
+	Parameters() map[string]string
+
+	// User is shorthand for Parameters()["user"]
+	User() string
+
+	// RemoteAddr returns the address of the client
+	RemoteAddr() net.Addr
+
+	// TLS returns the state of the encrypted connection, or nil if the client didn't use TLS
+	TLS() *tls.ConnectionState
+
+	// ChannelBinding returns the tls-server-end-point channel binding data, or nil if the client didn't use TLS
+	ChannelBinding() []byte
+
+	// Request sends an authentication request ( one of the AuthType constants ) with any data it needs
+	Request(authType int32, data []byte) error
+
+	// Response reads the body of the next password, SASL or GSS response message from the client
+	Response() ([]byte, error)
+
+	// RequestPassword asks for a cleartext password and returns it
+	RequestPassword() (string, error)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _AuthExchange is the session backed AuthExchange handed to authenticators
+type _AuthExchange struct {
+	Session *_Session
+	Startup *_StartupMessage
+}
+
+func (ex *_AuthExchange) Parameters() map[string]string { return ex.Startup.Parameters }
+func (ex *_AuthExchange) User() string                  { return ex.Startup.Parameters["user"] }
+func (ex *_AuthExchange) RemoteAddr() net.Addr          { return ex.Session.Conn.RemoteAddr() }
+func (ex *_AuthExchange) TLS() *tls.ConnectionState     { return ex.Session.TLSState }
+func (ex *_AuthExchange) ChannelBinding() []byte        { return ex.Session.ChannelBinding }
+
+func (ex *_AuthExchange) Request(authType int32, data []byte) error {
+	err := (&_AuthenticationRequest{Type: authType, Data: data}).write(ex.Session.Messenger)
+	if err != nil {
+		return fmt.Errorf("failed to write authentication request %d, err: %s", authType, err)
+	}
+	log.Infof("wrote authentication request %d", authType)
+	return nil
+}
+
+func (ex *_AuthExchange) Response() ([]byte, error) {
+
+	// shortcut
+	m := ex.Session.Messenger
+
+	msgID := m.readByte()
+	if m.Error != nil {
+		return nil, fmt.Errorf("unable to read messageID, err: %s", m.Error)
+	}
+	if msgID != PasswordMessageMessageID {
+		return nil, fatalError(SQLStateCodeProtocolViolation, fmt.Sprintf("expected password response, got message type %d", msgID))
+	}
+
+	msgLen := m.readInt32()
+	if m.Error != nil {
+		return nil, fmt.Errorf("unable to read message length, err: %s", m.Error)
+	}
+	if msgLen < 4 || msgLen > MaxAuthMessageLength {
+		return nil, fatalError(SQLStateCodeProtocolViolation, fmt.Sprintf("invalid message length %d", msgLen))
+	}
+
+	body := m.readBytes(msgLen - 4)
+	if m.Error != nil {
+		return nil, fmt.Errorf("unable to read authentication response, err: %s", m.Error)
+	}
+
+	return body, nil
+}
+
+func (ex *_AuthExchange) RequestPassword() (string, error) {
+	if err := ex.Request(AuthTypeCleartextPassword, nil); err != nil {
+		return "", err
+	}
+	msg := &_PasswordMessage{}
+	if err := readAuthResponse(ex, msg); err != nil {
+		return "", err
+	}
+	return msg.Password, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readAuthResponse reads the next response from the client and parses it into msg
+func readAuthResponse(exchange AuthExchange, msg _FrontendMessage) error {
+
+	body, err := exchange.Response()
+	if err != nil {
+		return err
+	}
+	if err := msg.read(newMessenger(bytes.NewBuffer(body))); err != nil {
+		return fatalError(SQLStateCodeProtocolViolation, fmt.Sprintf("invalid authentication response, err: %s", err))
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// passwordFailed is the error postgres gives for any kind of bad password
+func passwordFailed(user string) *PgError {
+	return fatalError(SQLStateCodeInvalidPassword, fmt.Sprintf("password authentication failed for user \"%s\"", user))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewTrustAuthenticator lets everyone in without asking for a password, this is the default
+func NewTrustAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(exchange AuthExchange) error { return nil })
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _PasswordAuthenticator asks for a cleartext password and checks it against the user -> password credentials
+type _PasswordAuthenticator struct {
+	Credentials map[string]string
+}
+
+// NewPasswordAuthenticator requires a cleartext password matching the user -> password credentials
+func NewPasswordAuthenticator(credentials map[string]string) Authenticator {
+	return &_PasswordAuthenticator{Credentials: credentials}
+}
+
+func (auth *_PasswordAuthenticator) Authenticate(exchange AuthExchange) error {
+
+	password, err := exchange.RequestPassword()
+	if err != nil {
+		return err
+	}
+
+	expected, found := auth.Credentials[exchange.User()]
+	if !found || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return passwordFailed(exchange.User())
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _MD5Authenticator does the salted md5 password challenge against the user -> password credentials
+type _MD5Authenticator struct {
+	Credentials map[string]string
+}
+
+// NewMD5Authenticator requires an md5 hashed password matching the user -> password credentials
+func NewMD5Authenticator(credentials map[string]string) Authenticator {
+	return &_MD5Authenticator{Credentials: credentials}
+}
+
+func (auth *_MD5Authenticator) Authenticate(exchange AuthExchange) error {
+
+	// ask for the password with a fresh salt
+	salt := randomBytes(4)
+	if err := exchange.Request(AuthTypeMD5Password, salt); err != nil {
+		return err
+	}
+	msg := &_PasswordMessage{}
+	if err := readAuthResponse(exchange, msg); err != nil {
+		return err
+	}
+
+	// the client sends "md5" + md5(md5(password + user) + salt)
+	password, found := auth.Credentials[exchange.User()]
+	if !found || subtle.ConstantTimeCompare([]byte(msg.Password), []byte(md5Password(password, exchange.User(), salt))) != 1 {
+		return passwordFailed(exchange.User())
+	}
+
+	return nil
+}
+
+// md5Password works out the md5 password response for the given salt
+func md5Password(password, user string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewSCRAMAuthenticator requires SCRAM-SHA-256 authentication against the user -> password credentials, offering
+// SCRAM-SHA-256-PLUS on TLS connections as binding allows
+func NewSCRAMAuthenticator(credentials map[string]string, binding ChannelBinding) Authenticator {
+	return &_SCRAMAuthenticator{Credentials: credentials, ChannelBinding: binding}
+}
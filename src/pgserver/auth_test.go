@@ -0,0 +1,151 @@
+package pgmock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// expectAuthRequest reads an authentication request asserting its type, returning any data that came with it
+func (c *_TestClient) expectAuthRequest(authType int32) []byte {
+	body := c.expectMessage(AuthenticationOkMessageID)
+	Expect(int32(binary.BigEndian.Uint32(body))).To(Equal(authType))
+	return body[4:]
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writePassword sends a PasswordMessage
+func (c *_TestClient) writePassword(password string) {
+	c.writeMessage(PasswordMessageMessageID, append([]byte(password), 0))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestPasswordAuthenticator(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server asking for cleartext passwords
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(NewPasswordAuthenticator(map[string]string{"test": "secret"}))
+	})
+	defer stop()
+
+	// the right password gets in
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	Expect(c.expectAuthRequest(AuthTypeCleartextPassword)).To(BeEmpty())
+	c.writePassword("secret")
+	c.expectAuthRequest(AuthTypeOk)
+	c.expectMessage(BackendKeyDataMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// the wrong one doesn't
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writePassword("wrong")
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSeverity]).To(Equal("FATAL"))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidPassword))
+	Expect(fields[ErrorMessage]).To(Equal("password authentication failed for user \"test\""))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestMD5Authenticator(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server asking for md5 passwords
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(NewMD5Authenticator(map[string]string{"test": "secret"}))
+	})
+	defer stop()
+
+	// hash the password with the salt we're sent
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	salt := c.expectAuthRequest(AuthTypeMD5Password)
+	Expect(salt).To(HaveLen(4))
+	c.writePassword(md5Password("secret", "test", salt))
+	c.expectAuthRequest(AuthTypeOk)
+
+	// the same hash is no good with a different salt
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeMD5Password)
+	c.writePassword(md5Password("secret", "test", salt))
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidPassword))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestCustomAuthenticator(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// a token style authenticator that lets one token through and expires everything else
+	var params map[string]string
+	var remote string
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(AuthenticatorFunc(func(exchange AuthExchange) error {
+			params, remote = exchange.Parameters(), exchange.RemoteAddr().String()
+			token, err := exchange.RequestPassword()
+			if err != nil {
+				return err
+			}
+			if token != "valid" {
+				return &PgError{Code: SQLStateCodeInvalidAuthorizationSpecification, Message: "token expired", Hint: "get a new one"}
+			}
+			return nil
+		}))
+	})
+	defer stop()
+
+	// the valid token gets in
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test", "database": "db"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writePassword("valid")
+	c.expectAuthRequest(AuthTypeOk)
+
+	// assert the exchange had the client details
+	Expect(params).To(Equal(map[string]string{"user": "test", "database": "db"}))
+	Expect(remote).To(Equal(c.Conn.LocalAddr().String()))
+
+	// an expired token gets our error, always as a FATAL
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writePassword("expired")
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSeverity]).To(Equal("FATAL"))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidAuthorizationSpecification))
+	Expect(fields[ErrorMessage]).To(Equal("token expired"))
+	Expect(fields[ErrorHint]).To(Equal("get a new one"))
+
+	// anything that isn't a password message is a protocol violation
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writeMessage(QueryMessageID, append(bytes.Repeat([]byte("x"), 4), 0))
+	fields = errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeProtocolViolation))
+}
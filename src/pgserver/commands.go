@@ -0,0 +1,316 @@
+package pgmock
+
+import (
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type _SessionCommandKind int
+
+const (
+	sessionCommandBegin _SessionCommandKind = iota
+	sessionCommandCommit
+	sessionCommandRollback
+	sessionCommandRollbackTo
+	sessionCommandSavepoint
+	sessionCommandRelease
+	sessionCommandSet
+	sessionCommandReset
+)
+
+// _SessionCommand is a statement that changes the state of the session rather than touching any data, transaction
+// control and SET / RESET. These get answered even without a fixture.
+type _SessionCommand struct {
+	Kind    _SessionCommandKind
+	Name    string
+	Value   string
+	Local   bool
+	Default bool
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// startupSettings are the startup parameters that aren't settings
+var startupSettings = map[string]bool{"user": true, "database": true, "options": true, "replication": true}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// startupSettingsOf picks the settings out of the startup parameters, the session starts off with these
+func startupSettingsOf(parameters map[string]string) map[string]string {
+	settings := map[string]string{}
+	for name, value := range parameters {
+		if !startupSettings[name] {
+			settings[strings.ToLower(name)] = value
+		}
+	}
+	return settings
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parseSessionCommand works out if sql is a session command, returning nil if it isn't
+func parseSessionCommand(sql string) *_SessionCommand {
+
+	tokens := trimSQLTokens(tokenizeSQL(sql))
+	words := []string{}
+	for _, t := range tokens {
+		if t.Kind != sqlTokenWord {
+			break
+		}
+		words = append(words, strings.ToUpper(t.Text))
+	}
+	if len(words) == 0 {
+		return nil
+	}
+
+	switch words[0] {
+	case "BEGIN":
+		return &_SessionCommand{Kind: sessionCommandBegin}
+	case "START":
+		if len(words) > 1 && words[1] == "TRANSACTION" {
+			return &_SessionCommand{Kind: sessionCommandBegin}
+		}
+	case "COMMIT", "END":
+		if len(words) > 1 && words[1] == "PREPARED" {
+			return nil
+		}
+		return &_SessionCommand{Kind: sessionCommandCommit}
+	case "ROLLBACK", "ABORT":
+		for _, w := range words[1:] {
+			if w == "TO" {
+				return &_SessionCommand{Kind: sessionCommandRollbackTo}
+			}
+			if w == "PREPARED" {
+				return nil
+			}
+		}
+		return &_SessionCommand{Kind: sessionCommandRollback}
+	case "SAVEPOINT":
+		if len(tokens) > 1 {
+			return &_SessionCommand{Kind: sessionCommandSavepoint}
+		}
+	case "RELEASE":
+		if len(tokens) > 1 {
+			return &_SessionCommand{Kind: sessionCommandRelease}
+		}
+	case "SET":
+		return parseSetCommand(tokens[1:])
+	case "RESET":
+		if len(tokens) == 2 && tokens[1].Kind == sqlTokenWord {
+			return &_SessionCommand{Kind: sessionCommandReset, Name: strings.ToLower(tokens[1].Text)}
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parseSetCommand parses the rest of SET [ SESSION | LOCAL ] name { TO | = } value, and SET TIME ZONE value
+func parseSetCommand(tokens []_SQLToken) *_SessionCommand {
+
+	cmd := &_SessionCommand{Kind: sessionCommandSet}
+	if len(tokens) > 0 && tokens[0].Kind == sqlTokenWord {
+		switch strings.ToUpper(tokens[0].Text) {
+		case "LOCAL":
+			cmd.Local, tokens = true, tokens[1:]
+		case "SESSION":
+			// SET SESSION AUTHORIZATION and CHARACTERISTICS aren't settings
+			if len(tokens) > 1 && tokens[1].Kind == sqlTokenWord && strings.ToUpper(tokens[1].Text) != "AUTHORIZATION" &&
+				strings.ToUpper(tokens[1].Text) != "CHARACTERISTICS" {
+				tokens = tokens[1:]
+			}
+		}
+	}
+
+	// SET TIME ZONE is the odd one out with no TO
+	if len(tokens) > 2 && strings.ToUpper(tokens[0].Text) == "TIME" && strings.ToUpper(tokens[1].Text) == "ZONE" {
+		cmd.Name, tokens = "timezone", tokens[2:]
+	} else if len(tokens) > 2 && (tokens[0].Kind == sqlTokenWord || tokens[0].Kind == sqlTokenQuotedIdent) &&
+		(strings.ToUpper(tokens[1].Text) == "TO" || tokens[1].Text == "=") {
+		cmd.Name, tokens = strings.ToLower(strings.Trim(tokens[0].Text, `"`)), tokens[2:]
+	} else {
+		return nil
+	}
+
+	// SET name TO DEFAULT is a RESET in disguise, a quoted 'default' is just a value though
+	if len(tokens) == 1 && tokens[0].Kind == sqlTokenWord && strings.ToUpper(tokens[0].Text) == "DEFAULT" {
+		cmd.Default = true
+		return cmd
+	}
+
+	// the value is the literals as they are, lists come out comma separated
+	values := []string{}
+	for _, t := range tokens {
+		if t.Kind == sqlTokenPunct && t.Text == "," {
+			continue
+		}
+		values = append(values, sqlLiteralValue(t))
+	}
+	cmd.Value = strings.Join(values, ", ")
+
+	return cmd
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// tag is the CommandComplete tag for the command, a COMMIT of a failed transaction is reported as the ROLLBACK it
+// really is
+func (cmd *_SessionCommand) tag(session *_Session) string {
+	switch cmd.Kind {
+	case sessionCommandBegin:
+		return "BEGIN"
+	case sessionCommandCommit:
+		if session != nil && session.TxStatus == ReadyForQueryError {
+			return "ROLLBACK"
+		}
+		return "COMMIT"
+	case sessionCommandRollback, sessionCommandRollbackTo:
+		return "ROLLBACK"
+	case sessionCommandSavepoint:
+		return "SAVEPOINT"
+	case sessionCommandRelease:
+		return "RELEASE"
+	case sessionCommandSet:
+		return "SET"
+	default:
+		return "RESET"
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// endsFailedTransaction checks the command is allowed in a failed transaction, everything else gets refused until the
+// transaction is over
+func (cmd *_SessionCommand) endsFailedTransaction() bool {
+	return cmd != nil && (cmd.Kind == sessionCommandCommit || cmd.Kind == sessionCommandRollback || cmd.Kind == sessionCommandRollbackTo)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// savepointStatement names the savepoint statement the command is, for the error when there's no transaction to use
+// it in
+func (cmd *_SessionCommand) savepointStatement() string {
+	if cmd == nil {
+		return ""
+	}
+	switch cmd.Kind {
+	case sessionCommandSavepoint:
+		return "SAVEPOINT"
+	case sessionCommandRelease:
+		return "RELEASE SAVEPOINT"
+	case sessionCommandRollbackTo:
+		return "ROLLBACK TO SAVEPOINT"
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// apply updates the session's transaction status and settings for the command
+func (cmd *_SessionCommand) apply(session *_Session) {
+
+	if session == nil {
+		return
+	}
+
+	switch cmd.Kind {
+	case sessionCommandBegin:
+		// keep hold of the settings so a rollback can put them back
+		if session.TxStatus == ReadyForQueryIdle {
+			session.TxStatus, session.TxSettings = ReadyForQueryTransaction, copySettings(session.Settings)
+		}
+	case sessionCommandCommit, sessionCommandRollback:
+		// a COMMIT of a failed transaction is a rollback too
+		if session.TxSettings != nil && (cmd.Kind == sessionCommandRollback || session.TxStatus == ReadyForQueryError) {
+			session.Settings = session.TxSettings
+		}
+		session.TxStatus, session.LocalSettings, session.TxSettings = ReadyForQueryIdle, nil, nil
+	case sessionCommandRollbackTo:
+		if session.TxStatus == ReadyForQueryError {
+			session.TxStatus = ReadyForQueryTransaction
+		}
+	case sessionCommandSet:
+		// SET LOCAL only lasts until the end of the transaction, and does nothing outside of one
+		if cmd.Local {
+			if session.TxStatus == ReadyForQueryIdle {
+				return
+			}
+			if session.LocalSettings == nil {
+				session.LocalSettings = map[string]string{}
+			}
+			value, found := cmd.Value, true
+			if cmd.Default {
+				// there's nothing to hide the session's value behind if it wasn't set at startup
+				value, found = startupSettingsOf(session.Parameters)[cmd.Name]
+			}
+			session.LocalSettings[cmd.Name] = value
+			if !found {
+				delete(session.LocalSettings, cmd.Name)
+			}
+			return
+		}
+		if cmd.Default {
+			session.resetSetting(cmd.Name)
+			return
+		}
+		if session.Settings == nil {
+			session.Settings = map[string]string{}
+		}
+		session.Settings[cmd.Name] = cmd.Value
+		delete(session.LocalSettings, cmd.Name)
+	case sessionCommandReset:
+		// settings go back to what they were at startup
+		if cmd.Name == "all" {
+			session.Settings, session.LocalSettings = startupSettingsOf(session.Parameters), nil
+			return
+		}
+		session.resetSetting(cmd.Name)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// resetSetting puts a setting back to what it was at startup, dropping it if it wasn't set then
+func (session *_Session) resetSetting(name string) {
+	delete(session.Settings, name)
+	delete(session.LocalSettings, name)
+	if value, found := startupSettingsOf(session.Parameters)[name]; found && session.Settings != nil {
+		session.Settings[name] = value
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// copySettings copies settings so changing one doesn't change the other
+func copySettings(settings map[string]string) map[string]string {
+	copied := map[string]string{}
+	for name, value := range settings {
+		copied[name] = value
+	}
+	return copied
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// setting returns the current value of a setting, SET LOCAL values first
+func (session *_Session) setting(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if value, found := session.LocalSettings[name]; found {
+		return value, true
+	}
+	value, found := session.Settings[name]
+	return value, found
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// settings returns all of the session's settings, the local ones in place of the rest
+func (session *_Session) settings() map[string]string {
+	settings := copySettings(session.Settings)
+	for name, value := range session.LocalSettings {
+		settings[name] = value
+	}
+	return settings
+}
@@ -0,0 +1,131 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestParseSessionCommand(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// assert the results
+	Expect(parseSessionCommand("SELECT 1")).To(BeNil())
+	Expect(parseSessionCommand("begin;")).To(Equal(&_SessionCommand{Kind: sessionCommandBegin}))
+	Expect(parseSessionCommand("START TRANSACTION ISOLATION LEVEL SERIALIZABLE")).To(Equal(&_SessionCommand{Kind: sessionCommandBegin}))
+	Expect(parseSessionCommand("END")).To(Equal(&_SessionCommand{Kind: sessionCommandCommit}))
+	Expect(parseSessionCommand("COMMIT PREPARED 'x'")).To(BeNil())
+	Expect(parseSessionCommand("ROLLBACK")).To(Equal(&_SessionCommand{Kind: sessionCommandRollback}))
+	Expect(parseSessionCommand("ROLLBACK TO SAVEPOINT a")).To(Equal(&_SessionCommand{Kind: sessionCommandRollbackTo}))
+	Expect(parseSessionCommand("SAVEPOINT sp_1")).To(Equal(&_SessionCommand{Kind: sessionCommandSavepoint}))
+	Expect(parseSessionCommand("release savepoint sp_1")).To(Equal(&_SessionCommand{Kind: sessionCommandRelease}))
+	Expect(parseSessionCommand("RELEASE sp_1").tag(nil)).To(Equal("RELEASE"))
+	Expect(parseSessionCommand("SAVEPOINT")).To(BeNil())
+
+	Expect(parseSessionCommand("SET search_path TO app, public")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "search_path", Value: "app, public"}))
+	Expect(parseSessionCommand("SET SESSION Application_Name = 'reports'")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "application_name", Value: "reports"}))
+	Expect(parseSessionCommand("set local statement_timeout = 5000")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "statement_timeout", Value: "5000", Local: true}))
+	Expect(parseSessionCommand("SET TIME ZONE 'UTC'")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "timezone", Value: "UTC"}))
+	Expect(parseSessionCommand("SET SESSION AUTHORIZATION bob")).To(BeNil())
+	Expect(parseSessionCommand("RESET ALL")).To(Equal(&_SessionCommand{Kind: sessionCommandReset, Name: "all"}))
+	Expect(parseSessionCommand("SET search_path TO DEFAULT")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "search_path", Default: true}))
+	Expect(parseSessionCommand("SET search_path TO 'default'")).
+		To(Equal(&_SessionCommand{Kind: sessionCommandSet, Name: "search_path", Value: "default"}))
+
+	// and they change the session
+	session := &_Session{TxStatus: ReadyForQueryIdle, Parameters: map[string]string{"user": "bob", "application_name": "api"}}
+	session.Settings = startupSettingsOf(session.Parameters)
+	parseSessionCommand("SET LOCAL work_mem = '1MB'").apply(session)
+	Expect(session.LocalSettings).To(BeNil())
+
+	parseSessionCommand("BEGIN").apply(session)
+	parseSessionCommand("SET LOCAL work_mem = '1MB'").apply(session)
+	parseSessionCommand("SET application_name = reports").apply(session)
+	Expect(session.TxStatus).To(Equal(ReadyForQueryTransaction))
+	Expect(session.LocalSettings["work_mem"]).To(Equal("1MB"))
+	Expect(session.Settings["application_name"]).To(Equal("reports"))
+
+	session.failTransaction()
+	Expect(parseSessionCommand("COMMIT").tag(session)).To(Equal("ROLLBACK"))
+	parseSessionCommand("COMMIT").apply(session)
+	Expect(session.TxStatus).To(Equal(ReadyForQueryIdle))
+	_, found := session.setting("work_mem")
+	Expect(found).To(BeFalse())
+
+	// the failed transaction took its SET with it
+	Expect(session.Settings["application_name"]).To(Equal("api"))
+
+	parseSessionCommand("SET application_name = reports").apply(session)
+	parseSessionCommand("RESET application_name").apply(session)
+	Expect(session.Settings["application_name"]).To(Equal("api"))
+	_, found = session.setting("user")
+	Expect(found).To(BeFalse())
+
+	// DEFAULT is the same as RESET
+	parseSessionCommand("SET application_name = reports").apply(session)
+	parseSessionCommand("SET application_name TO DEFAULT").apply(session)
+	Expect(session.Settings["application_name"]).To(Equal("api"))
+
+	// a rollback undoes the transaction's SETs, a commit keeps them
+	parseSessionCommand("BEGIN").apply(session)
+	parseSessionCommand("SET work_mem = '1MB'").apply(session)
+	parseSessionCommand("ROLLBACK").apply(session)
+	_, found = session.setting("work_mem")
+	Expect(found).To(BeFalse())
+
+	parseSessionCommand("BEGIN").apply(session)
+	parseSessionCommand("SET work_mem = '1MB'").apply(session)
+	parseSessionCommand("COMMIT").apply(session)
+	Expect(session.settings()["work_mem"]).To(Equal("1MB"))
+
+	// and a session SET replaces a local one
+	parseSessionCommand("BEGIN").apply(session)
+	parseSessionCommand("SET LOCAL work_mem = '2MB'").apply(session)
+	parseSessionCommand("SET LOCAL application_name TO DEFAULT").apply(session)
+	Expect(session.settings()["work_mem"]).To(Equal("2MB"))
+	Expect(session.settings()["application_name"]).To(Equal("api"))
+	parseSessionCommand("SET work_mem = '4MB'").apply(session)
+	Expect(session.settings()["work_mem"]).To(Equal("4MB"))
+	parseSessionCommand("COMMIT").apply(session)
+	Expect(session.settings()["work_mem"]).To(Equal("4MB"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestSessionCommandSavepoints(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	_, addr, stop := startTestServer(nil)
+	defer stop()
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results, nested transactions don't need fixtures
+	for _, command := range [][2]string{
+		{"BEGIN", "BEGIN"}, {"SAVEPOINT sp_1", "SAVEPOINT"}, {"ROLLBACK TO SAVEPOINT sp_1", "ROLLBACK"},
+		{"RELEASE SAVEPOINT sp_1", "RELEASE"}, {"COMMIT", "COMMIT"},
+	} {
+		ids, bodies := c.query(command[0])
+		Expect(string(ids)).To(Equal("C"), command[0])
+		Expect(string(bodies[0])).To(Equal(command[1]+"\x00"), command[0])
+	}
+
+	// savepoints need a transaction to be in
+	for _, sql := range []string{"SAVEPOINT sp_1", "RELEASE SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1"} {
+		ids, bodies := c.query(sql)
+		Expect(string(ids)).To(Equal("E"), sql)
+		Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeNoActiveSQLTransaction), sql)
+	}
+}
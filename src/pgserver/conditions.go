@@ -0,0 +1,123 @@
+package pgmock
+
+import (
+	"fmt"
+	"net"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// TxStatus is the transaction status of a session, as reported in ReadyForQuery
+type TxStatus string
+
+const (
+	// TxIdle is outside of a transaction
+	TxIdle TxStatus = "idle"
+	// TxActive is inside a transaction
+	TxActive TxStatus = "transaction"
+	// TxFailed is inside a transaction that has had an error and is waiting to be rolled back
+	TxFailed TxStatus = "failed"
+)
+
+// txIndicators maps the statuses onto the ReadyForQuery indicators
+var txIndicators = map[TxStatus]byte{
+	TxIdle:   ReadyForQueryIdle,
+	TxActive: ReadyForQueryTransaction,
+	TxFailed: ReadyForQueryError,
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SessionCondition restricts a fixture to sessions with matching attributes, fields that aren't set match anything.
+// Settings are checked against the startup parameters and anything SET since, ClientAddr can be an address or a CIDR
+// range.
+type SessionCondition struct {
+	User            string            `json:"user,omitempty"`
+	Database        string            `json:"database,omitempty"`
+	ApplicationName string            `json:"applicationName,omitempty"`
+	Settings        map[string]string `json:"settings,omitempty"`
+	ClientAddr      string            `json:"clientAddr,omitempty"`
+	TxStatus        TxStatus          `json:"txStatus,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// validate checks the condition makes sense before it gets used
+func (cond *SessionCondition) validate() error {
+
+	if cond.TxStatus != "" {
+		if _, found := txIndicators[cond.TxStatus]; !found {
+			return fmt.Errorf("unknown transaction status %s", cond.TxStatus)
+		}
+	}
+	if cond.ClientAddr != "" && net.ParseIP(cond.ClientAddr) == nil {
+		if _, _, err := net.ParseCIDR(cond.ClientAddr); err != nil {
+			return fmt.Errorf("client address %s is neither an address or a CIDR range", cond.ClientAddr)
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matches checks the session against the condition, a nil condition matches every session and a nil session only
+// matches a nil condition
+func (cond *SessionCondition) matches(session *_Session) bool {
+
+	if cond == nil {
+		return true
+	}
+	if session == nil {
+		return false
+	}
+
+	if cond.User != "" && cond.User != session.Parameters["user"] {
+		return false
+	}
+	if cond.Database != "" && cond.Database != session.Parameters["database"] {
+		return false
+	}
+	if cond.ApplicationName != "" {
+		if name, _ := session.setting("application_name"); name != cond.ApplicationName {
+			return false
+		}
+	}
+	for name, value := range cond.Settings {
+		if current, found := session.setting(name); !found || current != value {
+			return false
+		}
+	}
+	if cond.TxStatus != "" && txIndicators[cond.TxStatus] != session.TxStatus {
+		return false
+	}
+
+	if cond.ClientAddr != "" {
+		if session.Conn == nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(session.Conn.RemoteAddr().String())
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			return false
+		}
+		if _, network, err := net.ParseCIDR(cond.ClientAddr); err == nil {
+			return network.Contains(ip)
+		}
+		return net.ParseIP(cond.ClientAddr).Equal(ip)
+	}
+
+	return true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// txStatus is the session's transaction status
+func (session *_Session) txStatus() TxStatus {
+	for status, indicator := range txIndicators {
+		if indicator == session.TxStatus {
+			return status
+		}
+	}
+	return TxIdle
+}
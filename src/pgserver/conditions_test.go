@@ -0,0 +1,99 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestSessionConditions(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// the same query answered differently for different sessions, the first fixture to match wins so the default goes
+	// last
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	fixtures := []Fixture{
+		{Query: "SELECT source", Session: &SessionCondition{User: "reporting"}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"reporting"}}},
+		{Query: "SELECT source", Session: &SessionCondition{ApplicationName: "batch"}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"batch"}}},
+		{Query: "SELECT source", Session: &SessionCondition{Settings: map[string]string{"search_path": "tenant_2"}}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"tenant"}}},
+		{Query: "SELECT source", Session: &SessionCondition{TxStatus: TxActive}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"tx"}}},
+		{Query: "SELECT local", Session: &SessionCondition{ClientAddr: "127.0.0.0/8"}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"local"}}},
+		{Query: "SELECT remote", Session: &SessionCondition{ClientAddr: "10.0.0.1"}, Columns: []string{"src:text"}, Rows: [][]interface{}{{"remote"}}},
+		{Query: "SELECT source", Columns: []string{"src:text"}, Rows: [][]interface{}{{"default"}}},
+		{Query: "SELECT fail", Error: &PgError{Code: SQLStateCodeSerializationFailure, Message: "nope"}},
+	}
+	for _, fixture := range fixtures {
+		_, err := srv.AddFixture(fixture)
+		Expect(err).To(BeNil())
+	}
+	Expect(srv.Responder.Fixtures).To(HaveLen(len(fixtures)))
+
+	source := func(c *_TestClient, sql string) string {
+		ids, bodies := c.query(sql)
+		if string(ids) != "TDC" {
+			return string(ids)
+		}
+		return string(bodies[1])
+	}
+
+	// assert the results
+	api := connectTestClient(addr, map[string]string{"user": "api"})
+	defer api.Conn.Close()
+	Expect(source(api, "SELECT source")).To(ContainSubstring("default"))
+	Expect(source(api, "SELECT local")).To(ContainSubstring("local"))
+	Expect(source(api, "SELECT remote")).To(Equal("E"))
+
+	reporting := connectTestClient(addr, map[string]string{"user": "reporting"})
+	defer reporting.Conn.Close()
+	Expect(source(reporting, "SELECT source")).To(ContainSubstring("reporting"))
+
+	batch := connectTestClient(addr, map[string]string{"user": "api", "application_name": "batch"})
+	defer batch.Conn.Close()
+	Expect(source(batch, "SELECT source")).To(ContainSubstring("batch"))
+
+	// settings can be changed along the way, without needing fixtures for the SETs
+	ids, bodies := api.query("SET search_path TO tenant_2")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(bodies[0]).To(Equal(append([]byte("SET"), 0)))
+	Expect(source(api, "SELECT source")).To(ContainSubstring("tenant"))
+	api.query("RESET search_path")
+	Expect(source(api, "SELECT source")).To(ContainSubstring("default"))
+
+	// transactions are tracked, with ReadyForQuery reporting them
+	api.writeMessage(QueryMessageID, append([]byte("BEGIN"), 0))
+	Expect(api.expectMessage(CommandCompleteMessageID)).To(Equal(append([]byte("BEGIN"), 0)))
+	Expect(api.expectMessage(ReadyForQueryMessageID)).To(Equal([]byte{ReadyForQueryTransaction}))
+	Expect(source(api, "SELECT source")).To(ContainSubstring("tx"))
+
+	// an error fails the transaction until it's rolled back
+	api.writeMessage(QueryMessageID, append([]byte("SELECT fail"), 0))
+	api.expectMessage(ErrorResponseMessageID)
+	Expect(api.expectMessage(ReadyForQueryMessageID)).To(Equal([]byte{ReadyForQueryError}))
+	api.writeMessage(QueryMessageID, append([]byte("SELECT source"), 0))
+	Expect(errorFields(api.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeInFailedSQLTransaction))
+	api.expectMessage(ReadyForQueryMessageID)
+
+	api.writeMessage(QueryMessageID, append([]byte("COMMIT"), 0))
+	Expect(api.expectMessage(CommandCompleteMessageID)).To(Equal(append([]byte("ROLLBACK"), 0)))
+	Expect(api.expectMessage(ReadyForQueryMessageID)).To(Equal([]byte{ReadyForQueryIdle}))
+	Expect(source(api, "SELECT source")).To(ContainSubstring("default"))
+
+	// and the same through the extended protocol
+	ids, _ = api.extendedQuery("BEGIN")
+	Expect(string(ids)).To(Equal("12nC"))
+	ids, bodies = api.extendedQuery("SELECT source")
+	Expect(string(ids)).To(Equal("12TDC"))
+	Expect(string(bodies[3])).To(ContainSubstring("tx"))
+	api.extendedQuery("ROLLBACK")
+
+	// bad conditions are refused
+	_, err := srv.AddFixture(Fixture{Query: "SELECT 1", Session: &SessionCondition{TxStatus: "pending"}})
+	Expect(err).ToNot(BeNil())
+	_, err = srv.AddFixture(Fixture{Query: "SELECT 1", Session: &SessionCondition{ClientAddr: "localhost"}})
+	Expect(err).ToNot(BeNil())
+}
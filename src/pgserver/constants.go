@@ -52,6 +52,20 @@ const (
 	TerminateMessageID                       byte = 'X'
 )
 
+const (
+	AuthTypeOk                int32 = 0
+	AuthTypeKerberosV5        int32 = 2
+	AuthTypeCleartextPassword int32 = 3
+	AuthTypeMD5Password       int32 = 5
+	AuthTypeSCMCredential     int32 = 6
+	AuthTypeGSS               int32 = 7
+	AuthTypeGSSContinue       int32 = 8
+	AuthTypeSSPI              int32 = 9
+	AuthTypeSASL              int32 = 10
+	AuthTypeSASLContinue      int32 = 11
+	AuthTypeSASLFinal         int32 = 12
+)
+
 const (
 	ReadyForQueryIdle        byte = 'I'
 	ReadyForQueryTransaction byte = 'T'
@@ -68,7 +82,7 @@ const (
 	ErrorSeverity9P       byte = 'V'
 	ErrorSQLStateCode     byte = 'C'
 	ErrorMessage          byte = 'M'
-	ErrorDetail           byte = 'M'
+	ErrorDetail           byte = 'D'
 	ErrorHint             byte = 'H'
 	ErrorPosition         byte = 'P'
 	ErrorInternalPosition byte = 'p'
@@ -85,9 +99,67 @@ const (
 )
 
 const (
-	SQLStateCodeQueryCanceled string = "57014"
+	SQLStateCodeQueryCanceled                     string = "57014"
+	SQLStateCodeProtocolViolation                 string = "08P01"
+	SQLStateCodeInvalidAuthorizationSpecification string = "28000"
+	SQLStateCodeInvalidPassword                   string = "28P01"
+	SQLStateCodeFeatureNotSupported               string = "0A000"
+	SQLStateCodeInvalidCatalogName                string = "3D000"
+	SQLStateCodeTooManyConnections                string = "53300"
+	SQLStateCodeCannotConnectNow                  string = "57P03"
+	SQLStateCodeDataException                     string = "22000"
+	SQLStateCodeInvalidBinaryRepresentation       string = "22P03"
+	SQLStateCodeInvalidCursorName                 string = "34000"
+	SQLStateCodeInvalidSQLStatementName           string = "26000"
+	SQLStateCodeSerializationFailure              string = "40001"
+	SQLStateCodeInFailedSQLTransaction            string = "25P02"
+	SQLStateCodeNoActiveSQLTransaction            string = "25P01"
+	SQLStateCodeConnectionFailure                 string = "08006"
+	SQLStateCodeInternalError                     string = "XX000"
+)
+
+const (
+	LatestProtocolMinorVersion int32 = 2
+)
+
+// the longest messages postgres accepts, authentication responses are held to the small limit
+const (
+	MaxMessageLength     int32 = 1<<30 - 1
+	MaxAuthMessageLength int32 = 10000
+)
+
+const (
+	TLSHandshakeRecordType byte   = 0x16
+	ALPNProtocolPostgreSQL string = "postgresql"
+)
+
+const (
+	SASLMechanismSCRAMSHA256     string = "SCRAM-SHA-256"
+	SASLMechanismSCRAMSHA256Plus string = "SCRAM-SHA-256-PLUS"
+	ChannelBindingTypeEndPoint   string = "tls-server-end-point"
+)
+
+const (
+	OIDUnspecified int32 = 0
+	OIDBool        int32 = 16
+	OIDBytea       int32 = 17
+	OIDInt8        int32 = 20
+	OIDInt2        int32 = 21
+	OIDInt4        int32 = 23
+	OIDText        int32 = 25
+	OIDJSON        int32 = 114
+	OIDFloat4      int32 = 700
+	OIDFloat8      int32 = 701
+	OIDVarchar     int32 = 1043
+	OIDDate        int32 = 1082
+	OIDTimestamp   int32 = 1114
+	OIDTimestampTZ int32 = 1184
+	OIDNumeric     int32 = 1700
+	OIDUUID        int32 = 2950
+	OIDJSONB       int32 = 3802
 )
 
 const (
-	OIDInt4 int32 = 23
+	FormatText   int16 = 0
+	FormatBinary int16 = 1
 )
@@ -0,0 +1,177 @@
+package pgmock
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// closestFixtures is how many of the nearest fixtures are shown when a query doesn't match
+const closestFixtures = 3
+
+// sqlClauses start a new line when queries are laid out for diffing
+var sqlClauses = map[string]bool{
+	"FROM": true, "WHERE": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true, "OFFSET": true,
+	"JOIN": true, "LEFT": true, "RIGHT": true, "INNER": true, "FULL": true, "CROSS": true, "UNION": true,
+	"RETURNING": true, "VALUES": true, "SET": true, "ON": true,
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// diagnose explains why nothing matched the query, returning the detail and hint for the error. The detail has the
+// query as it's normalised along with the closest fixtures and how they differ, the hint is how to add a fixture.
+func (res *_Responder) diagnose(sql string) (string, string) {
+
+	normalized := normalizeSQL(sql)
+	hash := hashSQL(sql)
+	hint := fmt.Sprintf("register a response for hash %s with POST /%s, or add a fixture with PUT /fixtures", hash, hash)
+
+	// maintain concurrency
+	res.Lock()
+	type candidate struct {
+		Fixture  *_Fixture
+		Query    string
+		Distance int
+	}
+	candidates := []candidate{}
+	tokens := sqlTokenTexts(normalized)
+	for _, fixture := range res.Fixtures {
+		if fixture.Query == "" {
+			continue
+		}
+		query := fixture.Query
+		if fixture.Pattern == nil {
+			query = normalizeSQL(query)
+		}
+		candidates = append(candidates, candidate{fixture, query, editDistance(tokens, sqlTokenTexts(query))})
+	}
+	res.Unlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Distance < candidates[j].Distance })
+	if len(candidates) > closestFixtures {
+		candidates = candidates[:closestFixtures]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "normalized: %s", normalized)
+	if len(candidates) > 0 {
+		b.WriteString("\nclosest fixtures:")
+	}
+	for i, c := range candidates {
+		name := fmt.Sprintf("fixture %s", c.Fixture.ID)
+		fmt.Fprintf(&b, "\n%d. %s ( %s, distance %d )\n", i+1, name, c.Fixture.Match, c.Distance)
+		b.WriteString(unifiedDiff(sqlLines(c.Query), sqlLines(normalized), name, "query"))
+	}
+	log.Warnf("no fixture matched query\n%s\n%s", b.String(), hint)
+
+	return b.String(), hint
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sqlTokenTexts is the text of each of the query's tokens
+func sqlTokenTexts(sql string) []string {
+	texts := []string{}
+	for _, t := range tokenizeSQL(sql) {
+		texts = append(texts, t.Text)
+	}
+	return texts
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sqlLines lays a normalised query out with each clause on its own line, so diffs point at the clause that differs
+func sqlLines(sql string) []string {
+
+	lines, current := []string{}, []_SQLToken{}
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind == sqlTokenWord && sqlClauses[strings.ToUpper(t.Text)] && len(current) > 0 {
+			lines = append(lines, joinSQLTokens(current, normalizedSQLToken))
+			current = nil
+		}
+		current = append(current, t)
+	}
+	if len(current) > 0 {
+		lines = append(lines, joinSQLTokens(current, normalizedSQLToken))
+	}
+
+	return lines
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// editDistance is the levenshtein distance between two lists of tokens
+func editDistance(a, b []string) int {
+
+	prev, curr := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// unifiedDiff diffs the lines of from against to, showing every line as queries are short enough not to need hunks
+func unifiedDiff(from, to []string, fromName, toName string) string {
+
+	// longest common subsequence table, lcs[i][j] is for from[i:] and to[j:]
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n@@ -1,%d +1,%d @@", fromName, toName, len(from), len(to))
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			b.WriteString("\n " + from[i])
+			i, j = i+1, j+1
+		case j >= len(to) || (i < len(from) && lcs[i+1][j] >= lcs[i][j+1]):
+			b.WriteString("\n-" + from[i])
+			i++
+		default:
+			b.WriteString("\n+" + to[j])
+			j++
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,73 @@
+package pgmock
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestDiagnostics(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	for _, query := range []string{
+		"SELECT id, name FROM users WHERE id = $1",
+		"SELECT id FROM orders",
+		"DELETE FROM sessions WHERE expires < now()",
+		"UPDATE users SET name = $1",
+	} {
+		_, err := srv.AddFixture(Fixture{Query: query, Match: MatchNormalized})
+		Expect(err).To(BeNil())
+	}
+
+	// a typo in the column list
+	sql := "select id, nmae from users where id = $1"
+	detail, hint := srv.Responder.diagnose(sql)
+
+	// assert the results
+	lines := strings.Split(detail, "\n")
+	Expect(lines[0]).To(Equal("normalized: SELECT id,nmae FROM users WHERE id = $1"))
+	Expect(lines[1]).To(Equal("closest fixtures:"))
+	Expect(lines[2]).To(Equal("1. fixture 1 ( normalized, distance 1 )"))
+	Expect(lines[3:8]).To(Equal([]string{
+		"--- fixture 1",
+		"+++ query",
+		"@@ -1,3 +1,3 @@",
+		"-SELECT id,name",
+		"+SELECT id,nmae",
+	}))
+	Expect(lines[8:10]).To(Equal([]string{" FROM users", " WHERE id = $1"}))
+	Expect(strings.Count(detail, "fixture ")).To(Equal(2 * closestFixtures))
+	Expect(hint).To(ContainSubstring(hashSQL(sql)))
+
+	// and over the wire
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	ids, bodies := c.query(sql)
+	Expect(string(ids)).To(Equal("E"))
+	fields := errorFields(bodies[0])
+	Expect(fields[ErrorMessage]).To(Equal("No Response for query, err: No response found for hash " + hashSQL(sql)))
+	Expect(fields[ErrorDetail]).To(Equal(detail))
+	Expect(fields[ErrorHint]).To(Equal(hint))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestUnifiedDiff(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// assert the results
+	Expect(editDistance([]string{"a", "b", "c"}, []string{"a", "c", "d"})).To(Equal(2))
+	Expect(unifiedDiff([]string{"a", "b", "c"}, []string{"a", "c", "d"}, "x", "y")).
+		To(Equal("--- x\n+++ y\n@@ -1,3 +1,3 @@\n a\n-b\n c\n+d"))
+	Expect(sqlLines("SELECT a FROM t JOIN u ON t.id=u.id WHERE a=1 ORDER BY a")).
+		To(Equal([]string{"SELECT a", "FROM t", "JOIN u", "ON t.id = u.id", "WHERE a = 1", "ORDER BY a"}))
+}
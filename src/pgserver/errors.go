@@ -0,0 +1,55 @@
+package pgmock
+
+import (
+	"fmt"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// PgError is an error that gets sent to the client as an ErrorResponse, return one from an Authenticator to control
+// exactly what the client sees rather than the generic failure
+type PgError struct {
+	Severity string `json:"severity,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (e *PgError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// response converts the error into the wire message, severity defaults to ERROR
+func (e *PgError) response() *_ErrorResponse {
+
+	severity := e.Severity
+	if severity == "" {
+		severity = "ERROR"
+	}
+
+	res := (&_ErrorResponse{}).
+		AddErrorField(ErrorSeverity, severity).
+		AddErrorField(ErrorSeverity9P, severity).
+		AddErrorField(ErrorSQLStateCode, e.Code).
+		AddErrorField(ErrorMessage, e.Message)
+	if e.Detail != "" {
+		res.AddErrorField(ErrorDetail, e.Detail)
+	}
+	if e.Hint != "" {
+		res.AddErrorField(ErrorHint, e.Hint)
+	}
+
+	return res
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// fatalError is shorthand for the FATAL errors that end a connection
+func fatalError(code, message string) *PgError {
+	return &PgError{Severity: "FATAL", Code: code, Message: message}
+}
@@ -0,0 +1,258 @@
+package pgmock
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// EventType is the kind of thing that happened on the server
+type EventType string
+
+const (
+	// EventConnectionOpened is a client connecting
+	EventConnectionOpened EventType = "connection_opened"
+	// EventConnectionClosed is a connection going away, for whatever reason
+	EventConnectionClosed EventType = "connection_closed"
+	// EventStartup is a client's startup message, with the parameters it asked for
+	EventStartup EventType = "startup"
+	// EventAuthentication is the outcome of authenticating a client, with the error if it failed
+	EventAuthentication EventType = "authentication"
+	// EventQuery is a query being run by a Query or bound by a Bind
+	EventQuery EventType = "query"
+	// EventMatch is a fixture answering a query
+	EventMatch EventType = "match"
+	// EventMiss is a query no fixture matched, before the unmatched policy is applied
+	EventMiss EventType = "miss"
+	// EventError is an error sent to a client
+	EventError EventType = "error"
+	// EventMessageReceived is a message received from a client once it's past startup
+	EventMessageReceived EventType = "message_received"
+	// EventMessageSent is a message sent to a client from its startup on
+	EventMessageSent EventType = "message_sent"
+)
+
+// eventBuffer is how many events a subscriber can fall behind by before events are dropped for it
+const eventBuffer = 256
+
+// backendMessageNames names the messages sent to clients
+var backendMessageNames = map[byte]string{
+	AuthenticationOkMessageID:         "Authentication",
+	BackendKeyDataMessageID:           "BackendKeyData",
+	BindCompleteMessageID:             "BindComplete",
+	CloseCompleteMessageID:            "CloseComplete",
+	CommandCompleteMessageID:          "CommandComplete",
+	CopyDataMessageID:                 "CopyData",
+	CopyDoneMessageID:                 "CopyDone",
+	CopyInResponseMessageID:           "CopyInResponse",
+	CopyOutResponseMessageID:          "CopyOutResponse",
+	CopyBothResponseMessageID:         "CopyBothResponse",
+	DataRowMessageID:                  "DataRow",
+	EmptyQueryResponseMessageID:       "EmptyQueryResponse",
+	ErrorResponseMessageID:            "ErrorResponse",
+	FunctionCallResponseMessageID:     "FunctionCallResponse",
+	NegotiateProtocolVersionMessageID: "NegotiateProtocolVersion",
+	NoDataMessageID:                   "NoData",
+	NoticeResponseMessageID:           "NoticeResponse",
+	NotificationResponseMessageID:     "NotificationResponse",
+	ParameterDescriptionMessageID:     "ParameterDescription",
+	ParameterStatusMessageID:          "ParameterStatus",
+	ParseCompleteMessageID:            "ParseComplete",
+	PortalSuspendedMessageID:          "PortalSuspended",
+	ReadyForQueryMessageID:            "ReadyForQuery",
+	RowDescriptionMessageID:           "RowDescription",
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Event is something that happened on the server, ProcessID identifies the session it happened to. Message and Length
+// are the name and length of the messages received and sent.
+type Event struct {
+	Type       EventType         `json:"type"`
+	Time       time.Time         `json:"time"`
+	ProcessID  int32             `json:"processId"`
+	Message    string            `json:"message,omitempty"`
+	Length     int               `json:"length,omitempty"`
+	RemoteAddr string            `json:"remoteAddr,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	SQL        string            `json:"sql,omitempty"`
+	Params     []*string         `json:"params,omitempty"`
+	FixtureID  string            `json:"fixtureId,omitempty"`
+	Error      *PgError          `json:"error,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _Events hands out events to everyone subscribed, either over a channel or to a callback
+type _Events struct {
+	sync.Mutex
+	Subscribers map[int]*_Subscriber
+	NextID      int
+}
+
+// _Subscriber is sent the events of the given types, all of them if there are none
+type _Subscriber struct {
+	Types    map[EventType]bool
+	Channel  chan Event
+	Callback func(Event)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// add subscribes to events of the types, returning the function that unsubscribes and closes the channel if there is
+// one
+func (events *_Events) add(subscriber *_Subscriber, types []EventType) func() {
+
+	// maintain concurrency
+	events.Lock()
+	defer events.Unlock()
+
+	if len(types) > 0 {
+		subscriber.Types = map[EventType]bool{}
+		for _, t := range types {
+			subscriber.Types[t] = true
+		}
+	}
+	if events.Subscribers == nil {
+		events.Subscribers = map[int]*_Subscriber{}
+	}
+	events.NextID++
+	id := events.NextID
+	events.Subscribers[id] = subscriber
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			events.Lock()
+			delete(events.Subscribers, id)
+			if subscriber.Channel != nil {
+				close(subscriber.Channel)
+			}
+			events.Unlock()
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// subscribe returns a channel of events of the types along with the function that unsubscribes and closes it
+func (events *_Events) subscribe(types []EventType) (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	return ch, events.add(&_Subscriber{Channel: ch}, types)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// publish sends the event to every subscriber. Channels that have fallen too far behind miss it rather than hold up
+// the sessions, callbacks are called once the lock's released so they can use the server.
+func (events *_Events) publish(event Event) {
+
+	// maintain concurrency
+	events.Lock()
+	callbacks := []func(Event){}
+	for id, subscriber := range events.Subscribers {
+		if subscriber.Types != nil && !subscriber.Types[event.Type] {
+			continue
+		}
+		if subscriber.Callback != nil {
+			callbacks = append(callbacks, subscriber.Callback)
+			continue
+		}
+		select {
+		case subscriber.Channel <- event:
+		default:
+			log.Warnf("event subscriber %d is falling behind, dropped %s event", id, event.Type)
+		}
+	}
+	events.Unlock()
+
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// emit publishes an event for the session, if anything's listening
+func (session *_Session) emit(event Event) {
+	if session == nil || session.Events == nil {
+		return
+	}
+	event.Time, event.ProcessID = time.Now(), session.Key.ProcessID
+	session.Events.publish(event)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _MessageTap sits between a session and its connection publishing an event for each message written, it has to be
+// put in place at a message boundary
+type _MessageTap struct {
+	io.ReadWriter
+	Session   *_Session
+	Header    [5]byte
+	HeaderLen int
+	Remaining int
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// tapMessages starts publishing the messages sent to the client, from the next one on
+func (session *_Session) tapMessages() {
+	if session.Events == nil {
+		return
+	}
+	session.Messenger.Stream = &_MessageTap{ReadWriter: session.Messenger.Stream, Session: session}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Write writes to the connection, working out where the messages written start and end as it goes
+func (tap *_MessageTap) Write(p []byte) (int, error) {
+
+	n, err := tap.ReadWriter.Write(p)
+	for written := p[:n]; len(written) > 0; {
+
+		// the message id and length come first
+		if tap.HeaderLen < len(tap.Header) {
+			copied := copy(tap.Header[tap.HeaderLen:], written)
+			tap.HeaderLen += copied
+			written = written[copied:]
+			if tap.HeaderLen < len(tap.Header) {
+				break
+			}
+			tap.Remaining = int(binary.BigEndian.Uint32(tap.Header[1:])) - 4
+		}
+
+		// then the body
+		skipped := tap.Remaining
+		if skipped > len(written) {
+			skipped = len(written)
+		}
+		tap.Remaining -= skipped
+		written = written[skipped:]
+
+		if tap.Remaining <= 0 {
+			tap.sent()
+		}
+	}
+
+	return n, err
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sent publishes the message that's just been written
+func (tap *_MessageTap) sent() {
+	length := int(binary.BigEndian.Uint32(tap.Header[1:]))
+	name := backendMessageNames[tap.Header[0]]
+	if name == "" {
+		name = string(tap.Header[0])
+	}
+	tap.Session.emit(Event{Type: EventMessageSent, Message: name, Length: length})
+	tap.HeaderLen, tap.Remaining = 0, 0
+}
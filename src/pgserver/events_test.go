@@ -0,0 +1,103 @@
+package pgmock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestEvents(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	id, err := srv.AddFixture(Fixture{Query: "SELECT 1", Columns: []string{"n:int4"}, Rows: [][]interface{}{{"1"}}})
+	Expect(err).To(BeNil())
+
+	events, unsubscribe := srv.Subscribe(EventConnectionOpened, EventStartup, EventAuthentication, EventQuery, EventMatch,
+		EventMiss, EventError, EventConnectionClosed)
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	c.query("SELECT 1")
+	c.query("SELECT 2")
+	c.Conn.Close()
+
+	// assert the results
+	received := []Event{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < 9 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-timeout:
+			t.Fatalf("only received %d events", len(received))
+		}
+	}
+	types := []EventType{}
+	for _, event := range received {
+		types = append(types, event.Type)
+		Expect(event.ProcessID).To(Equal(received[0].ProcessID))
+	}
+	Expect(types).To(Equal([]EventType{
+		EventConnectionOpened, EventStartup, EventAuthentication, EventQuery, EventMatch, EventQuery, EventMiss,
+		EventError, EventConnectionClosed,
+	}))
+	Expect(received[1].Parameters).To(Equal(map[string]string{"user": "test", "database": "test"}))
+	Expect(received[2].Error).To(BeNil())
+	Expect(received[4].FixtureID).To(Equal(id))
+	Expect(received[6].SQL).To(Equal("SELECT 2"))
+	Expect(received[7].Error.Code).To(Equal(SQLStateCodeDataException))
+
+	// unsubscribing closes the channel
+	unsubscribe()
+	unsubscribe()
+	_, open := <-events
+	Expect(open).To(BeFalse())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestEventCallbacks(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	_, err := srv.AddFixture(Fixture{Query: "SELECT 1", Columns: []string{"n:int4"}, Rows: [][]interface{}{{"1"}}})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// the messages are tapped on their way out, so the client can see them before the callback does
+	var lock sync.Mutex
+	messages := []string{}
+	unregister := srv.OnEvent(func(event Event) {
+		lock.Lock()
+		messages = append(messages, string(event.Type)+" "+event.Message)
+		lock.Unlock()
+	}, EventMessageReceived, EventMessageSent)
+	got := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, messages...)
+	}
+
+	// assert the results
+	c.query("SELECT 1")
+	Eventually(got).Should(Equal([]string{
+		"message_received Query", "message_sent RowDescription", "message_sent DataRow",
+		"message_sent CommandComplete", "message_sent ReadyForQuery",
+	}))
+
+	// and nothing more once it's unregistered
+	unregister()
+	c.query("SELECT 1")
+	Consistently(got, 100*time.Millisecond).Should(HaveLen(5))
+}
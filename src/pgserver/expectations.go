@@ -0,0 +1,173 @@
+package pgmock
+
+import (
+	"fmt"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Expectation is how often a fixture expects to be used, Max nil for no upper limit. Fixtures with an Order have to be
+// used for the first time in ascending order.
+type Expectation struct {
+	Min   int  `json:"min"`
+	Max   *int `json:"max,omitempty"`
+	Order int  `json:"order,omitempty"`
+}
+
+// ExpectOnce expects the fixture to be used exactly once
+func ExpectOnce() *Expectation { return ExpectTimes(1) }
+
+// ExpectTimes expects the fixture to be used exactly n times
+func ExpectTimes(n int) *Expectation { return &Expectation{Min: n, Max: &n} }
+
+// ExpectAtLeast expects the fixture to be used n times or more
+func ExpectAtLeast(n int) *Expectation { return &Expectation{Min: n} }
+
+// ExpectNever expects the fixture not to be used at all
+func ExpectNever() *Expectation { return ExpectTimes(0) }
+
+// InOrder sets the order the fixture has to be first used in, returning the expectation
+func (expect *Expectation) InOrder(order int) *Expectation {
+	expect.Order = order
+	return expect
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Verification is the outcome of checking the expectations, along with the queries received since the journal was
+// last cleared, the most recent DefaultJournalSize of them
+type Verification struct {
+	Failures []ExpectationFailure `json:"failures"`
+	Received []string             `json:"received"`
+}
+
+// ExpectationFailure is an expectation that hasn't been met or has been broken, Received are the queries the fixture
+// answered, kept the same way as Verification's
+type ExpectationFailure struct {
+	FixtureID string   `json:"fixtureId"`
+	Query     string   `json:"query"`
+	Expected  string   `json:"expected"`
+	Calls     int      `json:"calls"`
+	Problem   string   `json:"problem"`
+	Received  []string `json:"received"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// validate checks the expectation is possible
+func (expect *Expectation) validate() error {
+	if expect.Min < 0 || (expect.Max != nil && *expect.Max < expect.Min) {
+		return fmt.Errorf("expectation can never be met")
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// String describes the expectation
+func (expect *Expectation) String() string {
+	switch {
+	case expect.Max == nil:
+		return fmt.Sprintf("at least %d", expect.Min)
+	case *expect.Max == 0:
+		return "never"
+	case *expect.Max == expect.Min:
+		return fmt.Sprintf("exactly %d", expect.Min)
+	default:
+		return fmt.Sprintf("between %d and %d", expect.Min, *expect.Max)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// called records a use of the fixture, checking it's in order. The caller must hold the lock.
+func (res *_Responder) called(fixture *_Fixture, sql string) {
+
+	if fixture.Expect != nil && fixture.Expect.Order > 0 && fixture.Calls == 0 {
+		for _, other := range res.Fixtures {
+			if other.Expect != nil && other.Expect.Order > 0 && other.Expect.Order < fixture.Expect.Order && other.Calls == 0 {
+				fixture.OrderProblem = fmt.Sprintf("used before fixture %s ( order %d )", other.ID, other.Expect.Order)
+				break
+			}
+		}
+	}
+
+	fixture.Calls++
+	fixture.Received = keepReceived(fixture.Received, sql)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// received records a query arriving, whether or not anything matched it
+func (res *_Responder) received(sql string) {
+	res.Lock()
+	res.Received = keepReceived(res.Received, sql)
+	res.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// clearReceived forgets the queries received so far, along with the ones each fixture answered
+func (res *_Responder) clearReceived() {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	res.Received = nil
+	for _, fixture := range res.Fixtures {
+		fixture.Received = nil
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// keepReceived adds the query to the received ones, dropping the oldest once there are as many as the journal keeps
+// by default so long running servers don't grow without bound
+func keepReceived(received []string, sql string) []string {
+	received = append(received, sql)
+	if over := len(received) - DefaultJournalSize; over > 0 {
+		received = append([]string{}, received[over:]...)
+	}
+	return received
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// verify checks every fixture with an expectation against how often it's been used
+func (res *_Responder) verify() *Verification {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	verification := &Verification{Failures: []ExpectationFailure{}, Received: append([]string{}, res.Received...)}
+	for _, fixture := range res.Fixtures {
+
+		expect := fixture.Expect
+		if expect == nil {
+			continue
+		}
+
+		problem := fixture.OrderProblem
+		if fixture.Calls < expect.Min {
+			problem = fmt.Sprintf("used %d times, short by %d", fixture.Calls, expect.Min-fixture.Calls)
+		} else if expect.Max != nil && fixture.Calls > *expect.Max {
+			problem = fmt.Sprintf("used %d times, %d too many", fixture.Calls, fixture.Calls-*expect.Max)
+		}
+		if problem == "" {
+			continue
+		}
+
+		verification.Failures = append(verification.Failures, ExpectationFailure{
+			FixtureID: fixture.ID,
+			Query:     fixture.Query,
+			Expected:  expect.String(),
+			Calls:     fixture.Calls,
+			Problem:   problem,
+			Received:  append([]string{}, fixture.Received...),
+		})
+	}
+
+	return verification
+}
@@ -0,0 +1,83 @@
+package pgmock
+
+import (
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestExpectations(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	fixtures := []Fixture{
+		{Query: "BEGIN", Expect: ExpectOnce().InOrder(1)},
+		{Query: "INSERT INTO orders VALUES (1)", Expect: ExpectTimes(2).InOrder(2)},
+		{Query: "SELECT count(*) FROM orders", Columns: []string{"count:int4"}, Rows: [][]interface{}{{"1"}}, Expect: ExpectAtLeast(1)},
+		{Query: "DELETE FROM orders", Expect: ExpectNever()},
+	}
+	ids := []string{}
+	for _, fixture := range fixtures {
+		id, err := srv.AddFixture(fixture)
+		Expect(err).To(BeNil())
+		ids = append(ids, id)
+	}
+	_, err := srv.AddFixture(Fixture{Query: "SELECT 1", Expect: &Expectation{Min: 2, Max: new(int)}})
+	Expect(err).ToNot(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// nothing has been used yet
+	verification := srv.Verify()
+	Expect(verification.Received).To(BeEmpty())
+	Expect(verification.Failures).To(HaveLen(3))
+	Expect(verification.Failures[0].Expected).To(Equal("exactly 1"))
+	Expect(verification.Failures[2].Expected).To(Equal("at least 1"))
+
+	// the insert comes before the begin, and the delete shouldn't happen at all
+	c.query("INSERT INTO orders VALUES (1)")
+	c.query("BEGIN")
+	c.query("INSERT INTO orders VALUES (1)")
+	c.query("SELECT count(*) FROM orders")
+	c.query("DELETE FROM orders")
+	c.query("SELECT 2")
+
+	// assert the results
+	verification = srv.Verify()
+	Expect(verification.Received).To(Equal([]string{
+		"INSERT INTO orders VALUES (1)", "BEGIN", "INSERT INTO orders VALUES (1)", "SELECT count(*) FROM orders",
+		"DELETE FROM orders", "SELECT 2",
+	}))
+	Expect(verification.Failures).To(Equal([]ExpectationFailure{
+		{
+			FixtureID: ids[1], Query: "INSERT INTO orders VALUES (1)", Expected: "exactly 2", Calls: 2,
+			Problem:  "used before fixture " + ids[0] + " ( order 1 )",
+			Received: []string{"INSERT INTO orders VALUES (1)", "INSERT INTO orders VALUES (1)"},
+		},
+		{
+			FixtureID: ids[3], Query: "DELETE FROM orders", Expected: "never", Calls: 1,
+			Problem: "used 1 times, 1 too many", Received: []string{"DELETE FROM orders"},
+		},
+	}))
+	// clearing the journal forgets what's been received, but not the calls
+	srv.ClearJournal()
+	verification = srv.Verify()
+	Expect(verification.Received).To(BeEmpty())
+	Expect(verification.Failures[1].Calls).To(Equal(1))
+	Expect(verification.Failures[1].Received).To(BeEmpty())
+
+	// and only the most recent are kept
+	received := []string{}
+	for i := 0; i < DefaultJournalSize+2; i++ {
+		received = keepReceived(received, strconv.Itoa(i))
+	}
+	Expect(received).To(HaveLen(DefaultJournalSize))
+	Expect(received[0]).To(Equal("2"))
+}
@@ -0,0 +1,485 @@
+package pgmock
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// MatchMode controls how a fixture's query is compared against the queries clients send
+type MatchMode string
+
+const (
+	// MatchExact needs the query text to be identical, byte for byte
+	MatchExact MatchMode = "exact"
+	// MatchNormalized ignores comments, whitespace, keyword case and trailing semicolons
+	MatchNormalized MatchMode = "normalized"
+	// MatchFingerprint is normalized with the literals swapped for placeholders, so only the shape of the query matters
+	MatchFingerprint MatchMode = "fingerprint"
+	// MatchRegex matches the query text against a regular expression, capture groups become the params
+	MatchRegex MatchMode = "regex"
+	// MatchGlob matches the whole query text against a glob where * is any run of characters and ? is any single one,
+	// each wildcard becomes a param
+	MatchGlob MatchMode = "glob"
+)
+
+// ExhaustMode controls what a fixture does once it has used up all of its responses
+type ExhaustMode string
+
+const (
+	// ExhaustRepeat keeps on returning the last response
+	ExhaustRepeat ExhaustMode = "repeat"
+	// ExhaustCycle starts again from the first response
+	ExhaustCycle ExhaustMode = "cycle"
+	// ExhaustError stops the fixture matching, so queries fall through to the next fixture or fail with no response
+	ExhaustError ExhaustMode = "error"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Fixture is a canned response for a query, columns are given as name:type pairs. Regex and glob fixtures are tried
+// after the others, highest priority first. Params, when given, have to match the query's arguments as well as the
+// query itself, for queries without bind arguments they're checked against the literals or captures instead.
+//
+// A fixture answers with its Columns and Rows, or Error if it's set, for Times calls ( 0 for no limit ). Responses
+// replaces that with a sequence used one call at a time, each entry answering once unless it has Times of its own and
+// taking the fixture's columns if it doesn't give any. Exhausted says what happens once they're all used up, repeating
+// the last response for sequences and no longer matching otherwise.
+//
+// Fixtures in a Scenario only match while it's in RequiredState ( any state if that's empty ) and move it on to
+// NewState, if there is one, when they do. Session restricts the fixture to sessions with matching attributes.
+//
+// With Template set, string values in the rows are text/template templates evaluated against a TemplateData for every
+// query, so {{param 1}} echoes the first argument back. Expect is how often the fixture should be used, checked with
+// Verify. Webhook hands the query to the URL to answer instead, see WebhookRequest, and Handler to a HandlerFunc, any
+// Columns describe statements before they're bound and are used for answers that don't have columns of their own.
+// Describe works the columns out from the query instead.
+type Fixture struct {
+	ID            string            `json:"id,omitempty"`
+	Query         string            `json:"query"`
+	Match         MatchMode         `json:"match,omitempty"`
+	Priority      int               `json:"priority,omitempty"`
+	Params        []ParamMatcher    `json:"params,omitempty"`
+	Columns       []string          `json:"cols"`
+	Rows          [][]interface{}   `json:"rows"`
+	Error         *PgError          `json:"error,omitempty"`
+	Times         int               `json:"times,omitempty"`
+	Responses     []FixtureResponse `json:"responses,omitempty"`
+	Exhausted     ExhaustMode       `json:"exhausted,omitempty"`
+	Scenario      string            `json:"scenario,omitempty"`
+	RequiredState string            `json:"requiredState,omitempty"`
+	NewState      string            `json:"newState,omitempty"`
+	Session       *SessionCondition `json:"session,omitempty"`
+	Template      bool              `json:"template,omitempty"`
+	Expect        *Expectation      `json:"expect,omitempty"`
+	Webhook       string            `json:"webhook,omitempty"`
+	Handler       HandlerFunc       `json:"-"`
+	Describe      DescribeFunc      `json:"-"`
+}
+
+// FixtureResponse is one response in a fixture's sequence, either rows or an error
+type FixtureResponse struct {
+	Columns []string        `json:"cols,omitempty"`
+	Rows    [][]interface{} `json:"rows,omitempty"`
+	Error   *PgError        `json:"error,omitempty"`
+	Times   int             `json:"times,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _QueryResponse is what gets sent back for a query, the error instead of the rows if there is one. Times is how many
+// calls it answers in its fixture's sequence, 0 for no limit. Templates holds the templated cells of the rows, nil for
+// the ones that are sent as they are. Tag replaces the usual SELECT n command tag. Responses with a Webhook or Handler
+// are replaced by their answer before they're sent.
+type _QueryResponse struct {
+	Columns        *_RowDescription
+	Rows           []*_DataRow
+	Error          *PgError
+	Times          int
+	Templates      [][]*template.Template
+	Tag            string
+	Webhook        string
+	WebhookTimeout time.Duration
+	Handler        HandlerFunc
+	Describe       DescribeFunc
+}
+
+// _Fixture is a Fixture ready for matching, Key is the hash of the query once it's been through the match mode, or the
+// pattern itself for regex and glob fixtures. Query is the original query, kept to explain misses. Position and Used
+// track how far through its responses the fixture is, Calls and Received how often and by what it's been used.
+type _Fixture struct {
+	ID            string
+	Query         string
+	Match         MatchMode
+	Key           string
+	Pattern       *regexp.Regexp
+	Priority      int
+	Matchers      []*_ParamMatcher
+	MatchersKey   string
+	Responses     []*_QueryResponse
+	Exhausted     ExhaustMode
+	Position      int
+	Used          int
+	Scenario      string
+	RequiredState string
+	NewState      string
+	Condition     *SessionCondition
+	Expect        *Expectation
+	Calls         int
+	Received      []string
+	OrderProblem  string
+}
+
+// _QueryMatch is the result of matching a query, Params holds the values the query was called with, nil for NULL.
+// They're the bind arguments for extended queries, otherwise the literals pulled out by fingerprint matches or the
+// capture groups of patterns. Named capture groups are in Captures as well. Unmatched queries being passed through
+// have Upstream set and no response.
+type _QueryMatch struct {
+	Fixture  *_Fixture
+	Response *_QueryResponse
+	Params   []*string
+	Captures map[string]string
+	Upstream *UnmatchedPolicy
+}
+
+// _Responder holds the fixtures and finds the one to answer each query, along with the state of the scenarios. Per
+// session scenarios keep their state in SessionScenarios rather than Scenarios. Policies are the unmatched policies
+// by database, "" for the server's, and Changed is closed whenever the fixtures change. Received is the most
+// recent queries to arrive, and Pending the unmatched queries held waiting for an answer.
+type _Responder struct {
+	sync.Mutex
+	Fixtures         []*_Fixture
+	NextID           int
+	Scenarios        map[string]string
+	SessionScenarios map[_SessionKey]map[string]string
+	PerSession       map[string]bool
+	Sequences        map[string]int64
+	Policies         map[string]*UnmatchedPolicy
+	Changed          chan struct{}
+	Received         []string
+	Pending          []*_PendingQuery
+	NextPendingID    int
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// hashSQL is the upper case hex sha1 of the query, the same hash used to inject responses over http
+func hashSQL(sql string) string {
+	h := sha1.New()
+	h.Write([]byte(sql))
+	return fmt.Sprintf("%X", h.Sum(nil))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matchKey works out the key to match on for a query under the given mode, along with any literals the mode takes
+// out of the query
+func matchKey(mode MatchMode, sql string) (string, []string) {
+	switch mode {
+	case MatchNormalized:
+		return hashSQL(normalizeSQL(sql)), nil
+	case MatchFingerprint:
+		fingerprint, literals := fingerprintSQL(sql)
+		return hashSQL(fingerprint), literals
+	default:
+		return hashSQL(sql), nil
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// compilePattern compiles the regex or glob for a pattern fixture
+func compilePattern(mode MatchMode, pattern string) (*regexp.Regexp, error) {
+
+	if mode == MatchRegex {
+		return regexp.Compile(pattern)
+	}
+
+	// globs match the whole query, with each wildcard as a capture group
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString("(.*?)")
+		case '?':
+			b.WriteString("(.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// add stores the fixture, replacing any existing one for the same query, mode, params, session condition and scenario
+// state, and returns its ID. A replacement keeps the old fixture's ID unless it was given one of its own.
+func (res *_Responder) add(fixture *_Fixture) string {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	replaced := false
+	for i, existing := range res.Fixtures {
+		if existing.Match == fixture.Match && existing.Key == fixture.Key && existing.MatchersKey == fixture.MatchersKey &&
+			existing.Scenario == fixture.Scenario && existing.RequiredState == fixture.RequiredState {
+			if fixture.ID == "" {
+				fixture.ID = existing.ID
+			}
+			res.Fixtures[i] = fixture
+			replaced = true
+			break
+		}
+	}
+
+	if !replaced {
+		if fixture.ID == "" {
+			res.NextID++
+			fixture.ID = fmt.Sprintf("%d", res.NextID)
+		}
+		res.Fixtures = append(res.Fixtures, fixture)
+	}
+
+	// wake up anything waiting on a new fixture
+	close(res.changed())
+	res.Changed = nil
+
+	// keep the patterns after everything else in priority order, otherwise the order they were added in
+	sort.SliceStable(res.Fixtures, func(i, j int) bool {
+		a, b := res.Fixtures[i], res.Fixtures[j]
+		if (a.Pattern != nil) != (b.Pattern != nil) {
+			return b.Pattern != nil
+		}
+		return a.Priority > b.Priority
+	})
+
+	return fixture.ID
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// find returns the match for the query, or nil if no fixture matches it. args are the bind arguments for extended
+// queries and nil for simple ones, session is the session asking which may be nil.
+func (res *_Responder) find(sql string, args []*string, session *_Session) *_QueryMatch {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	// only work out each key once however many fixtures there are
+	keys, literals := map[MatchMode]string{}, map[MatchMode][]string{}
+	for _, fixture := range res.Fixtures {
+
+		var match *_QueryMatch
+
+		// patterns match on the raw text
+		if fixture.Pattern != nil {
+			match = matchPattern(fixture, sql)
+		} else {
+			key, found := keys[fixture.Match]
+			if !found {
+				key, literals[fixture.Match] = matchKey(fixture.Match, sql)
+				keys[fixture.Match] = key
+			}
+			if key == fixture.Key {
+				match = &_QueryMatch{Fixture: fixture, Params: stringParams(literals[fixture.Match])}
+			}
+		}
+		if match == nil {
+			continue
+		}
+
+		// bind arguments take precedence over anything pulled out of the text
+		if args != nil {
+			match.Params = args
+		}
+		if !matchParams(fixture.Matchers, match.Params) || !res.inState(fixture, session) || !fixture.Condition.matches(session) {
+			continue
+		}
+
+		// only now it's definitely this fixture does it use up a response
+		if match.Response = fixture.next(); match.Response == nil {
+			log.Infof("fixture %s has no responses left", fixture.ID)
+			continue
+		}
+		res.called(fixture, sql)
+		match.Response = res.render(match.Response, match, session)
+		if fixture.Scenario != "" && fixture.NewState != "" {
+			res.setScenarioState(fixture.Scenario, fixture.NewState, session)
+		}
+
+		log.Infof("query matched fixture %s ( %s ), params: %d", fixture.ID, fixture.Match, len(match.Params))
+		return match
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describe returns the response of the first fixture matching the query regardless of its params, used to describe
+// prepared statements before any arguments are known
+func (res *_Responder) describe(sql string, session *_Session) *_QueryResponse {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	for _, fixture := range res.Fixtures {
+		response := fixture.peek()
+		if response == nil || !res.inState(fixture, session) || !fixture.Condition.matches(session) {
+			continue
+		}
+		if fixture.Pattern != nil {
+			if fixture.Pattern.MatchString(sql) {
+				return response
+			}
+			continue
+		}
+		if key, _ := matchKey(fixture.Match, sql); key == fixture.Key {
+			return response
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// inState checks the fixture's scenario is in the state it needs, the caller must hold the lock
+func (res *_Responder) inState(fixture *_Fixture, session *_Session) bool {
+	return fixture.Scenario == "" || fixture.RequiredState == "" ||
+		res.scenarioState(fixture.Scenario, session) == fixture.RequiredState
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// next uses up a call of the fixture's current response and returns it, or nil once an ExhaustError fixture has run
+// out. The caller must hold the responder's lock.
+func (fixture *_Fixture) next() *_QueryResponse {
+
+	response := fixture.peek()
+	if response == nil {
+		return nil
+	}
+
+	// cycling round means starting the count again
+	if fixture.Position >= len(fixture.Responses) && fixture.Exhausted == ExhaustCycle {
+		fixture.Position, fixture.Used = 0, 0
+	}
+	if fixture.Position >= len(fixture.Responses) {
+		return response
+	}
+
+	fixture.Used++
+	if response.Times > 0 && fixture.Used >= response.Times {
+		fixture.Position, fixture.Used = fixture.Position+1, 0
+	}
+
+	return response
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// peek returns the response the next call will get without using it up
+func (fixture *_Fixture) peek() *_QueryResponse {
+
+	if fixture.Position < len(fixture.Responses) {
+		return fixture.Responses[fixture.Position]
+	}
+
+	switch fixture.Exhausted {
+	case ExhaustRepeat:
+		return fixture.Responses[len(fixture.Responses)-1]
+	case ExhaustCycle:
+		return fixture.Responses[0]
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matchPattern matches the query against a regex or glob fixture, returning nil if it doesn't match
+func matchPattern(fixture *_Fixture, sql string) *_QueryMatch {
+
+	groups := fixture.Pattern.FindStringSubmatch(sql)
+	if groups == nil {
+		return nil
+	}
+
+	match := &_QueryMatch{Fixture: fixture, Params: stringParams(groups[1:]), Captures: map[string]string{}}
+	for i, name := range fixture.Pattern.SubexpNames() {
+		if name != "" {
+			match.Captures[name] = groups[i]
+		}
+	}
+
+	return match
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// buildQueryResponse converts the name:type columns and rows into the messages to send, nil values are NULL
+func buildQueryResponse(cols []string, rows [][]interface{}) (*_QueryResponse, error) {
+
+	response := &_QueryResponse{
+		Columns: &_RowDescription{
+			Fields: []*_RowDescriptionField{},
+		},
+		Rows: []*_DataRow{},
+	}
+
+	// split out the columns to build the _RowDescription things
+	for _, c := range cols {
+		bits := strings.Split(c, ":")
+		if len(bits) != 2 {
+			log.Errorf("column %s isn't a name:type pair", c)
+			return nil, errors.New("invalid column definition")
+		}
+		if _, found := rowDescs[bits[1]]; !found {
+			log.Errorf("unable to find field type for %s", bits[1])
+			return nil, errors.New("unable to find field type")
+		}
+		field := *rowDescs[bits[1]]
+		field.Name = bits[0]
+		response.Columns.Fields = append(response.Columns.Fields, &field)
+	}
+
+	for _, r := range rows {
+		cols := make([]*_DataRowColumn, 0)
+		for _, rData := range r {
+			switch v := rData.(type) {
+			case string:
+				cols = append(cols, &_DataRowColumn{Value: []byte(v)})
+			case float64:
+				cols = append(cols, &_DataRowColumn{Value: []byte(fmt.Sprintf("%f", v))})
+			case []byte:
+				cols = append(cols, &_DataRowColumn{Value: v})
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, bool:
+				cols = append(cols, &_DataRowColumn{Value: []byte(fmt.Sprint(v))})
+			case nil:
+				cols = append(cols, &_DataRowColumn{})
+			default:
+				return nil, fmt.Errorf("unsupported row value %v", v)
+			}
+		}
+		response.Rows = append(response.Rows, &_DataRow{Columns: cols})
+	}
+
+	return response, nil
+}
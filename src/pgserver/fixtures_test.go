@@ -0,0 +1,221 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestFixtureMatchModes(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with one fixture of each mode
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	exactID, err := srv.AddFixture(Fixture{
+		Query:   "SELECT name FROM users",
+		Columns: []string{"name:text"},
+		Rows:    [][]interface{}{{"exact"}},
+	})
+	Expect(err).To(BeNil())
+	normalizedID, err := srv.AddFixture(Fixture{
+		Query:   "select id from users where id = 1",
+		Match:   MatchNormalized,
+		Columns: []string{"id:text"},
+		Rows:    [][]interface{}{{"normalized"}},
+	})
+	Expect(err).To(BeNil())
+	Expect(normalizedID).ToNot(Equal(exactID))
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// exact only matches the exact text
+	ids, bodies := c.query("SELECT name FROM users")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(bodies[1]).To(ContainSubstring("exact"))
+	ids, _ = c.query("select name from users")
+	Expect(string(ids)).To(Equal("E"))
+
+	// normalized doesn't care about formatting
+	ids, bodies = c.query("SELECT id\n  FROM users -- by id\n WHERE id=1;")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(bodies[1]).To(ContainSubstring("normalized"))
+
+	// adding the same query again replaces the fixture rather than adding another
+	id, err := srv.AddFixture(Fixture{Query: "SELECT id FROM users WHERE id = 1", Match: MatchNormalized})
+	Expect(err).To(BeNil())
+	Expect(id).To(Equal(normalizedID))
+	Expect(srv.Responder.Fixtures).To(HaveLen(2))
+
+	// keeping the ID it was given if it has one
+	id, err = srv.AddFixture(Fixture{ID: "by-id", Query: "SELECT id FROM users WHERE id = 1", Match: MatchNormalized})
+	Expect(err).To(BeNil())
+	Expect(id).To(Equal("by-id"))
+	Expect(srv.Responder.Fixtures).To(HaveLen(2))
+
+	// and unknown modes and columns are refused
+	_, err = srv.AddFixture(Fixture{Query: "SELECT 1", Match: "fuzzy"})
+	Expect(err).ToNot(BeNil())
+	_, err = srv.AddFixture(Fixture{Query: "SELECT 1", Columns: []string{"id"}})
+	Expect(err).ToNot(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestFixtureFingerprint(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// one fixture for the shape of the query
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	_, err := srv.AddFixture(Fixture{
+		Query:   "SELECT name FROM users WHERE id = $1",
+		Match:   MatchFingerprint,
+		Columns: []string{"name:text"},
+		Rows:    [][]interface{}{{"bob"}},
+	})
+	Expect(err).To(BeNil())
+
+	// any literal matches it, with the literals handed over as the params
+	for _, sql := range []string{"SELECT name FROM users WHERE id = 1", "select name from users where id='x';"} {
+		match := srv.Responder.find(sql, nil, nil)
+		Expect(match).ToNot(BeNil(), sql)
+		Expect(match.Response.Rows).To(HaveLen(1))
+	}
+	Expect(srv.Responder.find("SELECT name FROM users WHERE id = 7", nil, nil).Params).To(Equal(stringParams([]string{"7"})))
+	Expect(srv.Responder.find("SELECT name FROM users WHERE email = 'x'", nil, nil)).To(BeNil())
+
+	// and over the wire
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	ids, _ := c.query("SELECT name FROM users WHERE id = 123")
+	Expect(string(ids)).To(Equal("TDC"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestFixturePatterns(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// a catch all glob, a more specific regex above it and an exact match that beats both
+	globID, err := srv.AddFixture(Fixture{Query: "SELECT * FROM users*", Match: MatchGlob, Columns: []string{"src:text"}, Rows: [][]interface{}{{"glob"}}})
+	Expect(err).To(BeNil())
+	regexID, err := srv.AddFixture(Fixture{
+		Query:    `^SELECT \* FROM users WHERE id IN \((?P<ids>[\d, ]+)\) ORDER BY (\w+)`,
+		Match:    MatchRegex,
+		Priority: 10,
+		Columns:  []string{"src:text"},
+		Rows:     [][]interface{}{{"regex"}},
+	})
+	Expect(err).To(BeNil())
+	exactID, err := srv.AddFixture(Fixture{Query: "SELECT * FROM users WHERE id IN (1) ORDER BY id", Columns: []string{"src:text"}})
+	Expect(err).To(BeNil())
+
+	// assert the results
+	Expect(srv.Responder.find("SELECT * FROM users WHERE id IN (1) ORDER BY id", nil, nil).Fixture.ID).To(Equal(exactID))
+
+	match := srv.Responder.find("SELECT * FROM users WHERE id IN (1, 2, 3) ORDER BY name DESC", nil, nil)
+	Expect(match.Fixture.ID).To(Equal(regexID))
+	Expect(match.Params).To(Equal(stringParams([]string{"1, 2, 3", "name"})))
+	Expect(match.Captures).To(Equal(map[string]string{"ids": "1, 2, 3"}))
+
+	match = srv.Responder.find("SELECT * FROM users LIMIT 5", nil, nil)
+	Expect(match.Fixture.ID).To(Equal(globID))
+	Expect(match.Params).To(Equal(stringParams([]string{"*", " LIMIT 5"})))
+
+	// globs match the whole query
+	Expect(srv.Responder.find("WITH x AS (SELECT 1) SELECT * FROM users", nil, nil)).To(BeNil())
+
+	// bumping the glob's priority puts it first
+	_, err = srv.AddFixture(Fixture{Query: "SELECT * FROM users*", Match: MatchGlob, Priority: 20})
+	Expect(err).To(BeNil())
+	Expect(srv.Responder.find("SELECT * FROM users WHERE id IN (1, 2) ORDER BY id", nil, nil).Fixture.ID).To(Equal(globID))
+
+	// bad patterns are refused
+	_, err = srv.AddFixture(Fixture{Query: "SELECT (", Match: MatchRegex})
+	Expect(err).ToNot(BeNil())
+
+	// and over the wire
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	ids, _ := c.query("SELECT * FROM users WHERE deleted")
+	Expect(string(ids)).To(Equal("C"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestFixtureSequences(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// a retry loop, failing twice before it works
+	_, err := srv.AddFixture(Fixture{
+		Query:   "UPDATE accounts SET balance = 0",
+		Columns: []string{"id:int4"},
+		Responses: []FixtureResponse{
+			{Error: &PgError{Code: SQLStateCodeSerializationFailure, Message: "could not serialize access"}, Times: 2},
+			{Rows: [][]interface{}{{"1"}}},
+		},
+	})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	for i := 0; i < 2; i++ {
+		ids, bodies := c.query("UPDATE accounts SET balance = 0")
+		Expect(string(ids)).To(Equal("E"))
+		Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeSerializationFailure))
+	}
+
+	// and then keeps on working
+	for i := 0; i < 2; i++ {
+		ids, _ := c.query("UPDATE accounts SET balance = 0")
+		Expect(string(ids)).To(Equal("TDC"))
+	}
+
+	// the same goes for extended queries
+	_, err = srv.AddFixture(Fixture{
+		Query:     "SELECT 1",
+		Columns:   []string{"n:text"},
+		Responses: []FixtureResponse{{Rows: [][]interface{}{{"a"}}}, {Rows: [][]interface{}{{"b"}}}},
+		Exhausted: ExhaustCycle,
+	})
+	Expect(err).To(BeNil())
+	rows := []string{}
+	for i := 0; i < 3; i++ {
+		ids, bodies := c.extendedQuery("SELECT 1")
+		Expect(string(ids)).To(Equal("12TDC"))
+		rows = append(rows, string(bodies[3][len(bodies[3])-1:]))
+	}
+	Expect(rows).To(Equal([]string{"a", "b", "a"}))
+
+	// a limited fixture stops matching once it's used up, letting the next one in
+	_, err = srv.AddFixture(Fixture{Query: "SELECT * FROM jobs", Match: MatchGlob, Columns: []string{"src:text"}, Rows: [][]interface{}{{"glob"}}})
+	Expect(err).To(BeNil())
+	_, err = srv.AddFixture(Fixture{Query: "SELECT * FROM jobs", Columns: []string{"src:text"}, Rows: [][]interface{}{{"once"}}, Times: 1})
+	Expect(err).To(BeNil())
+	Expect(srv.Responder.find("SELECT * FROM jobs", nil, nil).Response.Rows[0].Columns[0].Value).To(Equal([]byte("once")))
+	Expect(srv.Responder.find("SELECT * FROM jobs", nil, nil).Response.Rows[0].Columns[0].Value).To(Equal([]byte("glob")))
+
+	// unknown exhausted modes are refused
+	_, err = srv.AddFixture(Fixture{Query: "SELECT 2", Exhausted: "forever"})
+	Expect(err).ToNot(BeNil())
+}
@@ -0,0 +1,169 @@
+package pgmock
+
+import (
+	"context"
+	"fmt"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// HandlerFunc works out the answer to a query in code, ctx is cancelled if the client cancels the query or the session
+// it came from goes. Returning a *PgError sends it to the client as it is, any other error is sent as an internal error
+// ( or as cancelled, once ctx is ). A nil result with no error is an empty one.
+type HandlerFunc func(ctx context.Context, query *Query) (*Result, error)
+
+// Query is a query handed to a HandlerFunc. Params are the arguments, nil for NULL, or the literals and captures when
+// the matcher pulls them out of the query.
+type Query struct {
+	SQL       string            `json:"sql"`
+	Params    []*string         `json:"params"`
+	Captures  map[string]string `json:"captures,omitempty"`
+	FixtureID string            `json:"fixtureId"`
+	Session   SessionInfo       `json:"session"`
+}
+
+// Result is a HandlerFunc's answer, Tag replaces the usual SELECT n command tag. Without Columns it has the ones the
+// Matcher declared.
+type Result struct {
+	Columns []Column        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	Tag     string          `json:"tag,omitempty"`
+}
+
+// Column is a column of a Result, Type is one of the fixture column types such as text or int4
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Matcher picks out the queries a HandlerFunc answers, matching them the same way as a fixture would. Columns declares
+// the columns up front so prepared statements can be described before they're bound and the handler has been run,
+// Describe works them out from the query instead for handlers whose columns depend on it.
+type Matcher struct {
+	Query    string
+	Match    MatchMode
+	Params   []ParamMatcher
+	Session  *SessionCondition
+	Priority int
+	Columns  []Column
+	Describe DescribeFunc
+}
+
+// DescribeFunc works out the columns a query will have before it's run, nil for none
+type DescribeFunc func(sql string) []Column
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// handlerFailed is the error sent when a HandlerFunc returns an error that isn't meant for the client
+func handlerFailed(err error) *PgError {
+	return &PgError{Code: SQLStateCodeInternalError, Message: fmt.Sprintf("query handler failed, err: %s", err)}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// resolve replaces the response of a match that's answered by a webhook or a HandlerFunc with the answer they give
+func (bh *_BaseHandler) resolve(match *_QueryMatch, sql string) error {
+
+	if match == nil || match.Response == nil {
+		return nil
+	}
+
+	var fixtureID string
+	if match.Fixture != nil {
+		fixtureID = match.Fixture.ID
+	}
+	params := match.Params
+	if params == nil {
+		params = []*string{}
+	}
+
+	var response *_QueryResponse
+	var err error
+	switch {
+	case match.Response.Webhook != "":
+		request := &WebhookRequest{SQL: sql, Params: params, FixtureID: fixtureID, Session: bh.Session.info()}
+		response, err = callWebhook(bh.Session.context(), match.Response.Webhook, match.Response.WebhookTimeout, request)
+	case match.Response.Handler != nil:
+		query := &Query{SQL: sql, Params: params, Captures: match.Captures, FixtureID: fixtureID, Session: bh.Session.info()}
+		response, err = callHandler(bh.Session.context(), match.Response.Handler, query)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// answers without any columns have the ones declared up front
+	if len(response.Columns.Fields) == 0 && response.Error == nil {
+		response.Columns = match.Response.Columns
+	}
+	match.Response = response
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// callHandler runs the HandlerFunc and converts its result into a response
+func callHandler(ctx context.Context, handler HandlerFunc, query *Query) (*_QueryResponse, error) {
+
+	result, err := handler(ctx, query)
+	if err != nil && ctx.Err() != nil {
+		return nil, queryCanceled()
+	}
+	if pgErr, ok := err.(*PgError); ok {
+		return &_QueryResponse{Columns: &_RowDescription{}, Error: pgErr}, nil
+	}
+	if err != nil {
+		return nil, handlerFailed(err)
+	}
+	if result == nil {
+		return &_QueryResponse{Columns: &_RowDescription{}, Tag: emptyTag(query.SQL)}, nil
+	}
+
+	response, err := buildQueryResponse(columnPairs(result.Columns), result.Rows)
+	if err != nil {
+		return nil, handlerFailed(err)
+	}
+	response.Tag = result.Tag
+
+	return response, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describeColumns is a response with the columns describe works out for the query
+func describeColumns(describe DescribeFunc, sql string) (*_QueryResponse, error) {
+	response, err := buildQueryResponse(columnPairs(describe(sql)), nil)
+	if err != nil {
+		return nil, handlerFailed(err)
+	}
+	return response, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// columnPairs turns the columns into the name:type pairs fixtures use
+func columnPairs(columns []Column) []string {
+	cols := []string{}
+	for _, c := range columns {
+		cols = append(cols, c.Name+":"+c.Type)
+	}
+	return cols
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// context is the context of the query being handled, cancelled by a cancel request or once the session has gone.
+// Sessions that aren't being served are never cancelled.
+func (session *_Session) context() context.Context {
+	switch {
+	case session == nil:
+		return context.Background()
+	case session.QueryContext != nil:
+		return session.QueryContext
+	case session.Context != nil:
+		return session.Context
+	}
+	return context.Background()
+}
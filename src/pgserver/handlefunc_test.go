@@ -0,0 +1,132 @@
+package pgmock
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestHandleFunc(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// double whatever it's given
+	id, err := srv.HandleFunc(Matcher{Query: "SELECT $1::int * 2"}, func(ctx context.Context, query *Query) (*Result, error) {
+		n, err := strconv.Atoi(*query.Params[0])
+		if err != nil {
+			return nil, &PgError{Code: "22P02", Message: "invalid input syntax for type integer"}
+		}
+		return &Result{Columns: []Column{{Name: "doubled", Type: "int4"}}, Rows: [][]interface{}{{n * 2}}}, nil
+	})
+	Expect(err).To(BeNil())
+
+	// pull the table out of the query
+	_, err = srv.HandleFunc(Matcher{Query: `DELETE FROM (?P<table>\w+)`, Match: MatchRegex}, func(ctx context.Context, query *Query) (*Result, error) {
+		if query.Captures["table"] == "users" {
+			return nil, errors.New("not allowed")
+		}
+		return &Result{Tag: "DELETE 3"}, nil
+	})
+	Expect(err).To(BeNil())
+
+	// and say who's asking
+	_, err = srv.HandleFunc(Matcher{Query: "SELECT current_user"}, func(ctx context.Context, query *Query) (*Result, error) {
+		return &Result{Columns: []Column{{Name: "current_user", Type: "text"}}, Rows: [][]interface{}{{query.Session.User}}}, nil
+	})
+	Expect(err).To(BeNil())
+	_, err = srv.HandleFunc(Matcher{Query: "SELECT nothing"}, func(ctx context.Context, query *Query) (*Result, error) {
+		return nil, nil
+	})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results
+	arg := "21"
+	ids, bodies := c.extendedQuery("SELECT $1::int * 2", &arg)
+	Expect(string(ids)).To(Equal("12TDC"))
+	Expect(string(bodies[3][len(bodies[3])-2:])).To(Equal("42"))
+	entries, _ := srv.Journal(JournalFilter{FixtureID: id})
+	Expect(entries).ToNot(BeEmpty())
+
+	bad := "x"
+	ids, bodies = c.extendedQuery("SELECT $1::int * 2", &bad)
+	Expect(string(ids)).To(Equal("12nE"))
+	Expect(errorFields(bodies[3])[ErrorSQLStateCode]).To(Equal("22P02"))
+
+	ids, bodies = c.query("DELETE FROM orders")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("DELETE 3\x00"))
+	ids, bodies = c.query("DELETE FROM users")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeInternalError))
+	Expect(errorFields(bodies[0])[ErrorMessage]).To(Equal("query handler failed, err: not allowed"))
+
+	ids, bodies = c.query("SELECT current_user")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(string(bodies[1][len(bodies[1])-4:])).To(Equal("test"))
+
+	ids, bodies = c.query("SELECT nothing")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("SELECT 0\x00"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestHandleFuncDescribe(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// the columns are declared up front, the handler just gives the rows
+	_, err := srv.HandleFunc(Matcher{Query: "SELECT name FROM users", Columns: []Column{{Name: "name", Type: "text"}}}, func(ctx context.Context, query *Query) (*Result, error) {
+		return &Result{Rows: [][]interface{}{{"alice"}}}, nil
+	})
+	Expect(err).To(BeNil())
+
+	// and this one waits until it's cancelled
+	_, err = srv.HandleFunc(Matcher{Query: "SELECT pg_sleep(60)"}, func(ctx context.Context, query *Query) (*Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results
+	c.writeParse("stmt", "SELECT name FROM users")
+	c.writeDescribe(CloseStatement, "stmt")
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	c.expectMessage(ParameterDescriptionMessageID)
+	Expect(string(c.expectMessage(RowDescriptionMessageID))).To(ContainSubstring("name"))
+	c.expectMessage(ReadyForQueryMessageID)
+
+	c.writeBind("", "stmt", nil)
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(BindCompleteMessageID)
+	Expect(string(c.expectMessage(DataRowMessageID))).To(HaveSuffix("alice"))
+	c.expectMessage(CommandCompleteMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// cancelling the query cancels the handler's context
+	c.writeMessage(QueryMessageID, []byte("SELECT pg_sleep(60)\x00"))
+	Eventually(func() bool { return cancelRunningQuery(srv) }).Should(BeTrue())
+	Expect(errorFields(c.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeQueryCanceled))
+	c.expectMessage(ReadyForQueryMessageID)
+}
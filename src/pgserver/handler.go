@@ -1,8 +1,8 @@
 package pgmock
 
 import (
-	"crypto/sha1"
 	"fmt"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -10,13 +10,95 @@ import (
 type MessageHandler interface {
 	HandleQuery(*_Messenger) error
 	HandleParse(*_Messenger) error
+	HandleBind(*_Messenger) error
 	HandleDescribe(*_Messenger) error
+	HandleExecute(*_Messenger) error
+	HandleClose(*_Messenger) error
+}
+
+// _PreparedStatement is a parsed query waiting to be bound
+type _PreparedStatement struct {
+	SQL           string
+	ParameterOIDs []int32
+	Held          *_QueryMatch
+}
+
+// _Portal is a bound statement, the fixture is matched at bind time so the portal can be described. Error is the
+// unmatched error held back until the portal is executed.
+type _Portal struct {
+	Statement     *_PreparedStatement
+	Match         *_QueryMatch
+	Error         error
+	Command       *_SessionCommand
+	ResultFormats []int16
+	RowsSent      int
 }
 
 type _BaseHandler struct {
 	ResponseLoader *_Responder
+	Session        *_Session
+	Statements     map[string]*_PreparedStatement
+	Portals        map[string]*_Portal
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func newBaseHandler(responder *_Responder, session *_Session) *_BaseHandler {
+	return &_BaseHandler{
+		ResponseLoader: responder,
+		Session:        session,
+		Statements:     map[string]*_PreparedStatement{},
+		Portals:        map[string]*_Portal{},
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// noResponse is the error sent when no fixture matches a query
+func noResponse(sql string) *PgError {
+	return &PgError{Code: SQLStateCodeDataException, Message: fmt.Sprintf("No Response for query, err: No response found for hash %s", hashSQL(sql))}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// checkTransaction refuses everything but the end of a failed transaction, and savepoints outside of a transaction, as
+// postgres does
+func (bh *_BaseHandler) checkTransaction(cmd *_SessionCommand) *PgError {
+	if bh.Session == nil {
+		return nil
+	}
+	if bh.Session.TxStatus == ReadyForQueryIdle {
+		if statement := cmd.savepointStatement(); statement != "" {
+			return &PgError{Code: SQLStateCodeNoActiveSQLTransaction, Message: fmt.Sprintf("%s can only be used in transaction blocks", statement)}
+		}
+	}
+	if bh.Session.TxStatus != ReadyForQueryError || cmd.endsFailedTransaction() {
+		return nil
+	}
+	return &PgError{Code: SQLStateCodeInFailedSQLTransaction, Message: "current transaction is aborted, commands ignored until end of transaction block"}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// complete sends the CommandComplete for a query, session commands get their own tag and take effect. tag replaces
+// the usual SELECT n if it's set.
+func (bh *_BaseHandler) complete(m *_Messenger, cmd *_SessionCommand, rows int, tag string) error {
+
+	complete := &_CommandComplete{Tag: tag}
+	if cmd == nil {
+		if tag == "" {
+			complete.selectOrCreate(rows)
+		}
+		return complete.write(m)
+	}
+
+	complete.Tag = cmd.tag(bh.Session)
+	cmd.apply(bh.Session)
+	return complete.write(m)
 }
 
+// ---------------------------------------------------------------------------------------------------------------------
+
 func (bh *_BaseHandler) HandleDescribe(m *_Messenger) error {
 
 	msg := &_Describe{}
@@ -25,17 +107,113 @@ func (bh *_BaseHandler) HandleDescribe(m *_Messenger) error {
 		return err
 	}
 	log.Infof("HandleDesribe(%s, %s)", string(msg.Target), msg.TargetName)
+	entry := bh.journalEntry()
+
+	// portals already know their parameters and result formats
+	if msg.Target == ClosePortal {
+		portal, found := bh.Portals[msg.TargetName]
+		if !found {
+			return &PgError{Code: SQLStateCodeInvalidCursorName, Message: fmt.Sprintf("portal \"%s\" does not exist", msg.TargetName)}
+		}
+		entry.Portal, entry.SQL = msg.TargetName, portal.Statement.SQL
+		if portal.Match != nil && portal.Match.Upstream != nil {
+			return describeUpstream(m, portal.Match.Upstream, bh.Session, portal.Statement, portal)
+		}
+		var response *_QueryResponse
+		if portal.Match != nil {
+			response = portal.Match.Response
+		}
+		return writeRowDescription(m, response, portal.ResultFormats)
+	}
+
+	stmt, found := bh.Statements[msg.TargetName]
+	if !found {
+		return &PgError{Code: SQLStateCodeInvalidSQLStatementName, Message: fmt.Sprintf("prepared statement \"%s\" does not exist", msg.TargetName)}
+	}
+	entry.Statement, entry.SQL = msg.TargetName, stmt.SQL
+
+	// statements nothing here answers are described by the upstream when they'll be passed through, held and blocked
+	// ones wait for their answer now so there are columns to describe, keeping it for the bind
+	response := bh.ResponseLoader.describe(stmt.SQL, bh.Session)
+	if response != nil && response.Describe != nil {
+		if response, err = describeColumns(response.Describe, stmt.SQL); err != nil {
+			return err
+		}
+	}
+	if response == nil && stmt.Held != nil {
+		response = stmt.Held.Response
+	}
+	if response == nil && parseSessionCommand(stmt.SQL) == nil {
+		switch policy := bh.ResponseLoader.unmatchedPolicy(bh.database()); policy.Action {
+		case UnmatchedPassthrough:
+			return describeUpstream(m, policy, bh.Session, stmt, nil)
+		case UnmatchedHold, UnmatchedBlock:
+			match, err := bh.unmatched(stmt.SQL, nil)
+			if err != nil {
+				return err
+			}
+			stmt.Held, response = match, match.Response
+		}
+	}
 
 	// if it's a statement issue ParameterDescription, RowDescription
-	err = (&_ParameterDescription{ParameterOIDS: []int32{OIDInt4}}).write(m)
+	err = (&_ParameterDescription{ParameterOIDS: stmt.parameterTypes()}).write(m)
 	if err != nil {
 		return err
 	}
 	log.Info("WroteParameterDescription")
 
-	return nil
+	return writeRowDescription(m, response, nil)
 }
 
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeRowDescription describes the columns of response in the given formats, or NoData if there aren't any
+func writeRowDescription(m *_Messenger, response *_QueryResponse, formats []int16) error {
+
+	if response == nil || len(response.Columns.Fields) == 0 {
+		return (&_NoData{}).write(m)
+	}
+
+	desc := &_RowDescription{}
+	for i, f := range response.Columns.Fields {
+		field := *f
+		field.FormatCode = resultFormat(field.DataTypeOID, formatCode(formats, i))
+		desc.Fields = append(desc.Fields, &field)
+	}
+
+	return desc.write(m)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parameterTypes works out the parameter OIDs for the statement, parameters the client didn't give a type for are
+// described as text so clients send them as text
+func (stmt *_PreparedStatement) parameterTypes() []int32 {
+
+	// the statement needs as many parameters as the highest $n it uses
+	n := len(stmt.ParameterOIDs)
+	for _, t := range tokenizeSQL(stmt.SQL) {
+		if t.Kind == sqlTokenParam {
+			if i, err := strconv.Atoi(t.Text[1:]); err == nil && i > n {
+				n = i
+			}
+		}
+	}
+
+	oids := make([]int32, n)
+	for i := range oids {
+		oids[i] = OIDText
+		if i < len(stmt.ParameterOIDs) && stmt.ParameterOIDs[i] != OIDUnspecified {
+			oids[i] = stmt.ParameterOIDs[i]
+		}
+	}
+
+	return oids
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func (bh *_BaseHandler) HandleParse(m *_Messenger) error {
 
 	msg := &_Parse{}
@@ -44,6 +222,10 @@ func (bh *_BaseHandler) HandleParse(m *_Messenger) error {
 		return m.Error
 	}
 	log.Infof("HandleParse(%s)", msg.SQL)
+	entry := bh.journalEntry()
+	entry.Statement, entry.SQL = msg.Statement, msg.SQL
+
+	bh.Statements[msg.Statement] = &_PreparedStatement{SQL: msg.SQL, ParameterOIDs: msg.ParameterOIDs}
 
 	err := (&_ParseComplete{}).write(m)
 	if err != nil {
@@ -53,6 +235,188 @@ func (bh *_BaseHandler) HandleParse(m *_Messenger) error {
 	return nil
 }
 
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (bh *_BaseHandler) HandleBind(m *_Messenger) error {
+
+	msg := &_Bind{}
+	if err := msg.read(m); err != nil {
+		return err
+	}
+	log.Infof("HandleBind(%s, %s)", msg.DestinationPortal, msg.PreparedStatement)
+	entry := bh.journalEntry()
+	entry.Statement, entry.Portal = msg.PreparedStatement, msg.DestinationPortal
+
+	stmt, found := bh.Statements[msg.PreparedStatement]
+	if !found {
+		return &PgError{Code: SQLStateCodeInvalidSQLStatementName, Message: fmt.Sprintf("prepared statement \"%s\" does not exist", msg.PreparedStatement)}
+	}
+	entry.SQL = stmt.SQL
+
+	cmd := parseSessionCommand(stmt.SQL)
+	if pgErr := bh.checkTransaction(cmd); pgErr != nil {
+		return pgErr
+	}
+
+	// decode the arguments to text using the statement's types
+	oids := stmt.parameterTypes()
+	args := make([]*string, len(msg.Parameters))
+	for i, p := range msg.Parameters {
+		oid := OIDUnspecified
+		if i < len(oids) {
+			oid = oids[i]
+		}
+		args[i] = decodeParam(oid, p.FormatCode, p.Value)
+	}
+	entry.Params = args
+
+	// session commands don't need a fixture, anything else that doesn't have one goes to the unmatched policy
+	bh.ResponseLoader.received(stmt.SQL)
+	bh.Session.emit(Event{Type: EventQuery, SQL: stmt.SQL, Params: args})
+	// held statements already have their answer from when they were described
+	match := stmt.Held
+	stmt.Held = nil
+	if match != nil {
+		match.Params = args
+	} else {
+		match = bh.ResponseLoader.find(stmt.SQL, args, bh.Session)
+	}
+	bh.emitMatch(match, stmt.SQL, args)
+	var err error
+	if match == nil && cmd == nil {
+		match, err = bh.unmatched(stmt.SQL, args)
+	}
+	if err == nil {
+		err = bh.resolve(match, stmt.SQL)
+	}
+	entry.matched(match)
+
+	bh.Portals[msg.DestinationPortal] = &_Portal{
+		Statement:     stmt,
+		Match:         match,
+		Error:         err,
+		Command:       cmd,
+		ResultFormats: msg.ResultFormatCodes,
+	}
+
+	return (&_BindComplete{}).write(m)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (bh *_BaseHandler) HandleExecute(m *_Messenger) error {
+
+	msg := &_Execute{}
+	if err := msg.read(m); err != nil {
+		return err
+	}
+	log.Infof("HandleExecute(%s, %d)", msg.Portal, msg.MaxRows)
+	entry := bh.journalEntry()
+	entry.Portal = msg.Portal
+
+	portal, found := bh.Portals[msg.Portal]
+	if !found {
+		return &PgError{Code: SQLStateCodeInvalidCursorName, Message: fmt.Sprintf("portal \"%s\" does not exist", msg.Portal)}
+	}
+	entry.SQL = portal.Statement.SQL
+	if portal.Match != nil {
+		entry.Params = portal.Match.Params
+	}
+	entry.matched(portal.Match)
+	if portal.Error != nil {
+		return portal.Error
+	}
+	if portal.Match == nil {
+		return bh.complete(m, portal.Command, 0, "")
+	}
+	if portal.Match.Upstream != nil {
+		return passthrough(m, portal.Match, bh.Session, portal.Statement.SQL, true, portal.ResultFormats)
+	}
+	response := portal.Match.Response
+	if response.Error != nil {
+		return response.Error
+	}
+
+	// send the rows that are left, up to the limit if there is one
+	rows := response.Rows[portal.RowsSent:]
+	if msg.MaxRows > 0 && int(msg.MaxRows) < len(rows) {
+		rows = rows[:msg.MaxRows]
+	}
+	for _, row := range rows {
+		encoded, pgErr := encodeRow(row, response.Columns, portal.ResultFormats)
+		if pgErr != nil {
+			return pgErr
+		}
+		if err := encoded.write(m); err != nil {
+			log.Errorf("unable to write rows, err: %s", err)
+			return err
+		}
+	}
+	portal.RowsSent += len(rows)
+	entry.Rows = len(rows)
+
+	// more to come means the portal is suspended rather than complete
+	if portal.RowsSent < len(response.Rows) {
+		return (&_PortalSuspended{}).write(m)
+	}
+
+	return bh.complete(m, portal.Command, len(rows), response.Tag)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// encodeRow converts the row into the result formats the client asked for, failing with 22P03 if a value doesn't fit
+// the binary format of its column's type
+func encodeRow(row *_DataRow, columns *_RowDescription, formats []int16) (*_DataRow, *PgError) {
+
+	if len(formats) == 0 {
+		return row, nil
+	}
+
+	encoded := &_DataRow{Columns: make([]*_DataRowColumn, len(row.Columns))}
+	for i, c := range row.Columns {
+		oid, name := OIDText, ""
+		if i < len(columns.Fields) {
+			oid, name = columns.Fields[i].DataTypeOID, columns.Fields[i].Name
+		}
+		value, err := encodeResult(oid, formatCode(formats, i), c.Value)
+		if err != nil {
+			return nil, &PgError{
+				Code:    SQLStateCodeInvalidBinaryRepresentation,
+				Message: fmt.Sprintf("unable to send \"%s\" in binary for column \"%s\", err: %s", c.Value, name, err),
+			}
+		}
+		encoded.Columns[i] = &_DataRowColumn{Value: value}
+	}
+
+	return encoded, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (bh *_BaseHandler) HandleClose(m *_Messenger) error {
+
+	msg := &_Close{}
+	if err := msg.read(m); err != nil {
+		return err
+	}
+	log.Infof("HandleClose(%s, %s)", string(msg.CloseType), msg.Name)
+	entry := bh.journalEntry()
+
+	// closing something that doesn't exist isn't an error
+	if msg.CloseType == CloseStatement {
+		entry.Statement = msg.Name
+		delete(bh.Statements, msg.Name)
+	} else {
+		entry.Portal = msg.Name
+		delete(bh.Portals, msg.Name)
+	}
+
+	return (&_CloseComplete{}).write(m)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func (bh *_BaseHandler) HandleQuery(m *_Messenger) error {
 
 	msg := &_Query{}
@@ -61,21 +425,57 @@ func (bh *_BaseHandler) HandleQuery(m *_Messenger) error {
 		return m.Error
 	}
 	log.Infof("HandleQuery(%s)", msg.SQL)
+	entry := bh.journalEntry()
+	entry.SQL = msg.SQL
 
-	// hash the query string to work out what data to send
-	h := sha1.New()
-	h.Write([]byte(msg.SQL))
-	hash := fmt.Sprintf("%X", h.Sum(nil))
+	// a simple query replaces the unnamed statement and portal
+	delete(bh.Statements, "")
+	delete(bh.Portals, "")
 
-	response, found := bh.ResponseLoader.Responses[hash]
-	if !found {
-		return fmt.Errorf("No response found for hash %s", hash)
+	cmd := parseSessionCommand(msg.SQL)
+	if pgErr := bh.checkTransaction(cmd); pgErr != nil {
+		return pgErr
 	}
 
-	if err := response.Columns.write(m); err != nil {
-		log.Errorf("unable to write columns, err: %s", err)
+	// find the fixture matching the query to work out what data to send, session commands don't need one
+	bh.ResponseLoader.received(msg.SQL)
+	bh.Session.emit(Event{Type: EventQuery, SQL: msg.SQL})
+	match := bh.ResponseLoader.find(msg.SQL, nil, bh.Session)
+	bh.emitMatch(match, msg.SQL, nil)
+	entry.matched(match)
+	if match == nil && cmd != nil {
+		if err := bh.complete(m, cmd, 0, ""); err != nil {
+			return err
+		}
+		return bh.readyForQuery(m)
+	}
+	if match == nil {
+		var err error
+		if match, err = bh.unmatched(msg.SQL, nil); err != nil {
+			return err
+		}
+		entry.matched(match)
+	}
+	if err := bh.resolve(match, msg.SQL); err != nil {
 		return err
 	}
+	if match.Upstream != nil {
+		if err := passthrough(m, match, bh.Session, msg.SQL, false, nil); err != nil {
+			return err
+		}
+		return bh.readyForQuery(m)
+	}
+	response := match.Response
+	if response.Error != nil {
+		return response.Error
+	}
+
+	if len(response.Columns.Fields) > 0 {
+		if err := response.Columns.write(m); err != nil {
+			log.Errorf("unable to write columns, err: %s", err)
+			return err
+		}
+	}
 
 	for _, row := range response.Rows {
 		if err := row.write(m); err != nil {
@@ -84,16 +484,36 @@ func (bh *_BaseHandler) HandleQuery(m *_Messenger) error {
 		}
 	}
 
-	complete := &_CommandComplete{}
-	complete.selectOrCreate(1)
-	err := complete.write(m)
+	entry.Rows = len(response.Rows)
+	err := bh.complete(m, cmd, len(response.Rows), response.Tag)
 	if err != nil {
 		return err
 	}
 
 	log.Infof("Wrote CommandComplete")
 
-	(&_ReadyForQuery{Indicator: 'I'}).write(m)
+	return bh.readyForQuery(m)
+}
 
-	return nil
+// ---------------------------------------------------------------------------------------------------------------------
+
+// emitMatch publishes whether a fixture matched the query, session commands that don't need one aren't misses
+func (bh *_BaseHandler) emitMatch(match *_QueryMatch, sql string, args []*string) {
+	switch {
+	case match != nil && match.Fixture != nil:
+		bh.Session.emit(Event{Type: EventMatch, SQL: sql, Params: args, FixtureID: match.Fixture.ID})
+	case parseSessionCommand(sql) == nil:
+		bh.Session.emit(Event{Type: EventMiss, SQL: sql, Params: args})
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readyForQuery sends ReadyForQuery with the session's transaction status
+func (bh *_BaseHandler) readyForQuery(m *_Messenger) error {
+	indicator := ReadyForQueryIdle
+	if bh.Session != nil {
+		indicator = bh.Session.TxStatus
+	}
+	return (&_ReadyForQuery{Indicator: indicator}).write(m)
 }
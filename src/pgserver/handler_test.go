@@ -0,0 +1,154 @@
+package pgmock
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeParse sends a Parse message for the named statement
+func (c *_TestClient) writeParse(name, sql string, oids ...int32) {
+	body := &bytes.Buffer{}
+	bm := newMessenger(body)
+	bm.writeString(name).writeString(sql).writeInt16(int16(len(oids)))
+	for _, oid := range oids {
+		bm.writeInt32(oid)
+	}
+	c.writeMessage(ParseMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeBind binds text arguments ( nil for NULL ) to the named statement, asking for results in the given formats
+func (c *_TestClient) writeBind(portal, stmt string, args []*string, resultFormats ...int16) {
+	body := &bytes.Buffer{}
+	bm := newMessenger(body)
+	bm.writeString(portal).writeString(stmt).writeInt16(0).writeInt16(int16(len(args)))
+	for _, arg := range args {
+		if arg == nil {
+			bm.writeInt32(-1)
+			continue
+		}
+		bm.writeInt32(int32(len(*arg))).writeByteArray([]byte(*arg)...)
+	}
+	bm.writeInt16(int16(len(resultFormats)))
+	for _, f := range resultFormats {
+		bm.writeInt16(f)
+	}
+	c.writeMessage(BindMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeDescribe asks for a description of a statement ( 'S' ) or portal ( 'P' )
+func (c *_TestClient) writeDescribe(target byte, name string) {
+	c.writeMessage(DescribeMessageID, append([]byte{target}, append([]byte(name), 0)...))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeExecute runs the portal returning at most maxRows rows, 0 for all of them
+func (c *_TestClient) writeExecute(portal string, maxRows int32) {
+	body := &bytes.Buffer{}
+	newMessenger(body).writeString(portal).writeInt32(maxRows)
+	c.writeMessage(ExecuteMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// extendedQuery runs sql with the arguments using the unnamed statement and portal, returning the ids and bodies of
+// everything up to the ReadyForQuery
+func (c *_TestClient) extendedQuery(sql string, args ...*string) ([]byte, [][]byte) {
+	c.writeParse("", sql)
+	c.writeBind("", "", args)
+	c.writeDescribe(ClosePortal, "")
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	ids, bodies := []byte{}, [][]byte{}
+	for {
+		id, body := c.readMessage()
+		if id == ReadyForQueryMessageID {
+			return ids, bodies
+		}
+		ids, bodies = append(ids, id), append(bodies, body)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestExtendedQuery(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with a couple of rows to page through
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	_, err := srv.AddFixture(Fixture{
+		Query:   "SELECT id, name FROM users WHERE org = $1",
+		Columns: []string{"id:int4", "name:text"},
+		Rows:    [][]interface{}{{"1", "bob"}, {"2", "alice"}, {"3", "eve"}},
+	})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// describing the statement gives the parameters ( as text ) and the columns
+	c.writeParse("stmt", "SELECT id, name FROM users WHERE org = $1")
+	c.writeDescribe(CloseStatement, "stmt")
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	Expect(c.expectMessage(ParameterDescriptionMessageID)).To(Equal([]byte{0, 1, 0, 0, 0, 25}))
+	c.expectMessage(RowDescriptionMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// fetch two rows at a time with the id in binary
+	org := "acme"
+	c.writeBind("portal", "stmt", []*string{&org}, FormatBinary, FormatText)
+	c.writeExecute("portal", 2)
+	c.writeExecute("portal", 2)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(BindCompleteMessageID)
+	Expect(c.expectMessage(DataRowMessageID)).To(Equal([]byte{0, 2, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 3, 'b', 'o', 'b'}))
+	c.expectMessage(DataRowMessageID)
+	c.expectMessage(PortalSuspendedMessageID)
+	c.expectMessage(DataRowMessageID)
+	Expect(c.expectMessage(CommandCompleteMessageID)).To(Equal(append([]byte("SELECT 1"), 0)))
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// closing the statement means it can't be bound again
+	c.writeMessage(CloseMessageID, append([]byte{CloseStatement}, append([]byte("stmt"), 0)...))
+	c.writeBind("portal", "stmt", []*string{&org})
+	c.writeExecute("portal", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(CloseCompleteMessageID)
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidSQLStatementName))
+
+	// with the execute skipped until the sync
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// queries without a fixture error at execute
+	ids, bodies := c.extendedQuery("SELECT nothing")
+	Expect(string(ids)).To(Equal("12nE"))
+	Expect(errorFields(bodies[3])[ErrorSQLStateCode]).To(Equal(SQLStateCodeDataException))
+
+	// and a value that can't be sent in the binary format the columns were described with is an error too
+	_, err = srv.AddFixture(Fixture{Query: "SELECT small", Columns: []string{"n:int2"}, Rows: [][]interface{}{{"70000"}}})
+	Expect(err).To(BeNil())
+	c.writeParse("", "SELECT small")
+	c.writeBind("", "", nil, FormatBinary)
+	c.writeDescribe(ClosePortal, "")
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	c.expectMessage(BindCompleteMessageID)
+	desc := c.expectMessage(RowDescriptionMessageID)
+	Expect(desc[len(desc)-2:]).To(Equal([]byte{0, 1}))
+	Expect(errorFields(c.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidBinaryRepresentation))
+	c.expectMessage(ReadyForQueryMessageID)
+}
@@ -0,0 +1,264 @@
+package pgmock
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// DefaultJournalSize is how many entries the journal keeps before dropping the oldest
+const DefaultJournalSize = 10000
+
+// frontendMessageNames names the messages clients send once they're past startup
+var frontendMessageNames = map[byte]string{
+	QueryMessageID:     "Query",
+	ParseMessageID:     "Parse",
+	BindMessageID:      "Bind",
+	DescribeMessageID:  "Describe",
+	ExecuteMessageID:   "Execute",
+	CloseMessageID:     "Close",
+	FlushMessageID:     "Flush",
+	SyncMessageID:      "Sync",
+	TerminateMessageID: "Terminate",
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// JournalEntry records a message received from a client and what was sent back. ProcessID identifies the session,
+// Statement and Portal are the names the extended query messages used, and Matched is whether a fixture answered for
+// the messages that run queries. Duration is in nanoseconds.
+type JournalEntry struct {
+	ID        int64         `json:"id"`
+	ProcessID int32         `json:"processId"`
+	Message   string        `json:"message"`
+	SQL       string        `json:"sql,omitempty"`
+	Statement string        `json:"statement,omitempty"`
+	Portal    string        `json:"portal,omitempty"`
+	Params    []*string     `json:"params,omitempty"`
+	Matched   *bool         `json:"matched,omitempty"`
+	FixtureID string        `json:"fixtureId,omitempty"`
+	Rows      int           `json:"rows"`
+	Error     *PgError      `json:"error,omitempty"`
+	Received  time.Time     `json:"received"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// JournalFilter picks out journal entries, zero fields match everything. SQL is a regular expression, Since and Until
+// bound when the entries were received.
+type JournalFilter struct {
+	ProcessID int32
+	SQL       string
+	FixtureID string
+	Since     time.Time
+	Until     time.Time
+	Matched   *bool
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// pattern compiles the filter's SQL pattern, nil if it doesn't have one
+func (filter JournalFilter) pattern() (*regexp.Regexp, error) {
+	if filter.SQL == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(filter.SQL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sql pattern, err: %s", err)
+	}
+	return pattern, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _Journal keeps the most recent Size entries in the order they were received, Changed is closed whenever one is
+// added
+type _Journal struct {
+	sync.Mutex
+	Entries []*JournalEntry
+	Size    int
+	NextID  int64
+	Changed chan struct{}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// record adds the entry to the journal, dropping the oldest if it's full
+func (journal *_Journal) record(entry *JournalEntry) {
+
+	// maintain concurrency
+	journal.Lock()
+	defer journal.Unlock()
+
+	journal.NextID++
+	entry.ID = journal.NextID
+	journal.Entries = append(journal.Entries, entry)
+	journal.trim()
+
+	if journal.Changed != nil {
+		close(journal.Changed)
+		journal.Changed = nil
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// trim drops the oldest entries over the size, the caller must hold the lock. The entries are sliced off the front
+// rather than copied, append moves what's left to a new array once there's no room at the end.
+func (journal *_Journal) trim() {
+	size := journal.Size
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+	if over := len(journal.Entries) - size; over > 0 {
+		for i := 0; i < over; i++ {
+			journal.Entries[i] = nil
+		}
+		journal.Entries = journal.Entries[over:]
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// find returns copies of the entries matching the filter, oldest first
+func (journal *_Journal) find(filter JournalFilter) ([]JournalEntry, error) {
+
+	pattern, err := filter.pattern()
+	if err != nil {
+		return nil, err
+	}
+
+	// maintain concurrency
+	journal.Lock()
+	defer journal.Unlock()
+
+	return journal.filter(filter, pattern, false), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// filter returns copies of the entries matching the filter, only those running queries if queries is set. The caller
+// must hold the lock.
+func (journal *_Journal) filter(filter JournalFilter, pattern *regexp.Regexp, queries bool) []JournalEntry {
+
+	entries := []JournalEntry{}
+	for _, entry := range journal.Entries {
+		switch {
+		case queries && entry.Message != "Query" && entry.Message != "Bind":
+		case filter.ProcessID != 0 && entry.ProcessID != filter.ProcessID:
+		case pattern != nil && !pattern.MatchString(entry.SQL):
+		case filter.FixtureID != "" && entry.FixtureID != filter.FixtureID:
+		case !filter.Since.IsZero() && entry.Received.Before(filter.Since):
+		case !filter.Until.IsZero() && entry.Received.After(filter.Until):
+		case filter.Matched != nil && (entry.Matched == nil || *entry.Matched != *filter.Matched):
+		default:
+			entries = append(entries, *entry)
+		}
+	}
+
+	return entries
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// wait blocks until queries matching the filter have been received times times, returning their entries. Queries are
+// counted when a Query runs them or a Bind binds them. If they haven't all turned up before the timeout, 0 for no
+// timeout, the entries there are so far are returned with an error.
+func (journal *_Journal) wait(filter JournalFilter, times int, timeout time.Duration) ([]JournalEntry, error) {
+
+	pattern, err := filter.pattern()
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		journal.Lock()
+		entries := journal.filter(filter, pattern, true)
+		if journal.Changed == nil {
+			journal.Changed = make(chan struct{})
+		}
+		changed := journal.Changed
+		journal.Unlock()
+
+		if len(entries) >= times {
+			return entries, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return entries, fmt.Errorf("timed out waiting for %s, received %d of %d", describeFilter(filter), len(entries), times)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describeFilter describes what a wait is waiting for
+func describeFilter(filter JournalFilter) string {
+	parts := []string{}
+	if filter.SQL != "" {
+		parts = append(parts, fmt.Sprintf("queries matching %s", filter.SQL))
+	}
+	if filter.FixtureID != "" {
+		parts = append(parts, fmt.Sprintf("queries answered by fixture %s", filter.FixtureID))
+	}
+	if filter.ProcessID != 0 {
+		parts = append(parts, fmt.Sprintf("queries from session %d", filter.ProcessID))
+	}
+	if len(parts) == 0 {
+		return "queries"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// clear empties the journal, ids carry on from where they were
+func (journal *_Journal) clear() {
+	journal.Lock()
+	journal.Entries = nil
+	journal.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// setSize changes how many entries are kept, dropping the oldest if there are now too many
+func (journal *_Journal) setSize(size int) {
+	journal.Lock()
+	journal.Size = size
+	journal.trim()
+	journal.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// journalEntry is the entry for the message being handled, handlers fill in what they know about it. Sessions that
+// aren't journalled get one that's thrown away.
+func (bh *_BaseHandler) journalEntry() *JournalEntry {
+	if bh.Session == nil || bh.Session.Entry == nil {
+		return &JournalEntry{}
+	}
+	return bh.Session.Entry
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matched records whether a fixture answered the query, and which
+func (entry *JournalEntry) matched(match *_QueryMatch) {
+	matched := match != nil && match.Fixture != nil
+	entry.Matched = &matched
+	if matched {
+		entry.FixtureID = match.Fixture.ID
+	}
+}
@@ -0,0 +1,130 @@
+package pgmock
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestJournal(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	id, err := srv.AddFixture(Fixture{Query: "SELECT name FROM users WHERE id = $1", Columns: []string{"name:text"}, Rows: [][]interface{}{{"bob"}, {"sue"}}})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	other := connectTestClient(addr, map[string]string{"user": "test"})
+	defer other.Conn.Close()
+
+	start := time.Now()
+	arg := "1"
+	c.extendedQuery("SELECT name FROM users WHERE id = $1", &arg)
+	other.query("SELECT 1")
+
+	// the messages are journalled once they've been answered
+	all := func() []JournalEntry {
+		entries, err := srv.Journal(JournalFilter{})
+		Expect(err).To(BeNil())
+		return entries
+	}
+	Eventually(all).Should(HaveLen(6))
+	entries := all()
+
+	// assert the results
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	Expect(messages).To(Equal([]string{"Parse", "Bind", "Describe", "Execute", "Sync", "Query"}))
+	Expect(entries[1].Params).To(Equal([]*string{&arg}))
+	Expect(*entries[1].Matched).To(BeTrue())
+	Expect(entries[1].FixtureID).To(Equal(id))
+	Expect(entries[3].SQL).To(Equal("SELECT name FROM users WHERE id = $1"))
+	Expect(entries[3].Rows).To(Equal(2))
+	Expect(entries[3].Received).To(BeTemporally(">=", start))
+	Expect(entries[0].Matched).To(BeNil())
+	Expect(*entries[5].Matched).To(BeFalse())
+	Expect(entries[5].Error.Code).To(Equal(SQLStateCodeDataException))
+	Expect(entries[5].ProcessID).ToNot(Equal(entries[0].ProcessID))
+
+	// filters
+	matched := false
+	found, err := srv.Journal(JournalFilter{Matched: &matched, SQL: "^SELECT"})
+	Expect(err).To(BeNil())
+	Expect(found).To(HaveLen(1))
+	Expect(found[0].SQL).To(Equal("SELECT 1"))
+	found, _ = srv.Journal(JournalFilter{ProcessID: entries[0].ProcessID})
+	Expect(found).To(HaveLen(5))
+	found, _ = srv.Journal(JournalFilter{Since: entries[4].Received})
+	Expect(found).To(HaveLen(2))
+	found, _ = srv.Journal(JournalFilter{Until: entries[0].Received})
+	Expect(found).To(HaveLen(1))
+	_, err = srv.Journal(JournalFilter{SQL: "("})
+	Expect(err).ToNot(BeNil())
+
+	// the journal only keeps so many, and can be cleared
+	srv.SetJournalSize(2)
+	Expect(all()).To(HaveLen(2))
+	Expect(all()[0].Message).To(Equal("Sync"))
+	srv.ClearJournal()
+	Expect(all()).To(BeEmpty())
+
+	// without copying the lot every time one's added once it's full
+	journal := &_Journal{Size: 100}
+	for i := 0; i < 1000; i++ {
+		journal.record(&JournalEntry{})
+	}
+	Expect(journal.Entries).To(HaveLen(100))
+	Expect(journal.Entries[0].ID).To(Equal(int64(901)))
+	Expect(cap(journal.Entries)).To(BeNumerically("<=", 200))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestWaitForQuery(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	id, err := srv.AddFixture(Fixture{Query: "UPDATE jobs SET done = true", Match: MatchNormalized})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// a background worker gets round to it eventually
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.query("update jobs set done = true")
+		c.extendedQuery("UPDATE jobs SET done = true")
+	}()
+
+	// assert the results
+	entries, err := srv.WaitForQuery(JournalFilter{SQL: "(?i)^update jobs"}, 2, 5*time.Second)
+	Expect(err).To(BeNil())
+	Expect(entries).To(HaveLen(2))
+	Expect(entries[0].Message).To(Equal("Query"))
+	Expect(entries[1].Message).To(Equal("Bind"))
+
+	entries, err = srv.WaitForQuery(JournalFilter{FixtureID: id}, 2, time.Second)
+	Expect(err).To(BeNil())
+	Expect(entries).To(HaveLen(2))
+
+	// it gives up after the timeout with what there was
+	entries, err = srv.WaitForQuery(JournalFilter{FixtureID: id}, 3, 50*time.Millisecond)
+	Expect(err).ToNot(BeNil())
+	Expect(err.Error()).To(Equal("timed out waiting for queries answered by fixture " + id + ", received 2 of 3"))
+	Expect(entries).To(HaveLen(2))
+	_, err = srv.WaitForQuery(JournalFilter{SQL: "("}, 1, 0)
+	Expect(err).ToNot(BeNil())
+}
@@ -1,12 +1,18 @@
 package pgmock
 
 import (
+	"encoding/binary"
 	"fmt"
 )
 
 // Message formats from PG 10.0
 // https://www.postgresql.org/docs/current/protocol-message-formats.html
 
+// _FrontendMessage is implemented by the messages the client sends that are read after their Byte1 identifier
+type _FrontendMessage interface {
+	read(m *_Messenger) error
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // AuthenticationOk (B)
@@ -152,14 +158,15 @@ type _AuthenticationSASL struct {
 
 func (pgm *_AuthenticationSASL) write(m *_Messenger) error {
 
-	// work out the message length
+	// work out the message length, the list is always closed off with a terminating \x00
 	mechanisms := []byte{}
 	for _, s := range pgm.Mechanisms {
 		mechanisms = append(mechanisms, []byte(s+"\x00")...)
 	}
+	mechanisms = append(mechanisms, 0)
 
 	// write the message out
-	m.writeByte(AuthenticationSASLMessageID).writeInt32(int32(4 + len(mechanisms))).writeInt32(10).writeByteArray(mechanisms...)
+	m.writeByte(AuthenticationSASLMessageID).writeInt32(int32(8 + len(mechanisms))).writeInt32(10).writeByteArray(mechanisms...)
 	return m.Error
 }
 
@@ -177,7 +184,7 @@ type _AuthenticationSASLContinue struct {
 }
 
 func (pgm *_AuthenticationSASLContinue) write(m *_Messenger) error {
-	m.writeByte(AuthenticationSASLContinueMessageID).writeInt32(int32(4 + len(pgm.SASLData))).writeInt32(11).writeByteArray(pgm.SASLData...)
+	m.writeByte(AuthenticationSASLContinueMessageID).writeInt32(int32(8 + len(pgm.SASLData))).writeInt32(11).writeByteArray(pgm.SASLData...)
 	return m.Error
 }
 
@@ -195,7 +202,26 @@ type _AuthenticationSASLFinal struct {
 }
 
 func (pgm *_AuthenticationSASLFinal) write(m *_Messenger) error {
-	m.writeByte(AuthenticationSASLFinalMessageID).writeInt32(int32(4 + len(pgm.SASLData))).writeInt32(11).writeByteArray(pgm.SASLData...)
+	m.writeByte(AuthenticationSASLFinalMessageID).writeInt32(int32(8 + len(pgm.SASLData))).writeInt32(12).writeByteArray(pgm.SASLData...)
+	return m.Error
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Authentication requests all share the same layout, so there's a general form for when the type is decided at runtime
+
+// Byte1('R')	Identifies the message as an authentication request.
+// Int32		Length of message contents in bytes, including self.
+// Int32		The authentication request type, 0 for AuthenticationOk, 3 for AuthenticationCleartextPassword etc.
+// Byten		Data specific to the request type, if any.
+
+type _AuthenticationRequest struct {
+	Type int32
+	Data []byte
+}
+
+func (pgm *_AuthenticationRequest) write(m *_Messenger) error {
+	m.writeByte(AuthenticationOkMessageID).writeInt32(int32(8 + len(pgm.Data))).writeInt32(pgm.Type).writeByteArray(pgm.Data...)
 	return m.Error
 }
 
@@ -208,12 +234,21 @@ func (pgm *_AuthenticationSASLFinal) write(m *_Messenger) error {
 // Int32		The process ID of this backend.
 // Int32		The secret key of this backend.
 
+// From protocol 3.2 the secret key is variable length ( up to 256 bytes ), so the last field becomes
+
+// Byten		The secret key of this backend.
+
 type _BackendKeyData struct {
-	ProcessID int32
-	SecretKey int32
+	ProcessID     int32
+	SecretKey     int32
+	LongSecretKey []byte // protocol 3.2+, replaces SecretKey when set
 }
 
 func (pgm *_BackendKeyData) write(m *_Messenger) error {
+	if pgm.LongSecretKey != nil {
+		m.writeByte(BackendKeyDataMessageID).writeInt32(int32(8 + len(pgm.LongSecretKey))).writeInt32(pgm.ProcessID).writeByteArray(pgm.LongSecretKey...)
+		return m.Error
+	}
 	m.writeByte(BackendKeyDataMessageID).writeInt32(12).writeInt32(pgm.ProcessID).writeInt32(pgm.SecretKey)
 	return m.Error
 }
@@ -248,7 +283,7 @@ func (pgm *_BackendKeyData) write(m *_Messenger) error {
 // Int16[R]	The result-column format codes. Each must presently be zero (text) or one (binary).
 
 type _BindParameter struct {
-	Value            []byte
+	Value            []byte // nil for NULL
 	FormatCode       int16
 	ResultFormatCode int16
 }
@@ -257,17 +292,12 @@ type _Bind struct {
 	DestinationPortal string
 	PreparedStatement string
 	Parameters        []*_BindParameter
+	ResultFormatCodes []int16
 }
 
 func (pgm *_Bind) read(m *_Messenger) error {
 
-	// ignore the first byte as it's already been fetched to determine message type
-
-	// grab the message length and discard..
-	m.readInt32()
-	if m.Error != nil {
-		return fmt.Errorf("unable to read message length, err: %s", m.Error)
-	}
+	// the message id and length are already read in
 
 	// grab the destination portal
 	pgm.DestinationPortal = m.readString()
@@ -295,17 +325,6 @@ func (pgm *_Bind) read(m *_Messenger) error {
 		}
 	}
 
-	// helper function to the right format code
-	getFormatCode := func(idx int) int16 {
-		if nFormatCodes == 0 {
-			return -1
-		} else if len(formatCodes) < idx {
-			return formatCodes[0]
-		} else {
-			return formatCodes[idx]
-		}
-	}
-
 	// get the number of query parameters
 	nParameters := m.readInt16()
 	if m.Error != nil {
@@ -318,7 +337,7 @@ func (pgm *_Bind) read(m *_Messenger) error {
 
 		// create a new param
 		param := &_BindParameter{
-			FormatCode: getFormatCode(int(i)),
+			FormatCode: formatCode(formatCodes, int(i)),
 		}
 
 		// read the length of the value
@@ -327,10 +346,12 @@ func (pgm *_Bind) read(m *_Messenger) error {
 			return fmt.Errorf("unable to read parameters %d length, err: %s", i, m.Error)
 		}
 
-		// read in the vaue
-		param.Value = m.readBytes(valLen)
-		if m.Error != nil {
-			return fmt.Errorf("unable to read parameters %d value, err: %s", i, m.Error)
+		// read in the vaue, -1 means NULL
+		if valLen >= 0 {
+			param.Value = m.readBytes(valLen)
+			if m.Error != nil {
+				return fmt.Errorf("unable to read parameters %d value, err: %s", i, m.Error)
+			}
 		}
 
 		// add it to the param list
@@ -344,33 +365,35 @@ func (pgm *_Bind) read(m *_Messenger) error {
 	}
 
 	// read in the format codes
-	resultFormatCodes := make([]int16, nResultFormatCodes)
+	pgm.ResultFormatCodes = make([]int16, nResultFormatCodes)
 	for i := int16(0); i < nResultFormatCodes; i++ {
-		resultFormatCodes[i] = m.readInt16()
+		pgm.ResultFormatCodes[i] = m.readInt16()
 		if m.Error != nil {
 			return fmt.Errorf("unable to read resultFormatCode %d, err: %s", i, m.Error)
 		}
 	}
 
-	// helper function to the right result column format code
-	getResultFormatCode := func(idx int) int16 {
-		if nResultFormatCodes == 0 {
-			return -1
-		} else if len(resultFormatCodes) < idx {
-			return resultFormatCodes[0]
-		} else {
-			return resultFormatCodes[idx]
-		}
-	}
-
 	// set the result format codes
 	for i := int16(0); i < nParameters; i++ {
-		pgm.Parameters[i].ResultFormatCode = getResultFormatCode(int(i))
+		pgm.Parameters[i].ResultFormatCode = formatCode(pgm.ResultFormatCodes, int(i))
 	}
 
 	return nil
 }
 
+// formatCode picks the format code for the idx'th value, no codes means text for everything and a single code applies
+// to everything
+func formatCode(codes []int16, idx int) int16 {
+	switch {
+	case len(codes) == 0:
+		return 0
+	case len(codes) == 1 || idx >= len(codes):
+		return codes[0]
+	default:
+		return codes[idx]
+	}
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // BindComplete (B)
@@ -396,9 +419,12 @@ func (pgm *_BindComplete) write(m *_Messenger) error {
 // Int32				The process ID of the target backend.
 // Int32				The secret key for the target backend.
 
+// From protocol 3.2 the secret key is variable length, so the last field is a Byten sized by the message length.
+
 type _CancelRequest struct {
-	ProcessID int32
-	SecretKey int32
+	ProcessID     int32
+	SecretKey     int32
+	LongSecretKey []byte // protocol 3.2+, SecretKey holds the first 4 bytes
 }
 
 func (pgm *_CancelRequest) read(m *_Messenger) error {
@@ -418,6 +444,26 @@ func (pgm *_CancelRequest) read(m *_Messenger) error {
 	return nil
 }
 
+// readLong reads a protocol 3.2 cancel request where the secret key is keyLen bytes long
+func (pgm *_CancelRequest) readLong(m *_Messenger, keyLen int32) error {
+
+	if keyLen < 4 || keyLen > 256 {
+		return fmt.Errorf("_CancelRequest has an invalid secret key length %d", keyLen)
+	}
+
+	pgm.ProcessID = m.readInt32()
+	if m.Error != nil {
+		return m.Error
+	}
+	pgm.LongSecretKey = m.readBytes(keyLen)
+	if m.Error != nil {
+		return m.Error
+	}
+	pgm.SecretKey = int32(binary.BigEndian.Uint32(pgm.LongSecretKey))
+
+	return nil
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // Close (F)
@@ -434,11 +480,7 @@ type _Close struct {
 
 func (pgm *_Close) read(m *_Messenger) error {
 
-	// read and discard the message length
-	m.readInt32()
-	if m.Error != nil {
-		return m.Error
-	}
+	// the message id and length are already read in
 
 	// read the close type in
 	pgm.CloseType = m.readByte()
@@ -632,7 +674,17 @@ func (pgm *_Describe) read(m *_Messenger) error {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// EmptyQueryResponse
+// EmptyQueryResponse (B)
+
+// Byte1('I')	Identifies the message as a response to an empty query string. (This substitutes for CommandComplete.)
+// Int32(4)		Length of message contents in bytes, including self.
+
+type _EmptyQueryResponse struct{}
+
+func (pgm *_EmptyQueryResponse) write(m *_Messenger) error {
+	m.writeByte(EmptyQueryResponseMessageID).writeInt32(4)
+	return m.Error
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -690,7 +742,33 @@ func (pgm *_ErrorResponse) write(m *_Messenger) error {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// Execute
+// Execute (F)
+
+// Byte1('E')	Identifies the message as an Execute command.
+// Int32		Length of message contents in bytes, including self.
+// String		The name of the portal to execute (an empty string selects the unnamed portal).
+// Int32		Maximum number of rows to return, if portal contains a query that returns rows (ignored otherwise).
+//				Zero denotes "no limit".
+
+type _Execute struct {
+	Portal  string
+	MaxRows int32
+}
+
+func (pgm *_Execute) read(m *_Messenger) error {
+
+	// the message id and length are already read in
+	pgm.Portal = m.readString()
+	if m.Error != nil {
+		return fmt.Errorf("_Execute unable to read portal, err: %s", m.Error)
+	}
+	pgm.MaxRows = m.readInt32()
+	if m.Error != nil {
+		return fmt.Errorf("_Execute unable to read max rows, err: %s", m.Error)
+	}
+
+	return nil
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -710,11 +788,51 @@ func (pgm *_ErrorResponse) write(m *_Messenger) error {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// NegotiateProtocolVersion
+// NegotiateProtocolVersion (B)
+
+// Byte1('v')	Identifies the message as a protocol version negotiation message.
+// Int32		Length of message contents in bytes, including self.
+// Int32		Newest minor protocol version supported by the server for the major protocol version requested by the client.
+// Int32		Number of protocol options not recognized by the server.
+
+// Then, for protocol option not recognized by the server, there is the following:
+
+// String		The option name.
+
+type _NegotiateProtocolVersion struct {
+	NewestMinorVersion  int32
+	UnrecognisedOptions []string
+}
+
+func (pgm *_NegotiateProtocolVersion) write(m *_Messenger) error {
+
+	// work out the message length
+	msgLen := int32(12)
+	for _, o := range pgm.UnrecognisedOptions {
+		msgLen += int32(len(o) + 1)
+	}
+
+	m.writeByte(NegotiateProtocolVersionMessageID).
+		writeInt32(msgLen).
+		writeInt32(pgm.NewestMinorVersion).
+		writeInt32(int32(len(pgm.UnrecognisedOptions))).
+		writeStringArray(pgm.UnrecognisedOptions...)
+	return m.Error
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// NoData
+// NoData (B)
+
+// Byte1('n')	Identifies the message as a no-data indicator.
+// Int32(4)		Length of message contents in bytes, including self.
+
+type _NoData struct{}
+
+func (pgm *_NoData) write(m *_Messenger) error {
+	m.writeByte(NoDataMessageID).writeInt32(4)
+	return m.Error
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -837,11 +955,42 @@ func (pgm *_ParseComplete) write(m *_Messenger) error {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// PasswordMessage
+// PasswordMessage (F)
+
+// Byte1('p')	Identifies the message as a password response. Note that this is also used for GSSAPI, SSPI and SASL
+//				response messages. The exact message type can be deduced from the context.
+// Int32		Length of message contents in bytes, including self.
+// String		The password (encrypted, if requested).
+
+type _PasswordMessage struct {
+	Password string
+}
+
+func (pgm *_PasswordMessage) read(m *_Messenger) error {
+
+	// the message id and length are already read in
+	pgm.Password = m.readString()
+	if m.Error != nil {
+		return fmt.Errorf("_PasswordMessage unable to read password, err: %s", m.Error)
+	}
+
+	return nil
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// PortalSuspended
+// PortalSuspended (B)
+
+// Byte1('s')	Identifies the message as a portal-suspended indicator. Note this only appears if an Execute message's
+//				row-count limit was reached.
+// Int32(4)		Length of message contents in bytes, including self.
+
+type _PortalSuspended struct{}
+
+func (pgm *_PortalSuspended) write(m *_Messenger) error {
+	m.writeByte(PortalSuspendedMessageID).writeInt32(4)
+	return m.Error
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -968,11 +1117,72 @@ func (pgm *_RowDescription) write(m *_Messenger) error {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// SASLInitialResponse
+// SASLInitialResponse (F)
+
+// Byte1('p')	Identifies the message as an initial SASL response. Note that this is also used for GSSAPI, SSPI and
+//				password response messages. The exact message type is deduced from the context.
+// Int32		Length of message contents in bytes, including self.
+// String		Name of the SASL authentication mechanism that the client selected.
+// Int32		Length of SASL mechanism specific "Initial Client Response" that follows, or -1 if there is no Initial
+//				Response.
+// Byten		SASL mechanism specific "Initial Response".
+
+type _SASLInitialResponse struct {
+	Mechanism string
+	Data      []byte
+}
+
+func (pgm *_SASLInitialResponse) read(m *_Messenger) error {
+
+	// the message id and length are already read in
+
+	// read the selected mechanism
+	pgm.Mechanism = m.readString()
+	if m.Error != nil {
+		return fmt.Errorf("_SASLInitialResponse unable to read mechanism, err: %s", m.Error)
+	}
+
+	// read the length of the initial response, -1 means there isn't one
+	dataLen := m.readInt32()
+	if m.Error != nil {
+		return fmt.Errorf("_SASLInitialResponse unable to read data length, err: %s", m.Error)
+	}
+	if dataLen < 0 {
+		pgm.Data = nil
+		return nil
+	}
+
+	pgm.Data = m.readBytes(dataLen)
+	if m.Error != nil {
+		return fmt.Errorf("_SASLInitialResponse unable to read data, err: %s", m.Error)
+	}
+
+	return nil
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// SASLResponse
+// SASLResponse (F)
+
+// Byte1('p')	Identifies the message as a SASL response. Note that this is also used for GSSAPI, SSPI and password
+//				response messages. The exact message type can be deduced from the context.
+// Int32		Length of message contents in bytes, including self.
+// Byten		SASL mechanism specific message data.
+
+type _SASLResponse struct {
+	Data []byte
+}
+
+func (pgm *_SASLResponse) read(m *_Messenger) error {
+
+	// the message id and length are already read in, so the messenger only holds the message body
+	pgm.Data = m.readRemaining()
+	if m.Error != nil {
+		return fmt.Errorf("_SASLResponse unable to read data, err: %s", m.Error)
+	}
+
+	return nil
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -1023,13 +1233,11 @@ func (pgm *_StartupMessage) read(m *_Messenger) error {
 		if k == "" {
 			break
 		}
+		// values can legitimately be empty, only an empty key ends the list
 		v := m.readString()
 		if m.Error != nil {
 			return m.Error
 		}
-		if v == "" {
-			break
-		}
 
 		pgm.Parameters[k] = v
 	}
@@ -232,9 +232,9 @@ func TestAuthenticationSASL(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLMessageID,
-		0, 0, 0, 4, // int32 length of message including self
+		0, 0, 0, 9, // int32 length of message including self
 		0, 0, 0, 10, // int32(10)
-		// no mechanisms
+		0, // no mechanisms, just the list terminator
 	}))
 
 	// reset the buffer
@@ -247,11 +247,12 @@ func TestAuthenticationSASL(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLMessageID,
-		0, 0, 0, 22, // int32 length of message including self
+		0, 0, 0, 27, // int32 length of message including self
 		0, 0, 0, 10, // int32(10)
 		116, 101, 115, 116, 49, 0, // test1\x00
 		116, 101, 115, 116, 50, 0, // test2\x00
 		116, 101, 115, 116, 51, 0, // test3\x00
+		0, // list terminator
 	}))
 }
 
@@ -272,7 +273,7 @@ func TestAuthenticationSASLContinue(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLContinueMessageID,
-		0, 0, 0, 4, // int32 length of message including self
+		0, 0, 0, 8, // int32 length of message including self
 		0, 0, 0, 11, // int32(11)
 		// no SASLData
 	}))
@@ -287,7 +288,7 @@ func TestAuthenticationSASLContinue(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLContinueMessageID,
-		0, 0, 0, 8, // int32 length of message including self
+		0, 0, 0, 12, // int32 length of message including self
 		0, 0, 0, 11, // int32(11)
 		116, 101, 115, 116, // test
 	}))
@@ -310,8 +311,8 @@ func TestAuthenticationSASLFinal(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLFinalMessageID,
-		0, 0, 0, 4, // int32 length of message including self
-		0, 0, 0, 11, // int32(11)
+		0, 0, 0, 8, // int32 length of message including self
+		0, 0, 0, 12, // int32(12)
 		// no SASLData
 	}))
 
@@ -325,14 +326,37 @@ func TestAuthenticationSASLFinal(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(b.Bytes()).To(Equal([]byte{
 		AuthenticationSASLFinalMessageID,
-		0, 0, 0, 8, // int32 length of message including self
-		0, 0, 0, 11, // int32(11)
+		0, 0, 0, 12, // int32 length of message including self
+		0, 0, 0, 12, // int32(12)
 		116, 101, 115, 116, // test
 	}))
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+func TestAuthenticationRequest(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b, m := createBufMesPair()
+
+	// write the message to the messenger
+	err := (&_AuthenticationRequest{Type: AuthTypeMD5Password, Data: []byte{1, 2, 3, 4}}).write(m)
+
+	// assert the results, should be the same as the specific message
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		AuthenticationMD5PasswordMessageID,
+		0, 0, 0, 12, // int32(12)
+		0, 0, 0, 5, // int32(5)
+		1, 2, 3, 4, // salt
+	}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func TestBackendKeyData(t *testing.T) {
 
 	// gomega requirement
@@ -367,6 +391,21 @@ func TestBackendKeyData(t *testing.T) {
 		0, 0, 4, 210, // int32 process id
 		0, 0, 16, 225, // int32 secret key
 	}))
+
+	// reset the buffer
+	b.Reset()
+
+	// write a protocol 3.2 message with a long key to the messenger
+	err = (&_BackendKeyData{ProcessID: 1234, SecretKey: 4321, LongSecretKey: []byte("0123456789")}).write(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		BackendKeyDataMessageID,
+		0, 0, 0, 18, // int32 length of message including self
+		0, 0, 4, 210, // int32 process id
+		48, 49, 50, 51, 52, 53, 54, 55, 56, 57, // byten secret key
+	}))
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -378,20 +417,19 @@ func TestBind(t *testing.T) {
 
 	// create a dummy message to use
 	b, m := createBufMesPair()
-	m.writeInt32(0). // msg len - ignored
-				writeString("--portal--").
-				writeString("--statement--").
-				writeInt16(2).   // n format codes
-				writeInt16(123). // first format code
-				writeInt16(234). // second format code
-				writeInt16(2).   // n parameters
-				writeInt32(9).   // first param length
-				writeByteArray([]byte("--valu1--")...).
-				writeInt32(9). // second param length
-				writeByteArray([]byte("--valu2--")...).
-				writeInt16(2).   // n result codes
-				writeInt16(123). // first result format code
-				writeInt16(234)  // second result format code
+	m.writeString("--portal--").
+		writeString("--statement--").
+		writeInt16(2).   // n format codes
+		writeInt16(123). // first format code
+		writeInt16(234). // second format code
+		writeInt16(2).   // n parameters
+		writeInt32(9).   // first param length
+		writeByteArray([]byte("--valu1--")...).
+		writeInt32(9). // second param length
+		writeByteArray([]byte("--valu2--")...).
+		writeInt16(2).   // n result codes
+		writeInt16(123). // first result format code
+		writeInt16(234)  // second result format code
 
 	// create a new reader to read the message
 	m = newMessenger(bytes.NewBuffer(b.Bytes()))
@@ -411,6 +449,35 @@ func TestBind(t *testing.T) {
 	Expect(msg.Parameters[1].FormatCode).To(Equal(int16(234)))
 	Expect(msg.Parameters[1].ResultFormatCode).To(Equal(int16(234)))
 	Expect(msg.Parameters[1].Value).To(Equal([]byte("--valu2--")))
+
+	// reset the buffer and write a message with a single format code and a NULL
+	b.Reset()
+	m = newMessenger(b)
+	m.writeString("").
+		writeString("").
+		writeInt16(1). // n format codes
+		writeInt16(1). // format code for everything
+		writeInt16(2). // n parameters
+		writeInt32(4). // first param length
+		writeInt32(42).
+		writeInt32(-1). // NULL
+		writeInt16(0)   // n result codes
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg = &_Bind{}
+	err = msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(len(msg.Parameters)).To(Equal(2))
+	Expect(msg.Parameters[0].FormatCode).To(Equal(int16(1)))
+	Expect(msg.Parameters[0].Value).To(Equal([]byte{0, 0, 0, 42}))
+	Expect(msg.Parameters[1].FormatCode).To(Equal(int16(1)))
+	Expect(msg.Parameters[1].Value).To(BeNil())
+	Expect(msg.ResultFormatCodes).To(BeEmpty())
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -457,6 +524,26 @@ func TestCancelRequest(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(msg.ProcessID).To(Equal(int32(12345)))
 	Expect(msg.SecretKey).To(Equal(int32(54321)))
+
+	// reset the buffer and write a protocol 3.2 request with a long key
+	b.Reset()
+	m = newMessenger(b)
+	m.writeInt32(12345).
+		writeInt32(54321).
+		writeByteArray([]byte("--long-key--")...)
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg = &_CancelRequest{}
+	err = msg.readLong(m, 16)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.ProcessID).To(Equal(int32(12345)))
+	Expect(msg.SecretKey).To(Equal(int32(54321)))
+	Expect(msg.LongSecretKey).To(Equal([]byte{0, 0, 212, 49, 45, 45, 108, 111, 110, 103, 45, 107, 101, 121, 45, 45}))
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -468,8 +555,7 @@ func TestClose(t *testing.T) {
 
 	// create a dummy message to use
 	b, m := createBufMesPair()
-	m.writeInt32(0).
-		writeByte(CloseStatement).
+	m.writeByte(CloseStatement).
 		writeString("--statement--")
 
 	// create a new reader to read the message
@@ -657,7 +743,24 @@ func TestDescribe(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestEmptyQueryResponse(t *testing.T) {}
+func TestEmptyQueryResponse(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b, m := createBufMesPair()
+
+	// write the message to the messenger
+	err := (&_EmptyQueryResponse{}).write(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		EmptyQueryResponseMessageID,
+		0, 0, 0, 4, // int32(4)
+	}))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -698,7 +801,28 @@ func TestErrorResponse(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestExecute(t *testing.T) {}
+func TestExecute(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// create a dummy message to use
+	b, m := createBufMesPair()
+	m.writeString("--portal--").
+		writeInt32(10)
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg := &_Execute{}
+	err := msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.Portal).To(Equal("--portal--"))
+	Expect(msg.MaxRows).To(Equal(int32(10)))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -718,11 +842,48 @@ func TestGSSResponse(t *testing.T) {}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestNegotiateProtocolVersion(t *testing.T) {}
+func TestNegotiateProtocolVersion(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b, m := createBufMesPair()
+
+	// write the message to the messenger
+	err := (&_NegotiateProtocolVersion{NewestMinorVersion: 2, UnrecognisedOptions: []string{"_pq_.a"}}).write(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		NegotiateProtocolVersionMessageID,
+		0, 0, 0, 19, // int32 length of message including self
+		0, 0, 0, 2, // int32 newest minor version
+		0, 0, 0, 1, // int32 number of unrecognised options
+		95, 112, 113, 95, 46, 97, 0, // _pq_.a\x00
+	}))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestNoData(t *testing.T) {}
+func TestNoData(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b, m := createBufMesPair()
+
+	// write the message to the messenger
+	err := (&_NoData{}).write(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		NoDataMessageID,
+		0, 0, 0, 4, // int32(4)
+	}))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -835,11 +996,47 @@ func TestParseComplete(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestPasswordMessage(t *testing.T) {}
+func TestPasswordMessage(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// create a dummy message to use
+	b, m := createBufMesPair()
+	m.writeString("--password--")
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg := &_PasswordMessage{}
+	err := msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.Password).To(Equal("--password--"))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestPortalSuspended(t *testing.T) {}
+func TestPortalSuspended(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b, m := createBufMesPair()
+
+	// write the message to the messenger
+	err := (&_PortalSuspended{}).write(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(b.Bytes()).To(Equal([]byte{
+		PortalSuspendedMessageID,
+		0, 0, 0, 4, // int32(4)
+	}))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -925,11 +1122,70 @@ func TestRowDescription(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestSASLInitialResponse(t *testing.T) {}
+func TestSASLInitialResponse(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// create a dummy message to use
+	b, m := createBufMesPair()
+	m.writeString("SCRAM-SHA-256").
+		writeInt32(4).
+		writeByteArray([]byte("test")...)
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg := &_SASLInitialResponse{}
+	err := msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.Mechanism).To(Equal("SCRAM-SHA-256"))
+	Expect(msg.Data).To(Equal([]byte("test")))
+
+	// reset the buffer and write a message with no initial response
+	b.Reset()
+	m = newMessenger(b)
+	m.writeString("SCRAM-SHA-256").
+		writeInt32(-1)
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg = &_SASLInitialResponse{}
+	err = msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.Mechanism).To(Equal("SCRAM-SHA-256"))
+	Expect(msg.Data).To(BeNil())
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func TestSASLResponse(t *testing.T) {}
+func TestSASLResponse(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// create a dummy message to use
+	b, m := createBufMesPair()
+	m.writeByteArray([]byte("test")...)
+
+	// create a new reader to read the message
+	m = newMessenger(bytes.NewBuffer(b.Bytes()))
+
+	// create the message and attempt to read the data into it
+	msg := &_SASLResponse{}
+	err := msg.read(m)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(msg.Data).To(Equal([]byte("test")))
+}
 
 // ---------------------------------------------------------------------------------------------------------------------
 
@@ -941,7 +1197,9 @@ func TestStartupMessage(t *testing.T) {
 	// create a dummy message to use
 	b, m := createBufMesPair()
 	m.writeString("key1").writeString("val1").
-		writeString("key2").writeString("val2")
+		writeString("key2").writeString("").
+		writeString("key3").writeString("val3").
+		writeByte(0)
 
 	// create a new reader to read the message
 	m = newMessenger(bytes.NewBuffer(b.Bytes()))
@@ -950,11 +1208,12 @@ func TestStartupMessage(t *testing.T) {
 	msg := &_StartupMessage{}
 	err := msg.read(m)
 
-	// assert the results
+	// assert the results, empty values don't end the list
 	Expect(err).To(BeNil())
-	Expect(len(msg.Parameters)).To(Equal(2))
+	Expect(len(msg.Parameters)).To(Equal(3))
 	Expect(msg.Parameters["key1"]).To(Equal("val1"))
-	Expect(msg.Parameters["key2"]).To(Equal("val2"))
+	Expect(msg.Parameters["key2"]).To(Equal(""))
+	Expect(msg.Parameters["key3"]).To(Equal("val3"))
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -3,6 +3,7 @@ package pgmock
 import (
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 )
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -151,6 +152,15 @@ func (m *_Messenger) readBytes(len int32) []byte {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// readRemaining reads everything left in the stream, only sensible when reading a message body from a buffer
+func (m *_Messenger) readRemaining() []byte {
+	var res []byte
+	res, m.Error = ioutil.ReadAll(m.Stream)
+	return res
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func (m *_Messenger) readInt16() (res int16) {
 	m.Error = binary.Read(m.Stream, binary.BigEndian, &res)
 	return res
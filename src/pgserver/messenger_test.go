@@ -302,6 +302,33 @@ func TestReadBytes(t *testing.T) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+func TestReadRemaining(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// grab the test objects
+	b := bytes.NewBufferString("--testdata--")
+	m := newMessenger(b)
+
+	// read 4 bytes then the rest
+	m.readBytes(4)
+	fb := m.readRemaining()
+
+	// check it's correct in the buffer
+	Expect(m.Error).To(BeNil())
+	Expect(fb).To(Equal([]byte("stdata--")))
+
+	// nothing left
+	fb = m.readRemaining()
+
+	// check it's correct in the buffer
+	Expect(m.Error).To(BeNil())
+	Expect(fb).To(Equal([]byte{}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func TestReadInt16(t *testing.T) {
 
 	// gomega requirement
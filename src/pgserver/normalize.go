@@ -0,0 +1,338 @@
+package pgmock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _SQLTokenKind is the rough class of a lexed SQL token, just enough to normalise queries not to parse them
+type _SQLTokenKind int
+
+const (
+	sqlTokenWord _SQLTokenKind = iota
+	sqlTokenQuotedIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenParam
+	sqlTokenOperator
+	sqlTokenPunct
+)
+
+type _SQLToken struct {
+	Kind _SQLTokenKind
+	Text string
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sqlKeywords are folded to upper case when normalising, anything else unquoted is left alone as an identifier. The
+// built in type names are in there too as they're written in either case.
+var sqlKeywords = func() map[string]bool {
+	keywords := map[string]bool{}
+	for _, k := range strings.Fields(`
+		ABORT ACTION ADD ALL ALTER ALWAYS ANALYSE ANALYZE AND ANY ARRAY AS ASC ASYMMETRIC AT AUTHORIZATION BEGIN
+		BETWEEN BOTH BY CALL CASCADE CASE CAST CHECK COALESCE COLLATE COLUMN COMMENT COMMIT COMMITTED CONCURRENTLY
+		CONFLICT CONSTRAINT COPY CREATE CROSS CUBE CURRENT CURRENT_CATALOG CURRENT_DATE CURRENT_ROLE CURRENT_SCHEMA
+		CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER CURSOR CYCLE DATABASE DAY DEALLOCATE DECLARE DEFAULT DEFERRABLE
+		DEFERRED DELETE DESC DISCARD DISTINCT DO DOMAIN DROP EACH ELSE END ESCAPE EXCEPT EXCLUDE EXCLUSIVE EXECUTE
+		EXISTS EXPLAIN EXTENSION EXTRACT FALSE FETCH FILTER FIRST FOLLOWING FOR FOREIGN FROM FULL FUNCTION
+		GENERATED GRANT GREATEST GROUP GROUPING HAVING HOUR IF ILIKE IMMEDIATE IN INCLUDE INDEX INHERITS INITIALLY
+		INNER INSERT INTERSECT INTERVAL INTO IS ISNULL ISOLATION JOIN KEY LAST LATERAL LEADING LEAST LEFT LEVEL LIKE
+		LIMIT LISTEN LOCAL LOCALTIME LOCALTIMESTAMP LOCK MATCHED MATERIALIZED MERGE MINUTE MONTH NATURAL NEXT NO NOT
+		NOTHING NOTIFY NOTNULL NOWAIT NULL NULLIF NULLS OF OFFSET ON ONLY OR ORDER ORDINALITY OUTER OVER OVERLAPS
+		OVERLAY OWNED OWNER PARTITION PLACING POSITION PRECEDING PREPARE PRIMARY PROCEDURE RANGE READ RECURSIVE
+		REFERENCES REFRESH RELEASE RENAME REPEATABLE REPLACE RESET RESTRICT RETURNING RETURNS REVOKE RIGHT ROLE
+		ROLLBACK ROLLUP ROW ROWS SAVEPOINT SCHEMA SECOND SELECT SEQUENCE SERIALIZABLE SESSION SESSION_USER SET SETS
+		SHARE SHOW SIMILAR SKIP SOME START STATEMENT SUBSTRING SYMMETRIC TABLE TABLESAMPLE TEMP TEMPORARY THEN TIES
+		TO TRAILING TRANSACTION TREAT TRIGGER TRIM TRUE TRUNCATE TYPE UNBOUNDED UNCOMMITTED UNION UNIQUE UNKNOWN
+		UNLISTEN UNLOGGED UNTIL UPDATE USER USING VACUUM VALUES VARIADIC VARYING VIEW WHEN WHERE WINDOW WITH WITHIN
+		WITHOUT WORK WRITE YEAR ZONE
+
+		BIGINT BIGSERIAL BIT BOOL BOOLEAN BYTEA CHAR CHARACTER CIDR DATE DATERANGE DEC DECIMAL DOUBLE FLOAT FLOAT4
+		FLOAT8 INET INT INT2 INT4 INT8 INT4RANGE INT8RANGE INTEGER JSON JSONB MONEY NUMERIC NUMRANGE OID
+		PRECISION REAL REGCLASS SERIAL SMALLINT SMALLSERIAL TEXT TIME TIMESTAMP TIMESTAMPTZ TIMETZ TSRANGE
+		TSTZRANGE UUID VARCHAR XML`) {
+		keywords[k] = true
+	}
+	return keywords
+}()
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// tokenizeSQL splits sql into tokens, dropping whitespace and comments. It's forgiving rather than correct, anything
+// it doesn't understand comes out as a single character of punctuation.
+func tokenizeSQL(sql string) []_SQLToken {
+
+	tokens := []_SQLToken{}
+	for i := 0; i < len(sql); {
+
+		c := sql[i]
+		switch {
+
+		// whitespace separates tokens and nothing else
+		case isSQLSpace(c):
+			i++
+
+		// -- comments run to the end of the line
+		case strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+
+		// /* comments */ nest in postgres
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth, i = depth+1, i+2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth, i = depth-1, i+2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+
+		// 'string literals', with E'' escapes
+		case c == '\'' || ((c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\''):
+			start := i
+			i = scanSQLQuoted(sql, i+strings.IndexByte(sql[i:], '\''), '\'', c != '\'')
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenString, Text: sql[start:i]})
+
+		// "quoted identifiers" keep their case
+		case c == '"':
+			start := i
+			i = scanSQLQuoted(sql, i, '"', false)
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenQuotedIdent, Text: sql[start:i]})
+
+		// $1 style parameters and $tag$ dollar quoted strings
+		case c == '$':
+			start := i
+			if i+1 < len(sql) && isSQLDigit(sql[i+1]) {
+				for i++; i < len(sql) && isSQLDigit(sql[i]); i++ {
+				}
+				tokens = append(tokens, _SQLToken{Kind: sqlTokenParam, Text: sql[start:i]})
+				continue
+			}
+			end := strings.IndexByte(sql[i+1:], '$')
+			if end < 0 {
+				tokens = append(tokens, _SQLToken{Kind: sqlTokenPunct, Text: "$"})
+				i++
+				continue
+			}
+			tag := sql[i : i+end+2]
+			close := strings.Index(sql[i+len(tag):], tag)
+			if close < 0 {
+				i = len(sql)
+			} else {
+				i += len(tag) + close + len(tag)
+			}
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenString, Text: sql[start:i]})
+
+		// numbers, including decimals and exponents
+		case isSQLDigit(c) || (c == '.' && i+1 < len(sql) && isSQLDigit(sql[i+1])):
+			start := i
+			for i < len(sql) && (isSQLDigit(sql[i]) || sql[i] == '.' || sql[i] == '_' ||
+				((sql[i] == 'e' || sql[i] == 'E') && i+1 < len(sql) && (isSQLDigit(sql[i+1]) || sql[i+1] == '-' || sql[i+1] == '+')) ||
+				((sql[i] == '-' || sql[i] == '+') && (sql[i-1] == 'e' || sql[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenNumber, Text: sql[start:i]})
+
+		// keywords and identifiers
+		case isSQLIdentStart(c):
+			start := i
+			for i < len(sql) && (isSQLIdentStart(sql[i]) || isSQLDigit(sql[i]) || sql[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenWord, Text: sql[start:i]})
+
+		// runs of operator characters
+		case strings.IndexByte(sqlOperatorChars, c) >= 0:
+			start := i
+			for i < len(sql) && strings.IndexByte(sqlOperatorChars, sql[i]) >= 0 &&
+				!strings.HasPrefix(sql[i:], "--") && !strings.HasPrefix(sql[i:], "/*") {
+				i++
+			}
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenOperator, Text: sql[start:i]})
+
+		default:
+			tokens = append(tokens, _SQLToken{Kind: sqlTokenPunct, Text: string(c)})
+			i++
+		}
+	}
+
+	return tokens
+}
+
+const sqlOperatorChars = "+-*/<>=~!@#%^&|`?:"
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isSQLDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSQLIdentStart(c byte) bool {
+	return c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scanSQLQuoted returns the index just past the quoted section starting at i, doubled quotes are escapes as are
+// backslashes when backslash is set
+func scanSQLQuoted(sql string, i int, quote byte, backslash bool) int {
+	for i++; i < len(sql); i++ {
+		switch {
+		case backslash && sql[i] == '\\':
+			i++
+		case sql[i] == quote && i+1 < len(sql) && sql[i+1] == quote:
+			i++
+		case sql[i] == quote:
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// normalizeSQL rewrites sql so that formatting differences don't matter: comments are dropped, whitespace collapses
+// to single spaces between words ( and disappears around punctuation ), keywords are upper cased and trailing
+// semicolons go. Identifiers and literals are left exactly as they were.
+func normalizeSQL(sql string) string {
+	return joinSQLTokens(trimSQLTokens(tokenizeSQL(sql)), normalizedSQLToken)
+}
+
+// normalizedSQLToken upper cases keywords, everything else is left as it is
+func normalizedSQLToken(t _SQLToken) string {
+	if t.Kind == sqlTokenWord && sqlKeywords[strings.ToUpper(t.Text)] {
+		return strings.ToUpper(t.Text)
+	}
+	return t.Text
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// trimSQLTokens drops any trailing semicolons
+func trimSQLTokens(tokens []_SQLToken) []_SQLToken {
+	for len(tokens) > 0 && tokens[len(tokens)-1].Kind == sqlTokenPunct && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// joinSQLTokens puts tokens back together with a single space between them, leaving out the ones before and after
+// brackets, commas and dots so the result still reads like SQL
+func joinSQLTokens(tokens []_SQLToken, text func(_SQLToken) string) string {
+
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 && !isSQLTight(tokens[i-1], "(.,") && !isSQLTight(t, "(),.") {
+			b.WriteByte(' ')
+		}
+		b.WriteString(text(t))
+	}
+
+	return b.String()
+}
+
+// isSQLTight is true for punctuation in chars, which doesn't want a space on that side of it
+func isSQLTight(t _SQLToken, chars string) bool {
+	return t.Kind == sqlTokenPunct && len(t.Text) == 1 && strings.Contains(chars, t.Text)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// fingerprintSQL normalises sql and then swaps every string and number literal for a $n placeholder, the same way
+// pg_stat_statements does, so queries differing only in their constants share a fingerprint. The literal values are
+// returned in order, numbered on from any $n parameters already in the query.
+func fingerprintSQL(sql string) (string, []string) {
+
+	tokens := trimSQLTokens(tokenizeSQL(sql))
+
+	// placeholders carry on from the highest parameter already used
+	next := 1
+	for _, t := range tokens {
+		if t.Kind == sqlTokenParam {
+			if n, err := strconv.Atoi(t.Text[1:]); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+	}
+
+	literals := []string{}
+	fingerprint := joinSQLTokens(tokens, func(t _SQLToken) string {
+		if t.Kind == sqlTokenString || t.Kind == sqlTokenNumber {
+			literals = append(literals, sqlLiteralValue(t))
+			return fmt.Sprintf("$%d", next+len(literals)-1)
+		}
+		return normalizedSQLToken(t)
+	})
+
+	return fingerprint, literals
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sqlLiteralValue unquotes a string literal token, numbers come back as they are
+func sqlLiteralValue(t _SQLToken) string {
+
+	text := t.Text
+	if t.Kind != sqlTokenString {
+		return text
+	}
+
+	// $tag$ dollar quoted $tag$
+	if text[0] == '$' {
+		tag := text[:strings.IndexByte(text[1:], '$')+2]
+		if len(text) < 2*len(tag) {
+			return ""
+		}
+		return text[len(tag) : len(text)-len(tag)]
+	}
+
+	// E'escaped' strings
+	escaped := text[0] != '\''
+	if escaped {
+		text = text[1:]
+	}
+	if len(text) < 2 {
+		return ""
+	}
+	text = text[1 : len(text)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case escaped && text[i] == '\\' && i+1 < len(text):
+			i++
+			switch text[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(text[i])
+			}
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+
+	return b.String()
+}
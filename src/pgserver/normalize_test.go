@@ -0,0 +1,64 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestNormalizeSQL(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// formatting differences all come out the same
+	expected := `SELECT id,Name FROM "Users" WHERE email = 'A@b.com' AND age >= 18`
+	for _, sql := range []string{
+		`SELECT id, Name FROM "Users" WHERE email = 'A@b.com' AND age >= 18`,
+		`select id,Name from "Users" where email='A@b.com' and age>=18;`,
+		"SELECT id,\n\tName -- the name\nFROM \"Users\" /* users /* nested */ */ WHERE email = 'A@b.com'\n  AND age >= 18 ;;",
+	} {
+		Expect(normalizeSQL(sql)).To(Equal(expected), sql)
+	}
+
+	// but identifiers and literals keep their case and contents
+	Expect(normalizeSQL(`SELECT "Select" FROM t WHERE a = 'x  -- y'`)).To(Equal(`SELECT "Select" FROM t WHERE a = 'x  -- y'`))
+	Expect(normalizeSQL(`select Id from T`)).ToNot(Equal(normalizeSQL(`select id from t`)))
+
+	// escapes, dollar quotes and parameters survive intact
+	Expect(normalizeSQL(`select E'it\'s' , 'it''s', $$ a  b $$, $tag$ x $tag$ where id = $1`)).
+		To(Equal(`SELECT E'it\'s','it''s',$$ a  b $$,$tag$ x $tag$ WHERE id = $1`))
+	Expect(normalizeSQL(`select 1.5e-3 :: numeric`)).To(Equal(`SELECT 1.5e-3 :: NUMERIC`))
+
+	// type names and the less common keywords fold too
+	Expect(normalizeSQL(`with recursive t as (select now() at time zone 'UTC' + interval '1 day', $1::integer, $2::text)`)).
+		To(Equal(normalizeSQL(`WITH RECURSIVE t AS (SELECT now() AT TIME ZONE 'UTC' + INTERVAL '1 day', $1::INTEGER, $2::TEXT)`)))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestFingerprintSQL(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// literals become placeholders and come back out in order
+	fingerprint, literals := fingerprintSQL(`select * from users where id = 1 and name = 'it''s' and score > 1.5e3;`)
+	Expect(fingerprint).To(Equal(`SELECT * FROM users WHERE id = $1 AND name = $2 AND score > $3`))
+	Expect(literals).To(Equal([]string{"1", "it's", "1.5e3"}))
+
+	// so different constants share a fingerprint
+	other, _ := fingerprintSQL(`SELECT * FROM users WHERE id = 42 AND name = 'bob' AND score > 7`)
+	Expect(other).To(Equal(fingerprint))
+
+	// existing parameters are left alone with the literals numbered after them
+	fingerprint, literals = fingerprintSQL(`UPDATE t SET a = $2, b = E'x\ny', c = $$ raw $$ WHERE id = $1`)
+	Expect(fingerprint).To(Equal(`UPDATE t SET a = $2,b = $3,c = $4 WHERE id = $1`))
+	Expect(literals).To(Equal([]string{"x\ny", " raw "}))
+
+	// and identifiers still count
+	fingerprint, _ = fingerprintSQL(`SELECT * FROM accounts WHERE id = 1`)
+	Expect(fingerprint).ToNot(Equal(other))
+}
@@ -0,0 +1,518 @@
+package pgmock
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ParamMatcher checks a single query argument, every condition that's set has to pass and an empty matcher matches
+// anything. Arguments are compared in their text form.
+type ParamMatcher struct {
+	Any       bool        `json:"any,omitempty"`
+	Equals    *string     `json:"equals,omitempty"`
+	Regex     string      `json:"regex,omitempty"`
+	Min       *float64    `json:"min,omitempty"`
+	Max       *float64    `json:"max,omitempty"`
+	Null      *bool       `json:"null,omitempty"`
+	In        []string    `json:"in,omitempty"`
+	JSONPath  string      `json:"jsonPath,omitempty"`
+	JSONValue interface{} `json:"jsonValue,omitempty"`
+}
+
+// ParamAny matches any argument, NULL included
+func ParamAny() ParamMatcher { return ParamMatcher{Any: true} }
+
+// ParamEquals matches an argument equal to value
+func ParamEquals(value string) ParamMatcher { return ParamMatcher{Equals: &value} }
+
+// ParamRegex matches an argument against a regular expression
+func ParamRegex(pattern string) ParamMatcher { return ParamMatcher{Regex: pattern} }
+
+// ParamRange matches a numeric argument between min and max inclusive
+func ParamRange(min, max float64) ParamMatcher { return ParamMatcher{Min: &min, Max: &max} }
+
+// ParamNull matches a NULL argument
+func ParamNull() ParamMatcher {
+	null := true
+	return ParamMatcher{Null: &null}
+}
+
+// ParamNotNull matches any argument that isn't NULL
+func ParamNotNull() ParamMatcher {
+	null := false
+	return ParamMatcher{Null: &null}
+}
+
+// ParamIn matches an argument equal to any of values
+func ParamIn(values ...string) ParamMatcher { return ParamMatcher{In: values} }
+
+// ParamJSONPath matches a json argument whose value at path ( $.a.b[0] style ) equals value
+func ParamJSONPath(path string, value interface{}) ParamMatcher {
+	return ParamMatcher{JSONPath: path, JSONValue: value}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _ParamMatcher is a ParamMatcher ready for use
+type _ParamMatcher struct {
+	ParamMatcher
+	Pattern   *regexp.Regexp
+	JSONValue interface{}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// compileParamMatchers validates the matchers, compiling regexes and normalising json values so they compare equal
+// to decoded json
+func compileParamMatchers(matchers []ParamMatcher) ([]*_ParamMatcher, error) {
+
+	compiled := make([]*_ParamMatcher, len(matchers))
+	for i, matcher := range matchers {
+
+		pm := &_ParamMatcher{ParamMatcher: matcher}
+		if matcher.Regex != "" {
+			pattern, err := regexp.Compile(matcher.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("param %d has an invalid regex, err: %s", i+1, err)
+			}
+			pm.Pattern = pattern
+		}
+		if matcher.JSONPath != "" {
+			raw, err := json.Marshal(matcher.JSONValue)
+			if err != nil {
+				return nil, fmt.Errorf("param %d has an invalid json value, err: %s", i+1, err)
+			}
+			json.Unmarshal(raw, &pm.JSONValue)
+		}
+
+		compiled[i] = pm
+	}
+
+	return compiled, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matchParams checks each matcher against the argument in the same position, missing arguments count as NULL
+func matchParams(matchers []*_ParamMatcher, params []*string) bool {
+	for i, matcher := range matchers {
+		var param *string
+		if i < len(params) {
+			param = params[i]
+		}
+		if !matcher.match(param) {
+			return false
+		}
+	}
+	return true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (pm *_ParamMatcher) match(param *string) bool {
+
+	// NULL only gets past an explicit null check or an empty matcher
+	if pm.Null != nil && *pm.Null != (param == nil) {
+		return false
+	}
+	if param == nil {
+		return pm.Equals == nil && pm.Pattern == nil && pm.Min == nil && pm.Max == nil && pm.In == nil && pm.JSONPath == ""
+	}
+	value := *param
+
+	if pm.Equals != nil && *pm.Equals != value {
+		return false
+	}
+	if pm.Pattern != nil && !pm.Pattern.MatchString(value) {
+		return false
+	}
+
+	if pm.Min != nil || pm.Max != nil {
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || (pm.Min != nil && n < *pm.Min) || (pm.Max != nil && n > *pm.Max) {
+			return false
+		}
+	}
+
+	if pm.In != nil {
+		found := false
+		for _, v := range pm.In {
+			found = found || v == value
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if pm.JSONPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			return false
+		}
+		found, ok := jsonPathLookup(doc, pm.JSONPath)
+		if !ok || !reflect.DeepEqual(found, pm.JSONValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// jsonPathLookup follows a simple $.a.b[0].c path through decoded json
+func jsonPathLookup(doc interface{}, path string) (interface{}, bool) {
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(strings.Replace(path, "[", ".", -1), "]", "", -1)
+	if path == "" {
+		return doc, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			next, found := v[key]
+			if !found {
+				return nil, false
+			}
+			doc = next
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			doc = v[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// decodeParam converts a bound argument to its text form, nil for NULL. Binary arguments are decoded for the common
+// types, anything else is passed through as it is.
+func decodeParam(oid int32, format int16, value []byte) *string {
+
+	if value == nil {
+		return nil
+	}
+
+	text := string(value)
+	if format != FormatBinary {
+		return &text
+	}
+
+	switch {
+	case oid == OIDBool && len(value) == 1:
+		text = "f"
+		if value[0] != 0 {
+			text = "t"
+		}
+	case oid == OIDInt2 && len(value) == 2:
+		text = strconv.Itoa(int(int16(binary.BigEndian.Uint16(value))))
+	case oid == OIDInt4 && len(value) == 4:
+		text = strconv.Itoa(int(int32(binary.BigEndian.Uint32(value))))
+	case oid == OIDInt8 && len(value) == 8:
+		text = strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10)
+	case oid == OIDFloat4 && len(value) == 4:
+		text = formatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 32)
+	case oid == OIDFloat8 && len(value) == 8:
+		text = formatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 64)
+	case oid == OIDUUID && len(value) == 16:
+		h := hex.EncodeToString(value)
+		text = h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	case oid == OIDBytea:
+		text = "\\x" + hex.EncodeToString(value)
+	case oid == OIDJSONB && len(value) > 0 && value[0] == 1:
+		text = string(value[1:])
+	}
+
+	return &text
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// binaryEncoders convert text column values to the binary format, types without one are always sent as text
+var binaryEncoders = map[int32]func(text string) ([]byte, error){
+	OIDBool: func(text string) ([]byte, error) {
+		b, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	},
+	OIDBytea: func(text string) ([]byte, error) {
+		if strings.HasPrefix(text, `\x`) {
+			return hex.DecodeString(text[2:])
+		}
+		return []byte(text), nil
+	},
+	OIDInt2: func(text string) ([]byte, error) {
+		n, err := parseInteger(text, 16)
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return b, err
+	},
+	OIDInt4: func(text string) ([]byte, error) {
+		n, err := parseInteger(text, 32)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return b, err
+	},
+	OIDInt8: func(text string) ([]byte, error) {
+		n, err := parseInteger(text, 64)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(n))
+		return b, err
+	},
+	OIDFloat4: func(text string) ([]byte, error) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 32)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(f)))
+		return b, err
+	},
+	OIDFloat8: func(text string) ([]byte, error) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(f))
+		return b, err
+	},
+	OIDUUID: func(text string) ([]byte, error) {
+		b, err := hex.DecodeString(strings.NewReplacer("-", "", "{", "", "}", "").Replace(strings.TrimSpace(text)))
+		if err == nil && len(b) != 16 {
+			err = fmt.Errorf("invalid uuid %s", text)
+		}
+		return b, err
+	},
+	OIDText:    func(text string) ([]byte, error) { return []byte(text), nil },
+	OIDVarchar: func(text string) ([]byte, error) { return []byte(text), nil },
+	OIDJSON:    func(text string) ([]byte, error) { return []byte(text), nil },
+	OIDJSONB:   func(text string) ([]byte, error) { return append([]byte{1}, text...), nil },
+	OIDDate: func(text string) ([]byte, error) {
+		days, err := dateDays(text)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(days))
+		return b, err
+	},
+	OIDTimestamp: func(text string) ([]byte, error) {
+		// without a time zone it's the time on the clock that counts, whatever the offset says
+		micros, err := timestampMicros(text, func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		})
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(micros))
+		return b, err
+	},
+	OIDTimestampTZ: func(text string) ([]byte, error) {
+		micros, err := timestampMicros(text, time.Time.UTC)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(micros))
+		return b, err
+	},
+	OIDNumeric: encodeNumeric,
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// postgresEpoch is the date binary dates and timestamps count from
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// timestampLayouts are the ways a timestamp column value can be written, with or without a zone
+var timestampLayouts = []string{
+	time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07", "2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999", "2006-01-02",
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parseTimestamp parses a timestamp in any of the timestampLayouts, ones without a zone are taken to be UTC
+func parseTimestamp(text string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(text)); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %s", text)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// dateDays is the binary form of a date, the days since postgresEpoch
+func dateDays(text string) (int32, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "infinity":
+		return math.MaxInt32, nil
+	case "-infinity":
+		return math.MinInt32, nil
+	}
+	t, err := parseTimestamp(text)
+	if err != nil {
+		return 0, err
+	}
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return int32((date.Unix() - postgresEpoch.Unix()) / (24 * 60 * 60)), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// timestampMicros is the binary form of a timestamp, the microseconds since postgresEpoch of the time zone converts
+// it to
+func timestampMicros(text string, zone func(time.Time) time.Time) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "infinity":
+		return math.MaxInt64, nil
+	case "-infinity":
+		return math.MinInt64, nil
+	}
+	t, err := parseTimestamp(text)
+	if err != nil {
+		return 0, err
+	}
+	t = zone(t)
+	return (t.Unix()-postgresEpoch.Unix())*1000000 + int64(t.Nanosecond()/1000), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// encodeNumeric encodes a numeric the way postgres sends it, the number of base 10000 digits, the weight of the first
+// one, the sign and the number of decimal places followed by the digits
+func encodeNumeric(text string) ([]byte, error) {
+
+	text = strings.TrimSpace(text)
+	sign := uint16(0)
+	switch strings.ToLower(text) {
+	case "nan":
+		return numericBytes(0, 0xC000, 0, nil), nil
+	case "infinity", "+infinity":
+		return numericBytes(0, 0xD000, 0, nil), nil
+	case "-infinity":
+		return numericBytes(0, 0xF000, 0, nil), nil
+	}
+
+	// exponents are written out in full first
+	if strings.ContainsAny(text, "eE") {
+		f, _, err := big.ParseFloat(text, 10, 256, big.ToNearestEven)
+		if err != nil {
+			return nil, err
+		}
+		text = f.Text('f', -1)
+	}
+	if strings.HasPrefix(text, "-") {
+		sign, text = 0x4000, text[1:]
+	} else {
+		text = strings.TrimPrefix(text, "+")
+	}
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+	if whole+fraction == "" || strings.Trim(whole+fraction, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid numeric %s", text)
+	}
+
+	// the digits are grouped in fours either side of the decimal point
+	scale := len(fraction)
+	whole = strings.Repeat("0", (4-len(whole)%4)%4) + whole
+	fraction += strings.Repeat("0", (4-len(fraction)%4)%4)
+	digits := []uint16{}
+	for all := whole + fraction; len(all) > 0; all = all[4:] {
+		digit, _ := strconv.Atoi(all[:4])
+		digits = append(digits, uint16(digit))
+	}
+	weight := len(whole)/4 - 1
+	for len(digits) > 0 && digits[0] == 0 {
+		digits, weight = digits[1:], weight-1
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		weight, sign = 0, 0
+	}
+
+	return numericBytes(weight, sign, scale, digits), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func numericBytes(weight int, sign uint16, scale int, digits []uint16) []byte {
+	b := make([]byte, 8+2*len(digits))
+	binary.BigEndian.PutUint16(b[0:], uint16(len(digits)))
+	binary.BigEndian.PutUint16(b[2:], uint16(int16(weight)))
+	binary.BigEndian.PutUint16(b[4:], sign)
+	binary.BigEndian.PutUint16(b[6:], uint16(scale))
+	for i, digit := range digits {
+		binary.BigEndian.PutUint16(b[8+2*i:], digit)
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// resultFormat is the format a column of the type is sent in when the client asks for format, binary only for the
+// types in binaryEncoders. Arrays and anything else are always sent as text, with the RowDescription saying so.
+func resultFormat(oid int32, format int16) int16 {
+	if _, found := binaryEncoders[oid]; found && format == FormatBinary {
+		return FormatBinary
+	}
+	return FormatText
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// encodeResult converts a text column value into the format the client asked for. A value that can't be converted
+// is an error, the RowDescription has already told the client to expect binary.
+func encodeResult(oid int32, format int16, value []byte) ([]byte, error) {
+
+	if value == nil || resultFormat(oid, format) != FormatBinary {
+		return value, nil
+	}
+
+	return binaryEncoders[oid](string(value))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parseInteger parses an integer column value, fixtures loaded from JSON have whole numbers like 42.000000 so those
+// are allowed too
+func parseInteger(text string, bits int) (int64, error) {
+	text = strings.TrimSpace(text)
+	n, err := strconv.ParseInt(text, 10, bits)
+	if err == nil {
+		return n, nil
+	}
+	f, ferr := strconv.ParseFloat(text, 64)
+	if ferr != nil || f != math.Trunc(f) {
+		return 0, err
+	}
+	return strconv.ParseInt(strconv.FormatFloat(f, 'f', -1, 64), 10, bits)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// stringParams converts text values into params, none of which are NULL
+func stringParams(values []string) []*string {
+	params := make([]*string, len(values))
+	for i := range values {
+		params[i] = &values[i]
+	}
+	return params
+}
@@ -0,0 +1,131 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestParamMatchers(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// helper to compile and run a single matcher
+	match := func(matcher ParamMatcher, param *string) bool {
+		compiled, err := compileParamMatchers([]ParamMatcher{matcher})
+		Expect(err).To(BeNil())
+		return matchParams(compiled, []*string{param})
+	}
+	value := func(v string) *string { return &v }
+
+	// assert the results
+	Expect(match(ParamAny(), nil)).To(BeTrue())
+	Expect(match(ParamAny(), value("x"))).To(BeTrue())
+	Expect(match(ParamMatcher{}, nil)).To(BeTrue())
+
+	Expect(match(ParamEquals("x"), value("x"))).To(BeTrue())
+	Expect(match(ParamEquals("x"), value("y"))).To(BeFalse())
+	Expect(match(ParamEquals(""), nil)).To(BeFalse())
+
+	Expect(match(ParamRegex(`^\d+$`), value("123"))).To(BeTrue())
+	Expect(match(ParamRegex(`^\d+$`), value("12a"))).To(BeFalse())
+
+	Expect(match(ParamRange(1, 10), value("10"))).To(BeTrue())
+	Expect(match(ParamRange(1, 10), value("10.5"))).To(BeFalse())
+	Expect(match(ParamRange(1, 10), value("ten"))).To(BeFalse())
+	Expect(match(ParamRange(1, 10), nil)).To(BeFalse())
+
+	Expect(match(ParamNull(), nil)).To(BeTrue())
+	Expect(match(ParamNull(), value(""))).To(BeFalse())
+	Expect(match(ParamNotNull(), value(""))).To(BeTrue())
+	Expect(match(ParamNotNull(), nil)).To(BeFalse())
+
+	Expect(match(ParamIn("a", "b"), value("b"))).To(BeTrue())
+	Expect(match(ParamIn("a", "b"), value("c"))).To(BeFalse())
+
+	doc := `{"user": {"id": 7, "tags": ["a", "b"], "active": true}}`
+	Expect(match(ParamJSONPath("$.user.id", 7), value(doc))).To(BeTrue())
+	Expect(match(ParamJSONPath("$.user.tags[1]", "b"), value(doc))).To(BeTrue())
+	Expect(match(ParamJSONPath("user.active", true), value(doc))).To(BeTrue())
+	Expect(match(ParamJSONPath("$.user.id", 8), value(doc))).To(BeFalse())
+	Expect(match(ParamJSONPath("$.user.missing", nil), value(doc))).To(BeFalse())
+	Expect(match(ParamJSONPath("$.user.id", 7), value("not json"))).To(BeFalse())
+
+	// several conditions all have to pass
+	both := ParamRegex(`^1`)
+	both.Max = ParamRange(0, 15).Max
+	Expect(match(both, value("12"))).To(BeTrue())
+	Expect(match(both, value("19"))).To(BeFalse())
+
+	// missing arguments count as NULL
+	compiled, _ := compileParamMatchers([]ParamMatcher{ParamAny(), ParamNull()})
+	Expect(matchParams(compiled, []*string{value("x")})).To(BeTrue())
+
+	// bad regexes are refused
+	_, err := compileParamMatchers([]ParamMatcher{ParamRegex("(")})
+	Expect(err).ToNot(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestDecodeParam(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// assert the results
+	Expect(decodeParam(OIDInt4, FormatText, nil)).To(BeNil())
+	Expect(*decodeParam(OIDInt4, FormatText, []byte("42"))).To(Equal("42"))
+	Expect(*decodeParam(OIDInt4, FormatBinary, []byte{255, 255, 255, 254})).To(Equal("-2"))
+	Expect(*decodeParam(OIDInt8, FormatBinary, []byte{0, 0, 0, 0, 0, 0, 1, 0})).To(Equal("256"))
+	Expect(*decodeParam(OIDBool, FormatBinary, []byte{1})).To(Equal("t"))
+	Expect(*decodeParam(OIDFloat8, FormatBinary, []byte{63, 248, 0, 0, 0, 0, 0, 0})).To(Equal("1.5"))
+	Expect(*decodeParam(OIDJSONB, FormatBinary, append([]byte{1}, `{"a":1}`...))).To(Equal(`{"a":1}`))
+	Expect(*decodeParam(OIDUUID, FormatBinary, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0})).
+		To(Equal("12345678-9abc-def0-1234-56789abcdef0"))
+
+	// and results go the other way
+	encode := func(oid int32, format int16, text string) []byte {
+		encoded, err := encodeResult(oid, format, []byte(text))
+		Expect(err).To(BeNil(), text)
+		return encoded
+	}
+	Expect(encode(OIDInt4, FormatBinary, "258")).To(Equal([]byte{0, 0, 1, 2}))
+	Expect(encode(OIDText, FormatBinary, "x")).To(Equal([]byte("x")))
+	Expect(encode(OIDInt4, FormatText, "258")).To(Equal([]byte("258")))
+	Expect(encode(OIDInt4, FormatBinary, "42.000000")).To(Equal([]byte{0, 0, 0, 42}))
+	for oid, text := range map[int32]string{
+		OIDBool: "t", OIDBytea: `\xdead`, OIDInt2: "-3", OIDInt8: "9007199254740993", OIDFloat4: "1.5", OIDFloat8: "-Infinity",
+		OIDUUID: "12345678-9abc-def0-1234-56789abcdef0", OIDJSONB: `{"a":1}`, OIDVarchar: "v",
+	} {
+		Expect(*decodeParam(oid, FormatBinary, encode(oid, FormatBinary, text))).To(Equal(text))
+	}
+
+	// dates and timestamps count from 2000, timestamps without a zone ignore the offset
+	Expect(encode(OIDDate, FormatBinary, "2000-01-02")).To(Equal([]byte{0, 0, 0, 1}))
+	Expect(encode(OIDDate, FormatBinary, "1999-12-31")).To(Equal([]byte{255, 255, 255, 255}))
+	Expect(encode(OIDTimestampTZ, FormatBinary, "2000-01-01 01:00:00.5+01")).To(Equal([]byte{0, 0, 0, 0, 0, 7, 161, 32}))
+	Expect(encode(OIDTimestamp, FormatBinary, "2000-01-01 01:00:00.5+01")).To(Equal([]byte{0, 0, 0, 0, 214, 155, 69, 32}))
+	Expect(encode(OIDTimestamp, FormatBinary, "infinity")).To(Equal([]byte{127, 255, 255, 255, 255, 255, 255, 255}))
+
+	// numerics are base 10000 digits
+	Expect(encode(OIDNumeric, FormatBinary, "-123.4500")).To(Equal([]byte{0, 2, 0, 0, 64, 0, 0, 4, 0, 123, 17, 148}))
+	Expect(encode(OIDNumeric, FormatBinary, "0.0001")).To(Equal([]byte{0, 1, 255, 255, 0, 0, 0, 4, 0, 1}))
+	Expect(encode(OIDNumeric, FormatBinary, "1e6")).To(Equal([]byte{0, 1, 0, 1, 0, 0, 0, 0, 0, 100}))
+	Expect(encode(OIDNumeric, FormatBinary, "0")).To(Equal([]byte{0, 0, 0, 0, 0, 0, 0, 0}))
+	Expect(encode(OIDNumeric, FormatBinary, "NaN")).To(Equal([]byte{0, 0, 0, 0, 192, 0, 0, 0}))
+
+	// values that don't fit the type are errors rather than text the client isn't expecting
+	for oid, text := range map[int32]string{OIDInt2: "70000", OIDNumeric: "abc", OIDDate: "yesterday", OIDBool: "maybe"} {
+		_, err := encodeResult(oid, FormatBinary, []byte(text))
+		Expect(err).ToNot(BeNil(), text)
+	}
+
+	// and types without a binary encoding stay as text
+	Expect(resultFormat(OIDInt4, FormatBinary)).To(Equal(FormatBinary))
+	Expect(resultFormat(1007, FormatBinary)).To(Equal(FormatText))
+	Expect(encode(1007, FormatBinary, "{1,2}")).To(Equal([]byte("{1,2}")))
+}
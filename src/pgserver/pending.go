@@ -0,0 +1,132 @@
+package pgmock
+
+import (
+	"fmt"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// PendingQuery is an unmatched query held waiting for someone to answer it, ProcessID identifies the session holding
+// on for it
+type PendingQuery struct {
+	ID        string    `json:"id"`
+	SQL       string    `json:"sql"`
+	Params    []*string `json:"params,omitempty"`
+	ProcessID int32     `json:"processId"`
+	User      string    `json:"user,omitempty"`
+	Database  string    `json:"database,omitempty"`
+	Received  time.Time `json:"received"`
+}
+
+// PendingAnswer answers a pending query with rows, columns given as name:type pairs, or with Error if it's set. Save
+// keeps the answer as a fixture for the query, matched using Match ( exact if not set ), so it's answered the same way
+// from then on.
+type PendingAnswer struct {
+	Columns []string        `json:"cols"`
+	Rows    [][]interface{} `json:"rows"`
+	Error   *PgError        `json:"error,omitempty"`
+	Save    bool            `json:"save,omitempty"`
+	Match   MatchMode       `json:"match,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _PendingQuery is a held query along with the channel its answer is sent down
+type _PendingQuery struct {
+	PendingQuery
+	Answer chan *_QueryResponse
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// hold parks the query in the pending list until it's answered, giving up after timeout unless it's 0 or as soon as
+// the query is cancelled or the session goes
+func (res *_Responder) hold(sql string, args []*string, session *_Session, timeout time.Duration) *_QueryResponse {
+
+	pending := &_PendingQuery{
+		PendingQuery: PendingQuery{SQL: sql, Params: args, Received: time.Now()},
+		Answer:       make(chan *_QueryResponse, 1),
+	}
+	if session != nil {
+		pending.ProcessID = session.Key.ProcessID
+		pending.User, pending.Database = session.Parameters["user"], session.Parameters["database"]
+	}
+
+	// maintain concurrency
+	res.Lock()
+	res.NextPendingID++
+	pending.ID = fmt.Sprintf("%d", res.NextPendingID)
+	res.Pending = append(res.Pending, pending)
+	res.Unlock()
+	defer res.removePending(pending.ID)
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case response := <-pending.Answer:
+		return response
+	case <-deadline:
+	case <-session.context().Done():
+	}
+
+	// it might have been answered just as it gave up
+	res.removePending(pending.ID)
+	select {
+	case response := <-pending.Answer:
+		return response
+	default:
+		return nil
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// removePending takes the query out of the pending list, returning it if it was still there
+func (res *_Responder) removePending(id string) *_PendingQuery {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	for i, pending := range res.Pending {
+		if pending.ID == id {
+			res.Pending = append(res.Pending[:i:i], res.Pending[i+1:]...)
+			return pending
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// pending lists the held queries, oldest first
+func (res *_Responder) pending() []PendingQuery {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	queries := []PendingQuery{}
+	for _, pending := range res.Pending {
+		queries = append(queries, pending.PendingQuery)
+	}
+	return queries
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// answer sends the response to the pending query, releasing the session holding on for it
+func (res *_Responder) answer(id string, response *_QueryResponse) (*PendingQuery, error) {
+	pending := res.removePending(id)
+	if pending == nil {
+		return nil, fmt.Errorf("no pending query %s", id)
+	}
+	pending.Answer <- response
+	return &pending.PendingQuery, nil
+}
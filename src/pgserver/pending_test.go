@@ -0,0 +1,149 @@
+package pgmock
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestPendingQueries(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedHold, Timeout: 5000})).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test", "database": "shop"})
+	defer c.Conn.Close()
+
+	// the query waits in the pending list until it's answered
+	type result struct {
+		IDs    []byte
+		Bodies [][]byte
+	}
+	results := make(chan result)
+	query := func(sql string) {
+		ids, bodies := c.query(sql)
+		results <- result{ids, bodies}
+	}
+	go query("SELECT name FROM users")
+	Eventually(srv.Pending).Should(HaveLen(1))
+	pending := srv.Pending()[0]
+	Expect(pending.SQL).To(Equal("SELECT name FROM users"))
+	Expect(pending.User).To(Equal("test"))
+	Expect(pending.Database).To(Equal("shop"))
+
+	// assert the results
+	Expect(srv.AnswerPending(pending.ID, PendingAnswer{Columns: []string{"name:text"}, Rows: [][]interface{}{{"bob"}}, Save: true, Match: MatchNormalized})).To(BeNil())
+	r := <-results
+	Expect(string(r.IDs)).To(Equal("TDC"))
+	Expect(string(r.Bodies[1][len(r.Bodies[1])-3:])).To(Equal("bob"))
+	Expect(srv.Pending()).To(BeEmpty())
+	Expect(srv.AnswerPending(pending.ID, PendingAnswer{})).ToNot(BeNil())
+
+	// the saved answer is a fixture now
+	ids, _ := c.query("select name from users")
+	Expect(string(ids)).To(Equal("TDC"))
+
+	// errors can be sent back too
+	go query("SELECT 1")
+	Eventually(srv.Pending).Should(HaveLen(1))
+	Expect(srv.AnswerPending(srv.Pending()[0].ID, PendingAnswer{Error: &PgError{Code: "42P01", Message: "nope"}})).To(BeNil())
+	r = <-results
+	Expect(string(r.IDs)).To(Equal("E"))
+	Expect(errorFields(r.Bodies[0])[ErrorSQLStateCode]).To(Equal("42P01"))
+
+	// and unanswered queries time out
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedHold, Timeout: 50})).To(BeNil())
+	start := time.Now()
+	ids, bodies := c.query("SELECT 2")
+	Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeDataException))
+	Expect(srv.Pending()).To(BeEmpty())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestPendingQueriesDisconnect(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedHold})).To(BeNil())
+
+	// held queries without a timeout go when the client does
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	c.writeMessage(QueryMessageID, []byte("SELECT held\x00"))
+	Eventually(srv.Pending).Should(HaveLen(1))
+	c.Conn.Close()
+
+	// assert the results
+	Eventually(srv.Pending).Should(BeEmpty())
+	Eventually(func() int {
+		srv.Lock()
+		defer srv.Unlock()
+		return len(srv.Sessions)
+	}).Should(Equal(0))
+
+	// as do blocked ones
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedBlock})).To(BeNil())
+	c = connectTestClient(addr, map[string]string{"user": "test"})
+	c.writeMessage(QueryMessageID, []byte("SELECT blocked\x00"))
+	Eventually(func() int {
+		srv.Lock()
+		defer srv.Unlock()
+		return len(srv.Sessions)
+	}).Should(Equal(1))
+	c.Conn.Close()
+	Eventually(func() int {
+		srv.Lock()
+		defer srv.Unlock()
+		return len(srv.Sessions)
+	}).Should(Equal(0))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestPendingQueriesDescribe(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedHold})).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// describing the statement holds it so the answer's columns can be described
+	c.writeParse("stmt", "SELECT name FROM users")
+	c.writeDescribe(CloseStatement, "stmt")
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	Eventually(srv.Pending).Should(HaveLen(1))
+	Expect(srv.AnswerPending(srv.Pending()[0].ID, PendingAnswer{Columns: []string{"name:text"}, Rows: [][]interface{}{{"bob"}}})).To(BeNil())
+
+	// assert the results
+	c.expectMessage(ParameterDescriptionMessageID)
+	Expect(string(c.expectMessage(RowDescriptionMessageID))).To(ContainSubstring("name"))
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// and the bind uses the same answer rather than holding again
+	c.writeBind("", "stmt", nil)
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(BindCompleteMessageID)
+	Expect(string(c.expectMessage(DataRowMessageID))).To(HaveSuffix("bob"))
+	c.expectMessage(CommandCompleteMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+	Expect(srv.Pending()).To(BeEmpty())
+}
@@ -0,0 +1,136 @@
+package pgmock
+
+import (
+	"sort"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ScenarioStarted is the state every scenario begins in, and goes back to when it's reset
+const ScenarioStarted = "Started"
+
+// ScenarioState is the state a scenario is in, ProcessID is the session it belongs to for per session scenarios and 0
+// otherwise
+type ScenarioState struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	ProcessID int32  `json:"pid,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scenarioState returns the state of the scenario as the session sees it, the caller must hold the lock
+func (res *_Responder) scenarioState(name string, session *_Session) string {
+
+	states := res.Scenarios
+	if res.PerSession[name] && session != nil {
+		states = res.SessionScenarios[session.Key]
+	}
+
+	if state, found := states[name]; found {
+		return state
+	}
+	return ScenarioStarted
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// setScenarioState moves the scenario on as the session sees it, the caller must hold the lock
+func (res *_Responder) setScenarioState(name, state string, session *_Session) {
+
+	if res.PerSession[name] && session != nil {
+		if res.SessionScenarios == nil {
+			res.SessionScenarios = map[_SessionKey]map[string]string{}
+		}
+		if res.SessionScenarios[session.Key] == nil {
+			res.SessionScenarios[session.Key] = map[string]string{}
+		}
+		res.SessionScenarios[session.Key][name] = state
+		return
+	}
+
+	if res.Scenarios == nil {
+		res.Scenarios = map[string]string{}
+	}
+	res.Scenarios[name] = state
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scenarios lists the state of every scenario the fixtures use or that has been set, one per session for per session
+// scenarios
+func (res *_Responder) scenarios() []ScenarioState {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	names := map[string]bool{}
+	for _, fixture := range res.Fixtures {
+		if fixture.Scenario != "" {
+			names[fixture.Scenario] = true
+		}
+	}
+	for name := range res.Scenarios {
+		names[name] = true
+	}
+	for _, states := range res.SessionScenarios {
+		for name := range states {
+			names[name] = true
+		}
+	}
+
+	list := []ScenarioState{}
+	for name := range names {
+		if !res.PerSession[name] {
+			list = append(list, ScenarioState{Name: name, State: res.scenarioState(name, nil)})
+			continue
+		}
+		for key, states := range res.SessionScenarios {
+			if state, found := states[name]; found {
+				list = append(list, ScenarioState{Name: name, State: state, ProcessID: key.ProcessID})
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ProcessID < list[j].ProcessID
+	})
+
+	return list
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// resetScenarios puts the named scenarios, or all of them if there are no names, back to ScenarioStarted for every
+// session
+func (res *_Responder) resetScenarios(names ...string) {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	if len(names) == 0 {
+		res.Scenarios, res.SessionScenarios = nil, nil
+		return
+	}
+
+	for _, name := range names {
+		delete(res.Scenarios, name)
+		for _, states := range res.SessionScenarios {
+			delete(states, name)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// forgetSession drops the per session scenario state of a closed session
+func (res *_Responder) forgetSession(key _SessionKey) {
+	res.Lock()
+	delete(res.SessionScenarios, key)
+	res.Unlock()
+}
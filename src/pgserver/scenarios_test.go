@@ -0,0 +1,68 @@
+package pgmock
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestScenarios(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// no orders until one is inserted
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	fixtures := []Fixture{
+		{Query: "SELECT count(*) FROM orders", Scenario: "orders", RequiredState: ScenarioStarted, Columns: []string{"count:int4"}, Rows: [][]interface{}{{"0"}}},
+		{Query: "INSERT INTO orders VALUES (1)", Scenario: "orders", NewState: "ordered"},
+		{Query: "SELECT count(*) FROM orders", Scenario: "orders", RequiredState: "ordered", Columns: []string{"count:int4"}, Rows: [][]interface{}{{"1"}}},
+	}
+	for _, fixture := range fixtures {
+		_, err := srv.AddFixture(fixture)
+		Expect(err).To(BeNil())
+	}
+	Expect(srv.Responder.Fixtures).To(HaveLen(3))
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	other := connectTestClient(addr, map[string]string{"user": "test"})
+	defer other.Conn.Close()
+
+	count := func(c *_TestClient) string {
+		ids, bodies := c.query("SELECT count(*) FROM orders")
+		Expect(string(ids)).To(Equal("TDC"))
+		return string(bodies[1][len(bodies[1])-1:])
+	}
+
+	// assert the results
+	Expect(count(c)).To(Equal("0"))
+	Expect(srv.Scenarios()).To(Equal([]ScenarioState{{Name: "orders", State: ScenarioStarted}}))
+	c.query("INSERT INTO orders VALUES (1)")
+	Expect(count(c)).To(Equal("1"))
+	Expect(count(other)).To(Equal("1"))
+	Expect(srv.Scenarios()).To(Equal([]ScenarioState{{Name: "orders", State: "ordered"}}))
+
+	// resetting starts it over, and it can be moved on by hand
+	srv.ResetScenarios()
+	Expect(count(c)).To(Equal("0"))
+	srv.SetScenarioState("orders", "ordered")
+	Expect(count(c)).To(Equal("1"))
+	srv.ResetScenarios("orders")
+
+	// per session scenarios are only moved on for the session that did it
+	srv.SetScenarioPerSession("orders", true)
+	c.query("INSERT INTO orders VALUES (1)")
+	Expect(count(c)).To(Equal("1"))
+	Expect(count(other)).To(Equal("0"))
+	states := srv.Scenarios()
+	Expect(states).To(HaveLen(1))
+	Expect(states[0].State).To(Equal("ordered"))
+	Expect(states[0].ProcessID).ToNot(BeZero())
+
+	srv.ResetScenarios("orders")
+	Expect(count(c)).To(Equal("0"))
+}
@@ -0,0 +1,325 @@
+package pgmock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SCRAM-SHA-256 as described in RFC 5802 / RFC 7677, with the PostgreSQL specifics from
+// https://www.postgresql.org/docs/current/sasl-authentication.html
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ChannelBinding controls how SCRAM-SHA-256-PLUS is offered on TLS connections
+type ChannelBinding int
+
+const (
+	// ChannelBindingOffer advertises SCRAM-SHA-256-PLUS on TLS connections and verifies the binding data
+	ChannelBindingOffer ChannelBinding = iota
+	// ChannelBindingDisable never advertises SCRAM-SHA-256-PLUS, as a server without channel binding support would
+	ChannelBindingDisable
+	// ChannelBindingFail advertises SCRAM-SHA-256-PLUS but always rejects the binding data, to test client failures
+	ChannelBindingFail
+)
+
+const scramIterations = 4096
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _SCRAMAuthenticator performs SCRAM-SHA-256(-PLUS) authentication against a fixed set of user passwords
+type _SCRAMAuthenticator struct {
+	Credentials    map[string]string
+	ChannelBinding ChannelBinding
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// mechanisms returns the SASL mechanisms to offer, -PLUS is only possible once the session is using TLS
+func (auth *_SCRAMAuthenticator) mechanisms(exchange AuthExchange) []string {
+	if exchange.ChannelBinding() != nil && auth.ChannelBinding != ChannelBindingDisable {
+		return []string{SASLMechanismSCRAMSHA256Plus, SASLMechanismSCRAMSHA256}
+	}
+	return []string{SASLMechanismSCRAMSHA256}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (auth *_SCRAMAuthenticator) Authenticate(exchange AuthExchange) error {
+
+	// shortcut
+	user := exchange.User()
+
+	// tell the client which mechanisms we support
+	mechanisms := auth.mechanisms(exchange)
+	err := exchange.Request(AuthTypeSASL, saslMechanisms(mechanisms))
+	if err != nil {
+		return err
+	}
+	log.Infof("wrote AuthenticationSASL message, mechanisms: %v", mechanisms)
+
+	// read the client-first-message
+	initial := &_SASLInitialResponse{}
+	if err := readAuthResponse(exchange, initial); err != nil {
+		return err
+	}
+	log.Infof("read SASLInitialResponse, mechanism: %s, data: %s", initial.Mechanism, initial.Data)
+
+	offered := false
+	for _, mechanism := range mechanisms {
+		offered = offered || mechanism == initial.Mechanism
+	}
+	if !offered {
+		return fatalError(SQLStateCodeProtocolViolation, "client selected an invalid SASL authentication mechanism")
+	}
+	plus := initial.Mechanism == SASLMechanismSCRAMSHA256Plus
+
+	// split the gs2 header from the client-first-message-bare
+	parts := strings.SplitN(string(initial.Data), ",", 3)
+	if len(parts) != 3 {
+		return fatalError(SQLStateCodeProtocolViolation, "malformed SCRAM message")
+	}
+	cbindFlag, authzid, clientFirstBare := parts[0], parts[1], parts[2]
+	gs2Header := cbindFlag + "," + authzid + ","
+
+	// validate the channel binding flag against the selected mechanism
+	switch {
+	case cbindFlag == "n" && plus, cbindFlag == "y" && plus:
+		return fatalError(SQLStateCodeProtocolViolation, "The client selected SCRAM-SHA-256-PLUS, but the SCRAM message does not include channel binding data.")
+	case cbindFlag == "y" && len(mechanisms) > 1:
+		return fatalError(SQLStateCodeProtocolViolation, "The client supports SCRAM channel binding but thinks the server does not. However, this server does support channel binding.")
+	case strings.HasPrefix(cbindFlag, "p="):
+		if !plus {
+			return fatalError(SQLStateCodeProtocolViolation, "The client selected SCRAM-SHA-256 without channel binding, but the SCRAM message includes channel binding data.")
+		}
+		if cbindFlag[2:] != ChannelBindingTypeEndPoint {
+			return fatalError(SQLStateCodeProtocolViolation, fmt.Sprintf("unsupported SCRAM channel-binding type \"%s\"", cbindFlag[2:]))
+		}
+	case cbindFlag != "n" && cbindFlag != "y":
+		return fatalError(SQLStateCodeProtocolViolation, "malformed SCRAM message")
+	}
+	if authzid != "" {
+		return fatalError(SQLStateCodeProtocolViolation, "client uses authorization identity, but it is not supported")
+	}
+
+	// grab the client nonce, postgres ignores the username here in favour of the startup message
+	clientAttrs := scramAttributes(clientFirstBare)
+	clientNonce, found := clientAttrs['r']
+	if !found || clientNonce == "" {
+		return fatalError(SQLStateCodeProtocolViolation, "malformed SCRAM message")
+	}
+
+	// unknown users still go through the motions so clients can't tell the difference, same as postgres
+	password, known := auth.Credentials[user]
+	salt := randomBytes(16)
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(randomBytes(18))
+
+	// send the server-first-message
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), scramIterations)
+	if err := exchange.Request(AuthTypeSASLContinue, []byte(serverFirst)); err != nil {
+		return err
+	}
+	log.Infof("wrote AuthenticationSASLContinue message: %s", serverFirst)
+
+	// read the client-final-message
+	response := &_SASLResponse{}
+	if err := readAuthResponse(exchange, response); err != nil {
+		return err
+	}
+	clientFinal := string(response.Data)
+	log.Infof("read SASLResponse: %s", clientFinal)
+
+	// the proof always comes last, everything before it is included in the auth message
+	proofIdx := strings.LastIndex(clientFinal, ",p=")
+	if proofIdx < 0 {
+		return fatalError(SQLStateCodeProtocolViolation, "malformed SCRAM message")
+	}
+	clientFinalWithoutProof := clientFinal[:proofIdx]
+	finalAttrs := scramAttributes(clientFinalWithoutProof)
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIdx+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return fatalError(SQLStateCodeProtocolViolation, "malformed SCRAM message")
+	}
+
+	// check the channel binding input, for -PLUS that's the header plus the hash of our certificate
+	expected := []byte(gs2Header)
+	if plus {
+		binding := exchange.ChannelBinding()
+		if auth.ChannelBinding == ChannelBindingFail {
+			binding = randomBytes(len(binding))
+		}
+		expected = append(expected, binding...)
+	}
+	cbind, err := base64.StdEncoding.DecodeString(finalAttrs['c'])
+	if err != nil || !bytes.Equal(cbind, expected) {
+		return fatalError(SQLStateCodeProtocolViolation, "SCRAM channel binding check failed")
+	}
+	if finalAttrs['r'] != nonce {
+		return fatalError(SQLStateCodeProtocolViolation, "SCRAM nonce mismatch")
+	}
+
+	// verify the proof by recovering the client key and comparing it against the stored key
+	saltedPassword := scramSaltedPassword(password, salt, scramIterations)
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], []byte(authMessage))
+	recovered := make([]byte, len(proof))
+	for i := range proof {
+		recovered[i] = proof[i] ^ clientSignature[i]
+	}
+	recoveredKey := sha256.Sum256(recovered)
+	if !known || !hmac.Equal(recoveredKey[:], storedKey[:]) {
+		return passwordFailed(user)
+	}
+
+	// all good, send the server signature back so the client can verify us too
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, []byte(authMessage)))
+	if err := exchange.Request(AuthTypeSASLFinal, []byte(serverFinal)); err != nil {
+		return err
+	}
+	log.Infof("wrote AuthenticationSASLFinal message: %s", serverFinal)
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// saslMechanisms encodes the mechanism list for an AuthenticationSASL request
+func saslMechanisms(mechanisms []string) []byte {
+	data := []byte{}
+	for _, mechanism := range mechanisms {
+		data = append(append(data, mechanism...), 0)
+	}
+	return append(data, 0)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scramAttributes splits a SCRAM message into its single letter attributes
+func scramAttributes(msg string) map[byte]string {
+	attrs := map[byte]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// randomBytes returns n bytes from crypto/rand, used for nonces, salts and keys
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func scramHMAC(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scramSaltedPassword is Hi() from RFC 5802, which is PBKDF2 with HMAC-SHA-256 and a single block of output
+func scramSaltedPassword(password string, salt []byte, iterations int) []byte {
+
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+
+	u := scramHMAC([]byte(password), append(append([]byte{}, salt...), block...))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC([]byte(password), u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _SCRAMClient is the client side of a SCRAM-SHA-256 exchange without channel binding, used to log in to upstream
+// servers
+type _SCRAMClient struct {
+	Password        string
+	Nonce           string
+	ClientFirstBare string
+	ServerSignature []byte
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// newSCRAMClient starts an exchange, the user name is left out as postgres takes it from the startup message
+func newSCRAMClient(password string) *_SCRAMClient {
+	nonce := base64.StdEncoding.EncodeToString(randomBytes(18))
+	return &_SCRAMClient{Password: password, Nonce: nonce, ClientFirstBare: "n=,r=" + nonce}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// first is the client-first-message
+func (client *_SCRAMClient) first() []byte {
+	return []byte("n,," + client.ClientFirstBare)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// final works out the client-final-message from the server-first-message, keeping hold of the signature the server
+// should send back
+func (client *_SCRAMClient) final(serverFirst []byte) ([]byte, error) {
+
+	attrs := scramAttributes(string(serverFirst))
+	nonce := attrs['r']
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || !strings.HasPrefix(nonce, client.Nonce) || len(nonce) == len(client.Nonce) {
+		return nil, fmt.Errorf("malformed SCRAM server-first-message")
+	}
+	iterations := 0
+	if _, err := fmt.Sscanf(attrs['i'], "%d", &iterations); err != nil || iterations < 1 {
+		return nil, fmt.Errorf("malformed SCRAM server-first-message")
+	}
+
+	// biws is n,, base64 encoded
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := client.ClientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof
+
+	saltedPassword := scramSaltedPassword(client.Password, salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	client.ServerSignature = scramHMAC(scramHMAC(saltedPassword, []byte("Server Key")), []byte(authMessage))
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// verify checks the server-final-message proves the server knows the password too
+func (client *_SCRAMClient) verify(serverFinal []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(scramAttributes(string(serverFinal))['v'])
+	if err != nil || client.ServerSignature == nil || !hmac.Equal(signature, client.ServerSignature) {
+		return fmt.Errorf("SCRAM server signature check failed")
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package pgmock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// scramLogin runs the client side of a SCRAM exchange, returning the body of the message that ended it
+func (c *_TestClient) scramLogin(password, mechanism string, binding []byte) (byte, []byte) {
+
+	// work out the gs2 header for the selected mechanism
+	gs2Header := "n,,"
+	if mechanism == SASLMechanismSCRAMSHA256Plus {
+		gs2Header = "p=" + ChannelBindingTypeEndPoint + ",,"
+	}
+
+	// send the client-first-message
+	clientNonce := base64.StdEncoding.EncodeToString(randomBytes(18))
+	clientFirstBare := "n=,r=" + clientNonce
+	body := &bytes.Buffer{}
+	newMessenger(body).
+		writeString(mechanism).
+		writeInt32(int32(len(gs2Header + clientFirstBare))).
+		writeByteArray([]byte(gs2Header + clientFirstBare)...)
+	c.writeMessage(SASLInitialResponseMessageID, body.Bytes())
+
+	// read the server-first-message
+	msgID, serverFirst := c.readMessage()
+	if msgID != AuthenticationSASLContinueMessageID || binary.BigEndian.Uint32(serverFirst) != 11 {
+		return msgID, serverFirst
+	}
+	attrs := scramAttributes(string(serverFirst[4:]))
+	salt, _ := base64.StdEncoding.DecodeString(attrs['s'])
+	iterations, _ := strconv.Atoi(attrs['i'])
+
+	// send the client-final-message
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(gs2Header), binding...))
+	clientFinalWithoutProof := "c=" + cbind + ",r=" + attrs['r']
+	authMessage := clientFirstBare + "," + string(serverFirst[4:]) + "," + clientFinalWithoutProof
+	saltedPassword := scramSaltedPassword(password, salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], []byte(authMessage))
+	for i := range clientKey {
+		clientKey[i] ^= clientSignature[i]
+	}
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+	c.writeMessage(SASLResponseMessageID, []byte(clientFinal))
+
+	// read the server-final-message and check the server signature
+	msgID, serverFinal := c.readMessage()
+	if msgID != AuthenticationSASLFinalMessageID || binary.BigEndian.Uint32(serverFinal) != 12 {
+		return msgID, serverFinal
+	}
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+	Expect(string(serverFinal[4:])).To(Equal("v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, []byte(authMessage)))))
+
+	return c.readMessage()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readSASLMechanisms reads the AuthenticationSASL message, returning the offered mechanisms
+func (c *_TestClient) readSASLMechanisms() []string {
+	body := c.expectMessage(AuthenticationSASLMessageID)
+	Expect(binary.BigEndian.Uint32(body)).To(Equal(uint32(10)))
+	return strings.Split(strings.TrimRight(string(body[4:]), "\x00"), "\x00")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestSCRAMSaltedPassword(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// PBKDF2-HMAC-SHA256 test vector from RFC 7914
+	res := scramSaltedPassword("passwd", []byte("salt"), 1)
+	Expect(res).To(Equal([]byte{
+		0x55, 0xac, 0x04, 0x6e, 0x56, 0xe3, 0x08, 0x9f, 0xec, 0x16, 0x91, 0xc2, 0x25, 0x44, 0xb6, 0x05,
+		0xf9, 0x41, 0x85, 0x21, 0x6d, 0xde, 0x04, 0x65, 0xe6, 0x8b, 0x9d, 0x57, 0xc2, 0x0d, 0xac, 0xbc,
+	}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestSCRAMAuthentication(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server requiring scram without tls
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetSCRAMAuthentication(map[string]string{"test": "secret"}, ChannelBindingOffer)
+	})
+	defer stop()
+
+	// without tls there's no -PLUS on offer
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	Expect(c.readSASLMechanisms()).To(Equal([]string{SASLMechanismSCRAMSHA256}))
+
+	// the right password gets an AuthenticationOk
+	msgID, body := c.scramLogin("secret", SASLMechanismSCRAMSHA256, nil)
+	Expect(msgID).To(Equal(AuthenticationOkMessageID))
+	Expect(body).To(Equal([]byte{0, 0, 0, 0}))
+
+	// the wrong password gets a FATAL
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.readSASLMechanisms()
+	msgID, body = c.scramLogin("wrong", SASLMechanismSCRAMSHA256, nil)
+	Expect(msgID).To(Equal(ErrorResponseMessageID))
+	Expect(errorFields(body)[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidPassword))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestSCRAMChannelBinding(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with tls and scram
+	cert := createTestCertificate()
+	srv, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+		srv.SetSCRAMAuthentication(map[string]string{"test": "secret"}, ChannelBindingOffer)
+	})
+	defer stop()
+
+	// helper to connect over tls and return the certificate hash
+	connect := func() (*_TestClient, []byte) {
+		c := dialTestClient(addr)
+		Expect(c.writeSSLRequest()).To(Equal(byte('S')))
+		conn := c.upgradeTLS(&tls.Config{InsecureSkipVerify: true})
+		binding, err := tlsServerEndPoint(conn.ConnectionState().PeerCertificates[0].Raw)
+		Expect(err).To(BeNil())
+		c.writeStartup(map[string]string{"user": "test"})
+		return c, binding
+	}
+
+	// -PLUS is offered first and binds to the certificate
+	c, binding := connect()
+	defer c.Conn.Close()
+	Expect(c.readSASLMechanisms()).To(Equal([]string{SASLMechanismSCRAMSHA256Plus, SASLMechanismSCRAMSHA256}))
+	msgID, _ := c.scramLogin("secret", SASLMechanismSCRAMSHA256Plus, binding)
+	Expect(msgID).To(Equal(AuthenticationOkMessageID))
+
+	// binding data for some other certificate is rejected
+	c, _ = connect()
+	defer c.Conn.Close()
+	c.readSASLMechanisms()
+	msgID, body := c.scramLogin("secret", SASLMechanismSCRAMSHA256Plus, []byte("--not-the-cert-hash--"))
+	Expect(msgID).To(Equal(ErrorResponseMessageID))
+	Expect(errorFields(body)[ErrorMessage]).To(Equal("SCRAM channel binding check failed"))
+
+	// a client claiming the server can't bind is a downgrade
+	c, _ = connect()
+	defer c.Conn.Close()
+	c.readSASLMechanisms()
+	initial := &bytes.Buffer{}
+	newMessenger(initial).writeString(SASLMechanismSCRAMSHA256).writeInt32(11).writeByteArray([]byte("y,,n=,r=abc")...)
+	c.writeMessage(SASLInitialResponseMessageID, initial.Bytes())
+	Expect(errorFields(c.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeProtocolViolation))
+
+	// forcing a failure rejects even the correct binding data
+	srv.SetSCRAMAuthentication(map[string]string{"test": "secret"}, ChannelBindingFail)
+	c, binding = connect()
+	defer c.Conn.Close()
+	c.readSASLMechanisms()
+	msgID, body = c.scramLogin("secret", SASLMechanismSCRAMSHA256Plus, binding)
+	Expect(msgID).To(Equal(ErrorResponseMessageID))
+	Expect(errorFields(body)[ErrorMessage]).To(Equal("SCRAM channel binding check failed"))
+
+	// disabling binding only offers the plain mechanism
+	srv.SetSCRAMAuthentication(map[string]string{"test": "secret"}, ChannelBindingDisable)
+	c, _ = connect()
+	defer c.Conn.Close()
+	Expect(c.readSASLMechanisms()).To(Equal([]string{SASLMechanismSCRAMSHA256}))
+	msgID, _ = c.scramLogin("secret", SASLMechanismSCRAMSHA256, nil)
+	Expect(msgID).To(Equal(AuthenticationOkMessageID))
+}
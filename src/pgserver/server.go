@@ -1,35 +1,63 @@
 package pgmock
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
-	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// rowDescs are the column types fixtures can use, array types are named with a leading underscore as they are in
+// pg_type
 var rowDescs = func() map[string]*_RowDescriptionField {
-	return map[string]*_RowDescriptionField{
-		"text": &_RowDescriptionField{
-			TableOID:     0,
-			ColumnAttr:   0,
-			DataTypeOID:  25,
-			DataTypeSize: -1,
-			TypeModifier: 0,
-			FormatCode:   0,
-		},
-		"int4": &_RowDescriptionField{
-			TableOID:     0,
-			ColumnAttr:   0,
-			DataTypeOID:  23,
-			DataTypeSize: -1,
-			TypeModifier: 0,
-			FormatCode:   0,
-		},
+
+	types := []struct {
+		Name string
+		OID  int32
+		Size int16
+	}{
+		{"bool", 16, 1},
+		{"bytea", 17, -1},
+		{"int8", 20, 8},
+		{"int2", 21, 2},
+		{"int4", 23, 4},
+		{"text", 25, -1},
+		{"json", 114, -1},
+		{"float4", 700, 4},
+		{"float8", 701, 8},
+		{"varchar", 1043, -1},
+		{"date", 1082, 4},
+		{"timestamp", 1114, 8},
+		{"timestamptz", 1184, 8},
+		{"numeric", 1700, -1},
+		{"uuid", 2950, 16},
+		{"jsonb", 3802, -1},
+		{"_bool", 1000, -1},
+		{"_bytea", 1001, -1},
+		{"_int2", 1005, -1},
+		{"_int4", 1007, -1},
+		{"_text", 1009, -1},
+		{"_int8", 1016, -1},
+		{"_float4", 1021, -1},
+		{"_float8", 1022, -1},
+		{"_timestamptz", 1185, -1},
+		{"_numeric", 1231, -1},
+		{"_uuid", 2951, -1},
+		{"_jsonb", 3807, -1},
+	}
+
+	descs := map[string]*_RowDescriptionField{}
+	for _, t := range types {
+		descs[t.Name] = &_RowDescriptionField{DataTypeOID: t.OID, DataTypeSize: t.Size}
 	}
+	return descs
 }()
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -37,7 +65,32 @@ var rowDescs = func() map[string]*_RowDescriptionField {
 // Server wrapping interface around _Server
 type Server interface {
 	ListenAndServe(bindAddr string) error
+	Serve(ln net.Listener) error
 	InjectQueryResponse(queryHash string, columns []string, rows [][]interface{}) error
+	InjectRows(sql string, rows interface{}) error
+	AddFixture(fixture Fixture) (string, error)
+	SetTLSConfig(config *tls.Config)
+	SetSCRAMAuthentication(credentials map[string]string, binding ChannelBinding)
+	SetAuthenticator(auth Authenticator)
+	SetDatabases(databases []string)
+	SetRoles(roles map[string]int)
+	SetMaxConnections(max int)
+	SetStartingUp(startingUp bool)
+	Scenarios() []ScenarioState
+	SetScenarioState(name, state string)
+	SetScenarioPerSession(name string, perSession bool)
+	ResetScenarios(names ...string)
+	SetUnmatchedPolicy(database string, policy UnmatchedPolicy) error
+	Verify() *Verification
+	Journal(filter JournalFilter) ([]JournalEntry, error)
+	ClearJournal()
+	SetJournalSize(size int)
+	WaitForQuery(filter JournalFilter, times int, timeout time.Duration) ([]JournalEntry, error)
+	Subscribe(types ...EventType) (<-chan Event, func())
+	OnEvent(callback func(Event), types ...EventType) func()
+	Pending() []PendingQuery
+	AnswerPending(id string, answer PendingAnswer) error
+	HandleFunc(matcher Matcher, handler HandlerFunc) (string, error)
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -53,18 +106,16 @@ type _SessionKey struct {
 // _Server handles the incoming connections and session loops
 type _Server struct {
 	sync.Mutex
-	Responder *_Responder
-	Sessions  map[_SessionKey]*_Session
-}
-
-type _QueryResponse struct {
-	Columns *_RowDescription
-	Rows    []*_DataRow
-}
-
-type _Responder struct {
-	sync.Mutex
-	Responses map[string]*_QueryResponse
+	Responder      *_Responder
+	History        *_Journal
+	Events         *_Events
+	Sessions       map[_SessionKey]*_Session
+	TLSConfig      *tls.Config
+	Authenticator  Authenticator
+	Databases      map[string]bool
+	Roles          map[string]int
+	MaxConnections int
+	StartingUp     bool
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -72,67 +123,528 @@ type _Responder struct {
 // NewServer creates and returns a new Server
 func NewServer() Server {
 	return &_Server{
-		Responder: &_Responder{Responses: map[string]*_QueryResponse{}},
+		Responder: &_Responder{},
+		History:   &_Journal{Size: DefaultJournalSize},
+		Events:    &_Events{},
 		Sessions:  map[_SessionKey]*_Session{},
 	}
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// InjectQueryResponse adds an exact match fixture for the query with the given sha1 hash
 func (srv *_Server) InjectQueryResponse(hash string, cols []string, rows [][]interface{}) error {
 
-	response := &_QueryResponse{
-		Columns: &_RowDescription{
-			Fields: []*_RowDescriptionField{},
-		},
-		Rows: []*_DataRow{},
-	}
-
-	// split out the columns to build the _RowDescription things
-	for _, c := range cols {
-		bits := strings.Split(c, ":")
-		if _, found := rowDescs[bits[1]]; !found {
-			log.Errorf("unable to find field type for %s", bits[1])
-			return errors.New("unable to find field type")
-		}
-		field := rowDescs[bits[1]]
-		field.Name = bits[0]
-		response.Columns.Fields = append(response.Columns.Fields, field)
-	}
-
-	for _, r := range rows {
-		cols := make([]*_DataRowColumn, 0)
-		for _, rData := range r {
-			switch v := rData.(type) {
-			case string:
-				cols = append(cols, &_DataRowColumn{Value: []byte(v)})
-			case float64:
-				cols = append(cols, &_DataRowColumn{Value: []byte(fmt.Sprintf("%f", v))})
-			default:
-				cols = append(cols, &_DataRowColumn{Value: v.([]byte)})
+	response, err := buildQueryResponse(cols, rows)
+	if err != nil {
+		return err
+	}
+
+	// save the response off
+	srv.Responder.add(&_Fixture{Match: MatchExact, Key: hash, Responses: []*_QueryResponse{response}, Exhausted: ExhaustRepeat})
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// InjectRows adds an exact match fixture answering the query with a slice of structs, see StructRows for how they're
+// turned into rows
+func (srv *_Server) InjectRows(sql string, rows interface{}) error {
+
+	cols, values, err := StructRows(rows)
+	if err != nil {
+		return err
+	}
+
+	_, err = srv.AddFixture(Fixture{Query: sql, Match: MatchExact, Columns: cols, Rows: values, Exhausted: ExhaustRepeat})
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// AddFixture adds a fixture matching its query using the fixture's match mode, exact if not set, and returns the ID
+// the fixture was stored under
+func (srv *_Server) AddFixture(fixture Fixture) (string, error) {
+
+	switch fixture.Match {
+	case "":
+		fixture.Match = MatchExact
+	case MatchExact, MatchNormalized, MatchFingerprint, MatchRegex, MatchGlob:
+	default:
+		return "", fmt.Errorf("unknown match mode %s", fixture.Match)
+	}
+
+	responses, err := buildFixtureResponses(&fixture)
+	if err != nil {
+		return "", err
+	}
+
+	matchers, err := compileParamMatchers(fixture.Params)
+	if err != nil {
+		return "", err
+	}
+	if fixture.Session != nil {
+		if err := fixture.Session.validate(); err != nil {
+			return "", err
+		}
+	}
+	if fixture.Expect != nil {
+		if err := fixture.Expect.validate(); err != nil {
+			return "", err
+		}
+	}
+
+	// fixtures only replace each other when they match the same arguments for the same sessions
+	matchersKey, _ := json.Marshal([]interface{}{fixture.Params, fixture.Session})
+
+	compiled := &_Fixture{
+		ID:            fixture.ID,
+		Query:         fixture.Query,
+		Match:         fixture.Match,
+		Priority:      fixture.Priority,
+		Matchers:      matchers,
+		MatchersKey:   string(matchersKey),
+		Responses:     responses,
+		Exhausted:     fixture.Exhausted,
+		Scenario:      fixture.Scenario,
+		RequiredState: fixture.RequiredState,
+		NewState:      fixture.NewState,
+		Condition:     fixture.Session,
+		Expect:        fixture.Expect,
+	}
+	if fixture.Match == MatchRegex || fixture.Match == MatchGlob {
+		compiled.Key = fixture.Query
+		if compiled.Pattern, err = compilePattern(fixture.Match, fixture.Query); err != nil {
+			return "", fmt.Errorf("invalid %s pattern, err: %s", fixture.Match, err)
+		}
+	} else {
+		compiled.Key, _ = matchKey(fixture.Match, fixture.Query)
+	}
+
+	return srv.Responder.add(compiled), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// buildFixtureResponses builds the fixture's sequence of responses, a fixture without one is a sequence of one
+func buildFixtureResponses(fixture *Fixture) ([]*_QueryResponse, error) {
+
+	switch fixture.Exhausted {
+	case "":
+		fixture.Exhausted = ExhaustError
+		if len(fixture.Responses) > 0 {
+			fixture.Exhausted = ExhaustRepeat
+		}
+	case ExhaustRepeat, ExhaustCycle, ExhaustError:
+	default:
+		return nil, fmt.Errorf("unknown exhausted mode %s", fixture.Exhausted)
+	}
+
+	if len(fixture.Responses) == 0 {
+		response, err := buildQueryResponse(fixture.Columns, fixture.Rows)
+		if err != nil {
+			return nil, err
+		}
+		response.Error, response.Times = fixture.Error, fixture.Times
+		response.Webhook, response.Handler, response.Describe = fixture.Webhook, fixture.Handler, fixture.Describe
+		if fixture.Template {
+			if err := compileTemplates(response, fixture.Rows); err != nil {
+				return nil, err
 			}
 		}
-		response.Rows = append(response.Rows, &_DataRow{Columns: cols})
+		return []*_QueryResponse{response}, nil
 	}
 
-	// save the response off
+	responses := []*_QueryResponse{}
+	for _, r := range fixture.Responses {
+		cols := r.Columns
+		if cols == nil {
+			cols = fixture.Columns
+		}
+		response, err := buildQueryResponse(cols, r.Rows)
+		if err != nil {
+			return nil, err
+		}
+		response.Error, response.Times = r.Error, r.Times
+		response.Webhook, response.Handler, response.Describe = fixture.Webhook, fixture.Handler, fixture.Describe
+		if response.Times <= 0 {
+			response.Times = 1
+		}
+		if fixture.Template {
+			if err := compileTemplates(response, r.Rows); err != nil {
+				return nil, err
+			}
+		}
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetTLSConfig enables TLS, SSLRequests are accepted and upgraded using config rather than refused
+func (srv *_Server) SetTLSConfig(config *tls.Config) {
+	srv.Lock()
+	srv.TLSConfig = config
+	srv.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetSCRAMAuthentication requires SCRAM-SHA-256 authentication using the user -> password credentials, nil credentials
+// turns authentication off again
+func (srv *_Server) SetSCRAMAuthentication(credentials map[string]string, binding ChannelBinding) {
+	if credentials == nil {
+		srv.SetAuthenticator(nil)
+		return
+	}
+	srv.SetAuthenticator(NewSCRAMAuthenticator(credentials, binding))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetAuthenticator sets the authentication used for new connections, nil trusts everyone
+func (srv *_Server) SetAuthenticator(auth Authenticator) {
+	srv.Lock()
+	srv.Authenticator = auth
+	srv.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetDatabases restricts connections to the named databases, nil allows any database
+func (srv *_Server) SetDatabases(databases []string) {
+	srv.Lock()
+	defer srv.Unlock()
+
+	if databases == nil {
+		srv.Databases = nil
+		return
+	}
+	srv.Databases = map[string]bool{}
+	for _, db := range databases {
+		srv.Databases[db] = true
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetRoles restricts connections to the given roles, each mapped to its connection limit ( -1 for no limit ) just like
+// rolconnlimit, nil allows any role
+func (srv *_Server) SetRoles(roles map[string]int) {
+	srv.Lock()
+	srv.Roles = roles
+	srv.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetMaxConnections limits the number of concurrent connections like max_connections, 0 means no limit
+func (srv *_Server) SetMaxConnections(max int) {
+	srv.Lock()
+	srv.MaxConnections = max
+	srv.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetStartingUp refuses all new connections as a database that is still starting up would
+func (srv *_Server) SetStartingUp(startingUp bool) {
+	srv.Lock()
+	srv.StartingUp = startingUp
+	srv.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Scenarios lists the state of every scenario, per session scenarios are listed once for each session using them
+func (srv *_Server) Scenarios() []ScenarioState {
+	return srv.Responder.scenarios()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetScenarioState moves the scenario into state, for every session if it's per session
+func (srv *_Server) SetScenarioState(name, state string) {
+
+	// grab the sessions first, the server is never locked while holding the responder
+	keys := srv.sessionKeys()
+
+	// maintain concurrency
 	srv.Responder.Lock()
-	srv.Responder.Responses[hash] = response
-	srv.Responder.Unlock()
+	defer srv.Responder.Unlock()
+
+	res := srv.Responder
+	if !res.PerSession[name] {
+		res.setScenarioState(name, state, nil)
+		return
+	}
+	for key := range keys {
+		res.setScenarioState(name, state, &_Session{Key: key})
+	}
+}
 
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sessionKeys returns the keys of the current sessions
+func (srv *_Server) sessionKeys() map[_SessionKey]bool {
+	srv.Lock()
+	defer srv.Unlock()
+
+	keys := map[_SessionKey]bool{}
+	for key := range srv.Sessions {
+		keys[key] = true
+	}
+	return keys
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetScenarioPerSession gives every session its own copy of the scenario, starting in ScenarioStarted, rather than
+// sharing one between them
+func (srv *_Server) SetScenarioPerSession(name string, perSession bool) {
+
+	// maintain concurrency
+	srv.Responder.Lock()
+	defer srv.Responder.Unlock()
+
+	if srv.Responder.PerSession == nil {
+		srv.Responder.PerSession = map[string]bool{}
+	}
+	srv.Responder.PerSession[name] = perSession
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ResetScenarios puts the named scenarios, or all of them if none are named, back to ScenarioStarted
+func (srv *_Server) ResetScenarios(names ...string) {
+	srv.Responder.resetScenarios(names...)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetUnmatchedPolicy sets what happens to queries no fixture matches for sessions on the database, or for every
+// database without a policy of its own if database is ""
+func (srv *_Server) SetUnmatchedPolicy(database string, policy UnmatchedPolicy) error {
+
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	// maintain concurrency
+	srv.Responder.Lock()
+	defer srv.Responder.Unlock()
+
+	if srv.Responder.Policies == nil {
+		srv.Responder.Policies = map[string]*UnmatchedPolicy{}
+	}
+	srv.Responder.Policies[database] = &policy
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Verify checks the fixtures' expectations, returning the ones that haven't been met or have been broken along with
+// the queries that were received
+func (srv *_Server) Verify() *Verification {
+	return srv.Responder.verify()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Journal returns the journalled messages matching the filter, oldest first
+func (srv *_Server) Journal(filter JournalFilter) ([]JournalEntry, error) {
+	return srv.History.find(filter)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ClearJournal empties the journal and the queries the expectations have received, between tests say
+func (srv *_Server) ClearJournal() {
+	srv.History.clear()
+	srv.Responder.clearReceived()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// SetJournalSize sets how many messages the journal keeps, 0 for DefaultJournalSize
+func (srv *_Server) SetJournalSize(size int) {
+	srv.History.setSize(size)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// WaitForQuery blocks until queries matching the filter have been received times times, returning their journal
+// entries, or until the timeout ( 0 for none ) passes when it returns those there are with an error
+func (srv *_Server) WaitForQuery(filter JournalFilter, times int, timeout time.Duration) ([]JournalEntry, error) {
+	return srv.History.wait(filter, times, timeout)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Subscribe returns a channel of everything of the given types, or of any type if none are given, that happens on the
+// server from now on along with the function that unsubscribes and closes it. Events are dropped for subscribers that
+// fall too far behind.
+func (srv *_Server) Subscribe(types ...EventType) (<-chan Event, func()) {
+	return srv.Events.subscribe(types)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// OnEvent calls callback with everything of the given types, or of any type if none are given, that happens on the
+// server from now on, returning the function that unregisters it. The callback is called on the goroutine of the
+// session the event happened to, before the session carries on, so shouldn't block.
+func (srv *_Server) OnEvent(callback func(Event), types ...EventType) func() {
+	return srv.Events.add(&_Subscriber{Callback: callback}, types)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Pending lists the unmatched queries being held for an answer, oldest first
+func (srv *_Server) Pending() []PendingQuery {
+	return srv.Responder.pending()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// AnswerPending answers the held query, releasing its session, and saves the answer as a fixture if asked to
+func (srv *_Server) AnswerPending(id string, answer PendingAnswer) error {
+
+	// the query itself is the fixture's query, so it can't be a pattern
+	switch answer.Match {
+	case "", MatchExact, MatchNormalized, MatchFingerprint:
+	default:
+		return fmt.Errorf("pending queries can't be saved with match mode %s", answer.Match)
+	}
+
+	response, err := buildQueryResponse(answer.Columns, answer.Rows)
+	if err != nil {
+		return err
+	}
+	response.Error = answer.Error
+
+	pending, err := srv.Responder.answer(id, response)
+	if err != nil {
+		return err
+	}
+	if !answer.Save {
+		return nil
+	}
+
+	_, err = srv.AddFixture(Fixture{
+		Query:     pending.SQL,
+		Match:     answer.Match,
+		Columns:   answer.Columns,
+		Rows:      answer.Rows,
+		Error:     answer.Error,
+		Exhausted: ExhaustRepeat,
+	})
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// HandleFunc answers the queries the matcher picks out with handler, returning the ID of the fixture it's stored as
+func (srv *_Server) HandleFunc(matcher Matcher, handler HandlerFunc) (string, error) {
+	return srv.AddFixture(Fixture{
+		Query:     matcher.Query,
+		Match:     matcher.Match,
+		Params:    matcher.Params,
+		Session:   matcher.Session,
+		Priority:  matcher.Priority,
+		Columns:   columnPairs(matcher.Columns),
+		Exhausted: ExhaustRepeat,
+		Handler:   handler,
+		Describe:  matcher.Describe,
+	})
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// admitSession does the checks postgres makes before authentication, the session counts towards max connections
+// from here on
+func (srv *_Server) admitSession(session *_Session) *PgError {
+
+	// maintain concurrency
+	srv.Lock()
+	defer srv.Unlock()
+
+	if srv.StartingUp {
+		return fatalError(SQLStateCodeCannotConnectNow, "the database system is starting up")
+	}
+
+	if srv.MaxConnections > 0 && srv.countSessions(func(s *_Session) bool { return s.IsAdmitted }) >= srv.MaxConnections {
+		return fatalError(SQLStateCodeTooManyConnections, "sorry, too many clients already")
+	}
+
+	session.IsAdmitted = true
 	return nil
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// loginSession does the checks postgres makes after authentication, the role and database must exist and the role
+// must be under its connection limit
+func (srv *_Server) loginSession(session *_Session) *PgError {
+
+	// maintain concurrency
+	srv.Lock()
+	defer srv.Unlock()
+
+	user, database := session.Parameters["user"], session.Parameters["database"]
+
+	if srv.Roles != nil {
+		limit, found := srv.Roles[user]
+		if !found {
+			return fatalError(SQLStateCodeInvalidAuthorizationSpecification, fmt.Sprintf("role \"%s\" does not exist", user))
+		}
+		if limit >= 0 && srv.countSessions(func(s *_Session) bool { return s.IsLoggedIn && s.Parameters["user"] == user }) >= limit {
+			return fatalError(SQLStateCodeTooManyConnections, fmt.Sprintf("too many connections for role \"%s\"", user))
+		}
+	}
+
+	if srv.Databases != nil && !srv.Databases[database] {
+		return fatalError(SQLStateCodeInvalidCatalogName, fmt.Sprintf("database \"%s\" does not exist", database))
+	}
+
+	session.IsLoggedIn = true
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// countSessions counts the sessions matching the filter, the caller must hold the lock
+func (srv *_Server) countSessions(filter func(*_Session) bool) int {
+	count := 0
+	for _, session := range srv.Sessions {
+		if filter(session) {
+			count++
+		}
+	}
+	return count
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
 func (srv *_Server) ListenAndServe(bindAddr string) error {
 
 	// create a new listener
 	ln, err := net.Listen("tcp", bindAddr)
 	if err != nil {
-		return nil
+		return err
 	}
 
+	return srv.Serve(ln)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Serve accepts connections from ln until it's closed
+func (srv *_Server) Serve(ln net.Listener) error {
+
 	// close the listener when the service quits
 	defer ln.Close()
 
@@ -143,36 +655,50 @@ func (srv *_Server) ListenAndServe(bindAddr string) error {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Errorf("unable to accept connection, err: %s", err)
+			return err
 		}
 		log.Infof("accepted connection from: %s", conn.RemoteAddr())
 
 		// create a new session instance
+		srv.Lock()
 		session := &_Session{
 			Key:            _SessionKey{rand.Int31(), rand.Int31()},
+			Conn:           conn,
 			Messenger:      &_Messenger{Stream: conn},
 			CancelCallback: srv.issueCancelRequest,
-			Handler:        &_BaseHandler{srv.Responder},
+			AdmitCallback:  srv.admitSession,
+			LoginCallback:  srv.loginSession,
+			TLSConfig:      srv.TLSConfig,
+			Authenticator:  srv.Authenticator,
+			Journal:        srv.History,
+			Events:         srv.Events,
 		}
+		session.Handler = newBaseHandler(srv.Responder, session)
+		session.Context, session.Cancel = context.WithCancel(context.Background())
 
 		// add it to the active server list
-		srv.Lock()
 		srv.Sessions[session.Key] = session
 		srv.Unlock()
 
 		// spin off the goroutine to handle the session message processing
+		session.emit(Event{Type: EventConnectionOpened, RemoteAddr: conn.RemoteAddr().String()})
 		go func(session *_Session) {
 
 			// do some stuff on return
 			defer func() {
 
-				// make sure the connection closes
+				// make sure the connection closes, tls or not
 				log.Infof("closed connection to %s", conn.RemoteAddr())
-				conn.Close()
+				session.Conn.Close()
+				session.closeUpstream()
 
 				// remove the session from the server
+				session.Cancel()
 				srv.Lock()
 				delete(srv.Sessions, session.Key)
 				srv.Unlock()
+				srv.Responder.forgetSession(session.Key)
+				session.emit(Event{Type: EventConnectionClosed, RemoteAddr: conn.RemoteAddr().String()})
 
 				// catch panics, don't want to crash the server
 				if err := recover(); err != nil {
@@ -200,6 +726,12 @@ func (srv *_Server) issueCancelRequest(req *_CancelRequest) {
 
 	log.Warnf("Server.issueCancelRequest %v", req)
 	if v, found := srv.Sessions[_SessionKey{req.ProcessID, req.SecretKey}]; found {
-		v.handleCancel()
+
+		// protocol 3.2 sessions need the whole of the long key to match
+		if v.LongSecretKey != nil && !bytes.Equal(v.LongSecretKey, req.LongSecretKey) {
+			log.Warnf("Server.issueCancelRequest secret key mismatch for process %d", req.ProcessID)
+			return
+		}
+		v.cancelQuery()
 	}
 }
@@ -0,0 +1,460 @@
+package pgmock
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _TestClient is a bare bones frontend used to drive a running server over a real connection
+type _TestClient struct {
+	*_Messenger
+	Conn net.Conn
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// startTestServer starts a server on a random local port, call the returned func to stop it again
+func startTestServer(configure func(srv *_Server)) (*_Server, string, func()) {
+
+	srv := NewServer().(*_Server)
+	if configure != nil {
+		configure(srv)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	go srv.Serve(ln)
+
+	return srv, ln.Addr().String(), func() { ln.Close() }
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func dialTestClient(addr string) *_TestClient {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	Expect(err).To(BeNil())
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &_TestClient{_Messenger: newMessenger(conn), Conn: conn}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeStartup sends a protocol 3.0 StartupMessage with the given parameters
+func (c *_TestClient) writeStartup(params map[string]string) {
+	c.writeStartupVersion(3, 0, params)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeStartupVersion sends a StartupMessage for the given protocol version
+func (c *_TestClient) writeStartupVersion(major, minor int32, params map[string]string) {
+	body := &bytes.Buffer{}
+	bm := newMessenger(body)
+	bm.writeInt32(major<<16 | minor)
+	for k, v := range params {
+		bm.writeString(k).writeString(v)
+	}
+	bm.writeByte(0)
+	c.writeInt32(int32(4 + body.Len())).writeByteArray(body.Bytes()...)
+	Expect(c.Error).To(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeSSLRequest asks the server to upgrade the connection, returning the single byte answer
+func (c *_TestClient) writeSSLRequest() byte {
+	c.writeInt32(8).writeInt32(80877103)
+	Expect(c.Error).To(BeNil())
+	res := c.readByte()
+	Expect(c.Error).To(BeNil())
+	return res
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// upgradeTLS swaps the client over to TLS after a successful SSLRequest
+func (c *_TestClient) upgradeTLS(config *tls.Config) *tls.Conn {
+	conn := tls.Client(c.Conn, config)
+	Expect(conn.Handshake()).To(BeNil())
+	c.Conn = conn
+	c.Stream = conn
+	return conn
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// writeMessage sends a typed message with the body given
+func (c *_TestClient) writeMessage(msgID byte, body []byte) {
+	c.writeByte(msgID).writeInt32(int32(4 + len(body))).writeByteArray(body...)
+	Expect(c.Error).To(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readMessage reads the next backend message returning its identifier and body
+func (c *_TestClient) readMessage() (byte, []byte) {
+	msgID := c.readByte()
+	Expect(c.Error).To(BeNil())
+	msgLen := c.readInt32()
+	Expect(c.Error).To(BeNil())
+	body := c.readBytes(msgLen - 4)
+	Expect(c.Error).To(BeNil())
+	return msgID, body
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// expectMessage reads the next message asserting its identifier
+func (c *_TestClient) expectMessage(msgID byte) []byte {
+	id, body := c.readMessage()
+	Expect(string(id)).To(Equal(string(msgID)), "unexpected message: %s", body)
+	return body
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// errorFields decodes an ErrorResponse body into its fields
+func errorFields(body []byte) map[byte]string {
+	fields := map[byte]string{}
+	for len(body) > 1 {
+		end := bytes.IndexByte(body[1:], 0) + 1
+		fields[body[0]] = string(body[1:end])
+		body = body[end+1:]
+	}
+	return fields
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// createTestCertificate creates a self signed certificate for localhost
+func createTestCertificate() tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "localhost"},
+		DNSNames:           []string{"localhost"},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerStartup(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with the defaults
+	_, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// without tls the SSLRequest is refused and the startup carries on in the clear
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	Expect(c.writeSSLRequest()).To(Equal(byte('N')))
+	c.writeStartup(map[string]string{"user": "test"})
+
+	// assert the results
+	Expect(c.expectMessage(AuthenticationOkMessageID)).To(Equal([]byte{0, 0, 0, 0}))
+	Expect(c.expectMessage(BackendKeyDataMessageID)).To(HaveLen(8))
+	Expect(c.expectMessage(ReadyForQueryMessageID)).To(Equal([]byte{ReadyForQueryIdle}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerStartupTLS(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with tls switched on
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{createTestCertificate()}})
+	})
+	defer stop()
+
+	// the SSLRequest is accepted and the rest of the startup happens encrypted
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	Expect(c.writeSSLRequest()).To(Equal(byte('S')))
+	c.upgradeTLS(&tls.Config{InsecureSkipVerify: true})
+	c.writeStartup(map[string]string{"user": "test"})
+
+	// assert the results
+	c.expectMessage(AuthenticationOkMessageID)
+	c.expectMessage(BackendKeyDataMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerGSSENCRequest(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with the defaults
+	_, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// GSS encryption is refused and the client carries on
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeInt32(8).writeInt32(80877104)
+	Expect(c.readByte()).To(Equal(byte('N')))
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectMessage(AuthenticationOkMessageID)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerProtocolNegotiation(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server that holds on to queries so there's one to cancel
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedHold})).To(BeNil())
+
+	// a newer minor version and protocol options get negotiated down
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartupVersion(3, 9, map[string]string{"user": "test", "_pq_.test": "on"})
+	Expect(c.expectMessage(NegotiateProtocolVersionMessageID)).To(Equal([]byte{
+		0, 0, 0, 2, // newest minor
+		0, 0, 0, 1, // n options
+		95, 112, 113, 95, 46, 116, 101, 115, 116, 0, // _pq_.test
+	}))
+	c.expectMessage(AuthenticationOkMessageID)
+
+	// 3.2 gets a long cancel key
+	keyData := c.expectMessage(BackendKeyDataMessageID)
+	Expect(keyData).To(HaveLen(4 + 32))
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// cancelling with just the first 4 bytes of the key does nothing
+	c.writeMessage(QueryMessageID, []byte("SELECT held\x00"))
+	Eventually(srv.Pending).Should(HaveLen(1))
+	cancel := dialTestClient(addr)
+	cancel.writeInt32(16).writeInt32(80877102).writeByteArray(keyData[:8]...)
+	cancel.Conn.Close()
+	Consistently(srv.Pending, "50ms").Should(HaveLen(1))
+
+	// but the full key cancels the query
+	cancel = dialTestClient(addr)
+	cancel.writeInt32(int32(8 + len(keyData))).writeInt32(80877102).writeByteArray(keyData...)
+	cancel.Conn.Close()
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeQueryCanceled))
+	Expect(fields[ErrorMessage]).To(Equal("canceling statement due to user request"))
+	c.expectMessage(ReadyForQueryMessageID)
+	Expect(srv.Pending()).To(BeEmpty())
+
+	// and the session carries on
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedEmpty})).To(BeNil())
+	ids, _ := c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("C"))
+
+	// 3.2 exactly doesn't need any negotiation
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartupVersion(3, 2, map[string]string{"user": "test"})
+	c.expectMessage(AuthenticationOkMessageID)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerUnsupportedProtocol(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with the defaults
+	_, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// protocol 2 is long gone
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartupVersion(2, 0, map[string]string{"user": "test"})
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSeverity]).To(Equal("FATAL"))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeFeatureNotSupported))
+	Expect(fields[ErrorMessage]).To(Equal("unsupported frontend protocol 2.0: server supports 3.0 to 3.2"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerMessageTooLong(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server asking for passwords
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(NewPasswordAuthenticator(map[string]string{"test": "secret"}))
+	})
+	defer stop()
+
+	// a message claiming to be 2GB is refused before any of it's read
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writePassword("secret")
+	c.expectAuthRequest(AuthTypeOk)
+	c.expectMessage(BackendKeyDataMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+	c.writeByte(QueryMessageID).writeInt32(0x7FFFFFF0)
+	c.expectFatal(SQLStateCodeProtocolViolation, "invalid message length 2147483632")
+
+	// authentication responses have a much smaller limit
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectAuthRequest(AuthTypeCleartextPassword)
+	c.writeByte(PasswordMessageMessageID).writeInt32(20000)
+	c.expectFatal(SQLStateCodeProtocolViolation, "invalid message length 20000")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// expectFatal reads an ErrorResponse asserting it's a FATAL with the code and message given
+func (c *_TestClient) expectFatal(code, message string) {
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSeverity]).To(Equal("FATAL"))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(code))
+	Expect(fields[ErrorMessage]).To(Equal(message))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// connectTestClient dials the server and completes a startup with the parameters given
+func connectTestClient(addr string, params map[string]string) *_TestClient {
+	c := dialTestClient(addr)
+	c.writeStartup(params)
+	c.expectMessage(AuthenticationOkMessageID)
+	c.expectMessage(BackendKeyDataMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+	return c
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestServerStartupValidation(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with a couple of databases and roles
+	srv, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetDatabases([]string{"app", "admin"})
+		srv.SetRoles(map[string]int{"app": 1, "admin": -1})
+	})
+	defer stop()
+
+	// a known role gets in, defaulting the database to its own name
+	c := connectTestClient(addr, map[string]string{"user": "app"})
+	defer c.Conn.Close()
+
+	// but only once
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "app"})
+	c.expectFatal(SQLStateCodeTooManyConnections, "too many connections for role \"app\"")
+
+	// unlimited roles can keep going
+	c = connectTestClient(addr, map[string]string{"user": "admin", "database": "app"})
+	defer c.Conn.Close()
+	c = connectTestClient(addr, map[string]string{"user": "admin", "database": "app"})
+	defer c.Conn.Close()
+
+	// unknown roles and databases are refused
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "nobody", "database": "app"})
+	c.expectFatal(SQLStateCodeInvalidAuthorizationSpecification, "role \"nobody\" does not exist")
+
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "admin", "database": "nowhere"})
+	c.expectFatal(SQLStateCodeInvalidCatalogName, "database \"nowhere\" does not exist")
+
+	// as is a startup without a user
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"database": "app"})
+	c.expectFatal(SQLStateCodeInvalidAuthorizationSpecification, "no PostgreSQL user name specified in startup packet")
+
+	// three connections are open, so a limit of three leaves no room for more
+	srv.SetMaxConnections(3)
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "admin"})
+	c.expectFatal(SQLStateCodeTooManyConnections, "sorry, too many clients already")
+
+	// and nobody gets in while starting up
+	srv.SetMaxConnections(0)
+	srv.SetStartingUp(true)
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.writeStartup(map[string]string{"user": "admin"})
+	c.expectFatal(SQLStateCodeCannotConnectNow, "the database system is starting up")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// query sends a simple query and reads everything up to the ReadyForQuery, returning the ids and bodies in order
+func (c *_TestClient) query(sql string) ([]byte, [][]byte) {
+	c.writeMessage(QueryMessageID, append([]byte(sql), 0))
+	ids, bodies := []byte{}, [][]byte{}
+	for {
+		id, body := c.readMessage()
+		if id == ReadyForQueryMessageID {
+			return ids, bodies
+		}
+		ids, bodies = append(ids, id), append(bodies, body)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// cancelRunningQuery cancels the query a session is in the middle of, returning false if none of them are running one
+func cancelRunningQuery(srv *_Server) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	for _, session := range srv.Sessions {
+		session.QueryLock.Lock()
+		running := session.QueryCancel != nil
+		session.QueryLock.Unlock()
+		if running {
+			session.cancelQuery()
+			return true
+		}
+	}
+	return false
+}
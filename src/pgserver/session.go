@@ -1,7 +1,17 @@
 package pgmock
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -10,61 +20,186 @@ import (
 
 type _SessionCancelRequestCallback func(*_CancelRequest)
 
+// _SessionStartupCallback lets the server accept or refuse a session during startup
+type _SessionStartupCallback func(*_Session) *PgError
+
 type _Session struct {
-	Key                 _SessionKey
-	Messenger           *_Messenger
-	CancelCallback      _SessionCancelRequestCallback
-	IsHandshakeComplete bool
-	Handler             MessageHandler
+	Key                  _SessionKey
+	Conn                 net.Conn
+	Messenger            *_Messenger
+	CancelCallback       _SessionCancelRequestCallback
+	AdmitCallback        _SessionStartupCallback
+	LoginCallback        _SessionStartupCallback
+	IsHandshakeComplete  bool
+	Handler              MessageHandler
+	TLSConfig            *tls.Config
+	TLSState             *tls.ConnectionState
+	ChannelBinding       []byte
+	Authenticator        Authenticator
+	ProtocolMinorVersion int32
+	LongSecretKey        []byte
+	Parameters           map[string]string
+	IsAdmitted           bool
+	IsLoggedIn           bool
+	IgnoreTillSync       bool
+	TxStatus             byte
+	Settings             map[string]string
+	LocalSettings        map[string]string
+	TxSettings           map[string]string
+	Upstream             *_Upstream
+	Journal              *_Journal
+	Entry                *JournalEntry
+	Events               *_Events
+	Context              context.Context
+	Cancel               context.CancelFunc
+	QueryLock            sync.Mutex
+	QueryContext         context.Context
+	QueryCancel          context.CancelFunc
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (session *_Session) handleCancel() {
+// _Frame is a message read off the connection, Error is why the connection couldn't be read any further
+type _Frame struct {
+	ID     byte
+	Length int32
+	Body   []byte
+	Error  error
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
 
-	log.Warnf("Session.handleCancel")
+// cancelQuery cancels the query the session is running, if there is one, for a cancel request. It's called from
+// another session's goroutine so all it does is cancel the query's context, the session itself sends the error.
+func (session *_Session) cancelQuery() {
 
-	// write an error message
-	errRes := &_ErrorResponse{Fields: []*_ErrorResponseField{
-		&_ErrorResponseField{Indicator: ErrorSeverity, Message: "ERROR"},
-		&_ErrorResponseField{Indicator: ErrorSQLStateCode, Message: SQLStateCodeQueryCanceled},
-		&_ErrorResponseField{Indicator: ErrorMessage, Message: "Request was cancelled"},
-	}}
-	errRes.Fields = append(errRes.Fields)
-	errRes.write(session.Messenger)
+	// maintain concurrency
+	session.QueryLock.Lock()
+	defer session.QueryLock.Unlock()
 
-	// write a ReadyForQuery message
-	err := (&_ReadyForQuery{Indicator: ReadyForQueryIdle}).write(session.Messenger)
-	if err != nil {
-		log.Fatalf("failed to write ReadyForQuery message, err: %s", err)
+	if session.QueryCancel != nil {
+		session.QueryCancel()
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// startQuery gives the message about to be handled its own context, cancelled by a cancel request or when the session
+// goes. The returned func finishes it off.
+func (session *_Session) startQuery() func() {
+
+	ctx, cancel := context.WithCancel(session.context())
+
+	// maintain concurrency
+	session.QueryLock.Lock()
+	session.QueryContext, session.QueryCancel = ctx, cancel
+	session.QueryLock.Unlock()
+
+	return func() {
+		session.QueryLock.Lock()
+		session.QueryContext, session.QueryCancel = nil, nil
+		session.QueryLock.Unlock()
+		cancel()
 	}
-	log.Infof("succesfully wrote ReadyForQuery message")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// queryCanceled is the error sent for a query stopped by a cancel request
+func queryCanceled() *PgError {
+	return &PgError{Code: SQLStateCodeQueryCanceled, Message: "canceling statement due to user request"}
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
 func (session *_Session) processMessages() error {
 
+	// loop until the handshake is done
+	for !session.IsHandshakeComplete {
+
+		// if hsndshake returns true it was a cancel request
+		if err := session.doHandshake(); err != nil {
+			return err // kill connection
+		}
+	}
+
+	// from here on the connection is read by its own goroutine, so the session finds out straight away when the
+	// client goes even if it's in the middle of a query, while only this goroutine writes to it
+	frames, stop := make(chan *_Frame), make(chan struct{})
+	defer close(stop)
+	go session.readFrames(frames, stop)
+
 	// loop until things break or get closed
 	for {
+		log.Infof("handshake is complete, processing next message")
+		if err := session.processNextMessage(<-frames); err != nil {
+			return err
+		}
+	}
+}
 
-		// if there's still no startup message we're in handshake mode
-		if !session.IsHandshakeComplete {
+// ---------------------------------------------------------------------------------------------------------------------
 
-			// if hsndshake returns true it was a cancel request
-			if err := session.doHandshake(); err != nil {
-				return err // kill connection
-			}
+// readFrames reads messages off the connection and hands them over until the session stops, cancelling the session
+// as soon as the connection can't be read
+func (session *_Session) readFrames(frames chan<- *_Frame, stop <-chan struct{}) {
 
-			continue
+	m := newMessenger(session.Messenger.Stream)
+	for {
+		frame := readFrame(m)
+		if frame.Error != nil && session.Cancel != nil {
+			session.Cancel()
 		}
 
-		// if we're past handshake, process the next message instead
-		log.Infof("handshake is complete, processing next message")
-		if err := session.processNextMessage(); err != nil {
-			return err
+		select {
+		case frames <- frame:
+		case <-stop:
+			return
 		}
+		if frame.Error != nil || !validMessageLength(frame.Length) {
+			return
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// readFrame reads the next message, leaving out the body if the length is no good
+func readFrame(m *_Messenger) *_Frame {
+
+	// grab the messageID
+	frame := &_Frame{ID: m.readByte()}
+	if m.Error != nil {
+		frame.Error = fmt.Errorf("unable to read messageID, err: %s", m.Error)
+		return frame
+	}
+	log.Infof("found message ID: %s", string(frame.ID))
+
+	// get the message length
+	frame.Length = m.readInt32()
+	if m.Error != nil {
+		frame.Error = fmt.Errorf("unable to read message length, err: %s", m.Error)
+		return frame
 	}
+	log.Infof("found message length: %d", frame.Length)
+	if !validMessageLength(frame.Length) {
+		return frame
+	}
+
+	// read the whole body up front so a handler that reads too little ( or a message we skip ) can't throw the stream
+	// out
+	frame.Body = m.readBytes(frame.Length - 4)
+	if m.Error != nil {
+		frame.Error = fmt.Errorf("unable to read message body, err: %s", m.Error)
+	}
+	return frame
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// validMessageLength checks the length covers itself and isn't more than we'll read
+func validMessageLength(msgLen int32) bool {
+	return msgLen >= 4 && msgLen <= MaxMessageLength
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -76,11 +211,22 @@ func (session *_Session) doHandshake() error {
 	// shortcut
 	m := session.Messenger
 
-	// read and discard the message length
-	msgLen := m.readInt32()
+	// read the first byte on its own, startup packets are never big enough for it to be anything other than zero so
+	// a TLS handshake record here means the client is using direct ssl negotiation ( sslnegotiation=direct )
+	first := m.readByte()
+	if m.Error != nil {
+		return fmt.Errorf("unable to read message length, err: %s", m.Error)
+	}
+	if first == TLSHandshakeRecordType && session.TLSState == nil {
+		return session.acceptDirectTLS(first)
+	}
+
+	// otherwise it's the start of the message length, read the rest and discard
+	rest := m.readBytes(3)
 	if m.Error != nil {
 		return fmt.Errorf("unable to read message length, err: %s", m.Error)
 	}
+	msgLen := int32(binary.BigEndian.Uint32(append([]byte{first}, rest...)))
 	log.Infof("read message length: %d", msgLen)
 
 	protocolVersion := m.readInt32()
@@ -95,16 +241,39 @@ func (session *_Session) doHandshake() error {
 
 	// // SSLRequest uses the code 80877103 which yields 1234/5679 respectively ( 52.2.9 SSL Session Encryption )
 	if msb == 1234 && lsb == 5679 {
+
+		// no tls config ( or already encrypted ) means we carry on unencrypted
+		if session.TLSConfig == nil || session.TLSState != nil {
+			m.writeByte('N')
+			return m.Error
+		}
+
+		// otherwise tell the client to go ahead and do the handshake, the startup message follows encrypted
+		m.writeByte('S')
+		if m.Error != nil {
+			return fmt.Errorf("unable to accept SSLRequest, err: %s", m.Error)
+		}
+		return session.upgradeTLS(false)
+	}
+
+	// GSSENCRequest uses the code 80877104 which yields 1234/5680, there's no GSSAPI here so always refuse it and let
+	// the client carry on with an SSLRequest or startup message
+	if msb == 1234 && lsb == 5680 {
 		m.writeByte('N')
-		return nil
+		return m.Error
 	}
 
 	// CancelRequest uses the code 80877102 which yields 1234/5678 respectively
 	if msb == 1234 && lsb == 5678 {
 
-		// read in the cancel request message
+		// read in the cancel request message, anything longer than 16 bytes is a protocol 3.2 one with a long key
 		cancelRequest := &_CancelRequest{}
-		err := cancelRequest.read(m)
+		var err error
+		if msgLen > 16 {
+			err = cancelRequest.readLong(m, msgLen-12)
+		} else {
+			err = cancelRequest.read(m)
+		}
 		if err != nil {
 			return fmt.Errorf("unable to read cancel request, err: %s", err)
 		}
@@ -118,9 +287,12 @@ func (session *_Session) doHandshake() error {
 	}
 
 	// StartupMessage is the only other option..
-	if msb == 3 && lsb == 0 {
+	if msb == 3 {
+
+		log.Infof("have msb/lsb matching protocol 3.%d - accept startup message", lsb)
 
-		log.Infof("have msb/lsb matching protocol 3.0 - accept startup message")
+		// everything we send from here on is a proper message
+		session.tapMessages()
 
 		// read the startup message
 		msg := &_StartupMessage{}
@@ -131,6 +303,40 @@ func (session *_Session) doHandshake() error {
 
 		log.Infof("read startup message: %v", msg)
 
+		// newer minor versions and _pq_. protocol options need negotiating down
+		if err := session.negotiateProtocol(lsb, msg); err != nil {
+			return err
+		}
+
+		// postgres fills in the database from the user when it's missing
+		session.Parameters = msg.Parameters
+		if _, found := msg.Parameters["database"]; !found {
+			msg.Parameters["database"] = msg.Parameters["user"]
+		}
+		parameters := map[string]string{}
+		for k, v := range msg.Parameters {
+			parameters[k] = v
+		}
+		session.emit(Event{Type: EventStartup, Parameters: parameters})
+		if msg.Parameters["user"] == "" {
+			return session.sendFatal(SQLStateCodeInvalidAuthorizationSpecification, "no PostgreSQL user name specified in startup packet")
+		}
+
+		// make sure the server can take us at all before bothering with authentication
+		if err := session.checkStartup(session.AdmitCallback); err != nil {
+			return err
+		}
+
+		// authenticate the user if required
+		if err := session.authenticate(msg); err != nil {
+			return err
+		}
+
+		// then check the role and database exist, as postgres does after authentication
+		if err := session.checkStartup(session.LoginCallback); err != nil {
+			return err
+		}
+
 		// we've done the handshake
 		session.IsHandshakeComplete = true
 
@@ -143,47 +349,174 @@ func (session *_Session) doHandshake() error {
 
 		// write the BackendKeyData message
 		err = (&_BackendKeyData{
-			ProcessID: session.Key.ProcessID,
-			SecretKey: session.Key.SecretKey,
+			ProcessID:     session.Key.ProcessID,
+			SecretKey:     session.Key.SecretKey,
+			LongSecretKey: session.LongSecretKey,
 		}).write(m)
 		if err != nil {
 			return fmt.Errorf("failed to write BackendKeyData message, err: %s", err)
 		}
 		log.Infof("succesfully wrote BackendKeyData message")
 
+		// the session starts off outside a transaction with the settings it asked for
+		session.TxStatus = ReadyForQueryIdle
+		session.Settings = startupSettingsOf(session.Parameters)
+
 		// write a ReadyForQuery message
-		err = (&_ReadyForQuery{Indicator: 'I'}).write(m)
+		err = (&_ReadyForQuery{Indicator: session.TxStatus}).write(m)
 		if err != nil {
 			return fmt.Errorf("failed to write ReadyForQuery message, err: %s", err)
 		}
 		log.Infof("succesfully wrote ReadyForQuery message")
+		return nil
 	}
 
+	// anything else is a protocol we don't speak
+	return session.sendFatal(SQLStateCodeFeatureNotSupported,
+		fmt.Sprintf("unsupported frontend protocol %d.%d: server supports 3.0 to 3.%d", msb, lsb, LatestProtocolMinorVersion))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// negotiateProtocol settles on the minor protocol version for the session, sending a NegotiateProtocolVersion if the
+// client asked for something newer than we support or passed _pq_. protocol options, none of which are recognised
+func (session *_Session) negotiateProtocol(requested int32, msg *_StartupMessage) error {
+
+	// pull out the protocol options so they don't get treated as run-time parameters
+	unrecognised := []string{}
+	for k := range msg.Parameters {
+		if strings.HasPrefix(k, "_pq_.") {
+			unrecognised = append(unrecognised, k)
+			delete(msg.Parameters, k)
+		}
+	}
+	sort.Strings(unrecognised)
+
+	minor := requested
+	if minor > LatestProtocolMinorVersion {
+		minor = LatestProtocolMinorVersion
+	}
+	session.ProtocolMinorVersion = minor
+
+	// protocol 3.2 gets the longer cancel key, the first 4 bytes stay as the session key so cancels can find us
+	if minor >= 2 {
+		session.LongSecretKey = randomBytes(32)
+		binary.BigEndian.PutUint32(session.LongSecretKey, uint32(session.Key.SecretKey))
+	}
+
+	// nothing to tell the client if we're giving it what it asked for
+	if minor == requested && len(unrecognised) == 0 {
+		return nil
+	}
+
+	err := (&_NegotiateProtocolVersion{NewestMinorVersion: minor, UnrecognisedOptions: unrecognised}).write(session.Messenger)
+	if err != nil {
+		return fmt.Errorf("failed to write NegotiateProtocolVersion message, err: %s", err)
+	}
+	log.Infof("wrote NegotiateProtocolVersion message, minor version: %d, unrecognised options: %v", minor, unrecognised)
+
 	return nil
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (session *_Session) processNextMessage() error {
+// authenticate runs the configured Authenticator, any failure is sent to the client as a FATAL error
+func (session *_Session) authenticate(msg *_StartupMessage) error {
+
+	if session.Authenticator == nil {
+		session.emit(Event{Type: EventAuthentication})
+		return nil
+	}
+
+	err := session.Authenticator.Authenticate(&_AuthExchange{Session: session, Startup: msg})
+	if err == nil {
+		session.emit(Event{Type: EventAuthentication})
+		return nil
+	}
+	log.Warnf("authentication failed, err: %s", err)
+
+	// errors meant for the client go out as they are, always FATAL though as the connection is going away
+	pgErr, ok := err.(*PgError)
+	if !ok {
+		pgErr = passwordFailed(msg.Parameters["user"])
+	}
+	fatal := *pgErr
+	fatal.Severity = "FATAL"
+	session.emit(Event{Type: EventAuthentication, Error: &fatal})
+
+	return session.sendError(&fatal)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// checkStartup runs one of the startup callbacks, sending any error back to the client
+func (session *_Session) checkStartup(callback _SessionStartupCallback) error {
+	if callback == nil {
+		return nil
+	}
+	if pgErr := callback(session); pgErr != nil {
+		log.Warnf("startup refused, err: %s", pgErr)
+		return session.sendError(pgErr)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sendFatal writes a FATAL ErrorResponse to the client and returns an error so the caller drops the connection
+func (session *_Session) sendFatal(code, message string) error {
+	return session.sendError(fatalError(code, message))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// sendError writes the error to the client and hands it back so the caller can return it
+func (session *_Session) sendError(pgErr *PgError) error {
+	session.emit(Event{Type: EventError, Error: pgErr})
+	if err := pgErr.response().write(session.Messenger); err != nil {
+		log.Errorf("failed to write %s error, err: %s", pgErr.Severity, err)
+	}
+	return pgErr
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (session *_Session) processNextMessage(frame *_Frame) error {
 
 	// shortcut
 	m := session.Messenger
 
-	// grab the messageID
-	msgID := m.readByte()
-	if m.Error != nil {
-		return fmt.Errorf("unable to read messageID, err: %s", m.Error)
+	if frame.Error != nil {
+		return frame.Error
+	}
+	msgID, msgLen := frame.ID, frame.Length
+	if !validMessageLength(msgLen) {
+		return session.sendFatal(SQLStateCodeProtocolViolation, fmt.Sprintf("invalid message length %d", msgLen))
 	}
-	log.Infof("found message ID: %s", string(msgID))
 
-	// get the message length and discard
-	msgLen := m.readInt32()
-	if m.Error != nil {
-		return fmt.Errorf("unable to read message length, err: %s", m.Error)
+	// the handlers read from the body and write straight back to the client
+	bm := newMessenger(&_MessageBody{Reader: bytes.NewReader(frame.Body), Writer: m.Stream})
+
+	// the message gets its own context so a cancel request only stops what's running now
+	defer session.startQuery()()
+
+	// journal the message along with what came of it
+	entry := &JournalEntry{ProcessID: session.Key.ProcessID, Message: frontendMessageNames[msgID], Received: time.Now()}
+	if entry.Message == "" {
+		entry.Message = string(msgID)
+	}
+	session.Entry = entry
+	defer session.journal(entry)
+	session.emit(Event{Type: EventMessageReceived, Message: entry.Message, Length: int(msgLen)})
+
+	// after an error in an extended query everything up to the next Sync is ignored
+	if session.IgnoreTillSync && msgID != SyncMessageID && msgID != TerminateMessageID {
+		log.Infof("ignoring message %s until Sync", string(msgID))
+		return nil
 	}
-	log.Infof("found message length: %d", msgLen)
 
 	// yep, big ol switch case for the message IDs, message registry would be nicer
+	var err error
 	switch msgID {
 
 	// terminate the connection straight away
@@ -192,38 +525,94 @@ func (session *_Session) processNextMessage() error {
 
 	// pass Query on to Handler
 	case QueryMessageID:
-		err := session.Handler.HandleQuery(m)
+		err := session.Handler.HandleQuery(bm)
 		if err != nil {
-
-			errRes := &_ErrorResponse{Fields: []*_ErrorResponseField{
-				&_ErrorResponseField{Indicator: ErrorSeverity, Message: "ERROR"},
-				&_ErrorResponseField{Indicator: ErrorSQLStateCode, Message: "22000"},
-				&_ErrorResponseField{Indicator: ErrorMessage, Message: fmt.Sprintf("No Response for query, err: %s", err)},
-			}}
-			errRes.write(m)
-			(&_ReadyForQuery{Indicator: 'I'}).write(m)
+			session.failTransaction()
+		}
+		if pgErr, ok := err.(*PgError); ok {
+			log.Warnf("query failed, err: %s", pgErr)
+			entry.Error = pgErr
+			session.sendError(pgErr)
+			(&_ReadyForQuery{Indicator: session.TxStatus}).write(m)
+		} else if err != nil {
+
+			entry.Error = &PgError{Code: "22000", Message: fmt.Sprintf("No Response for query, err: %s", err)}
+			session.sendError(entry.Error)
+			(&_ReadyForQuery{Indicator: session.TxStatus}).write(m)
 			// return fmt.Errorf("handling of Query message failed, err: %s", err)
 		}
+		return nil
 
 	case ParseMessageID:
-		err := session.Handler.HandleParse(m)
-		if err != nil {
-			return fmt.Errorf("handling of Parse message failed, err: %s", err)
-		}
+		err = session.Handler.HandleParse(bm)
+
+	case BindMessageID:
+		err = session.Handler.HandleBind(bm)
 
 	case DescribeMessageID:
-		err := session.Handler.HandleDescribe(m)
-		if err != nil {
-			return fmt.Errorf("handling of Describe message failed, err: %s", err)
-		}
+		err = session.Handler.HandleDescribe(bm)
+
+	case ExecuteMessageID:
+		err = session.Handler.HandleExecute(bm)
+
+	case CloseMessageID:
+		err = session.Handler.HandleClose(bm)
+
+	// everything is written as it goes so there's nothing to flush
+	case FlushMessageID:
 
 	case SyncMessageID:
-		err := (&_ReadyForQuery{Indicator: ReadyForQueryIdle}).write(m)
+		session.IgnoreTillSync = false
+		err := (&_ReadyForQuery{Indicator: session.TxStatus}).write(m)
 		if err != nil {
 			return fmt.Errorf("handling of Sync message failed, err: %s", err)
 		}
 		log.Infof("wrote ReadyForQuery message")
+
+	default:
+		return session.sendFatal(SQLStateCodeProtocolViolation, fmt.Sprintf("invalid frontend message type %d", msgID))
+	}
+
+	// errors meant for the client get sent back, anything else means the connection is broken
+	if err != nil {
+		pgErr, ok := err.(*PgError)
+		if !ok {
+			return fmt.Errorf("handling of %s message failed, err: %s", string(msgID), err)
+		}
+		log.Warnf("extended query failed, err: %s", pgErr)
+		entry.Error = pgErr
+		session.IgnoreTillSync = true
+		session.failTransaction()
+		session.sendError(pgErr)
 	}
 
 	return nil
 }
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// journal finishes off the entry for the message that's been handled and adds it to the journal
+func (session *_Session) journal(entry *JournalEntry) {
+	session.Entry = nil
+	entry.Duration = time.Since(entry.Received)
+	if session.Journal != nil {
+		session.Journal.record(entry)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// failTransaction marks the transaction the session is in, if there is one, as failed after an error
+func (session *_Session) failTransaction() {
+	if session.TxStatus == ReadyForQueryTransaction {
+		session.TxStatus = ReadyForQueryError
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _MessageBody reads a message body that's already been read off the connection while writing straight back to it
+type _MessageBody struct {
+	io.Reader
+	io.Writer
+}
@@ -0,0 +1,511 @@
+package pgmock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Mock sets up what a server expects to be asked the way DATA-DOG/sqlmock does, so tests written against sqlmock can
+// move over to a real connection. Expectations are met in the order they're set up unless MatchExpectationsInOrder
+// is turned off, and anything that isn't expected fails. Expected queries are regular expressions as they are in
+// sqlmock, QueryMatcher can change that to any of the other non pattern match modes.
+type Mock struct {
+	sync.Mutex
+	QueryMatcher MatchMode
+	Expected     []_MockExpectation
+	Unordered    bool
+}
+
+// _MockExpectation is one of the expected queries or commands
+type _MockExpectation interface {
+	common() *_MockCommon
+}
+
+// _MockCommon is what every expectation has, Kind names it in errors
+type _MockCommon struct {
+	Kind      string
+	SQL       string
+	Args      []interface{}
+	HasArgs   bool
+	Err       error
+	Delay     time.Duration
+	Fulfilled bool
+}
+
+// Argument matches an argument in its own way, the argument is its text value or nil for NULL
+type Argument interface {
+	Match(value *string) bool
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ExpectedQuery is a query expected to return rows
+type ExpectedQuery struct {
+	_MockCommon
+	Rows *Rows
+}
+
+// ExpectedExec is a statement expected to affect rows
+type ExpectedExec struct {
+	_MockCommon
+	Affected int64
+}
+
+// ExpectedCommand is a BEGIN, COMMIT or ROLLBACK
+type ExpectedCommand struct {
+	_MockCommon
+}
+
+// Rows is the result of an expected query, columns are name:type pairs or just a name for text
+type Rows struct {
+	Columns []string
+	Values  [][]interface{}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (e *ExpectedQuery) common() *_MockCommon   { return &e._MockCommon }
+func (e *ExpectedExec) common() *_MockCommon    { return &e._MockCommon }
+func (e *ExpectedCommand) common() *_MockCommon { return &e._MockCommon }
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewMock hooks a Mock up to the server, it answers anything no other fixture does
+func NewMock(srv Server) (*Mock, error) {
+
+	mock := &Mock{QueryMatcher: MatchRegex}
+	matcher := Matcher{Query: "(?s).*", Match: MatchRegex, Priority: math.MinInt32, Describe: mock.describe}
+	_, err := srv.HandleFunc(matcher, mock.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	return mock, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// MatchExpectationsInOrder sets whether expectations have to be met in the order they were set up, they do by default
+func (mock *Mock) MatchExpectationsInOrder(inOrder bool) {
+	mock.Lock()
+	mock.Unordered = !inOrder
+	mock.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ExpectQuery expects a query matching sql that returns rows
+func (mock *Mock) ExpectQuery(sql string) *ExpectedQuery {
+	e := &ExpectedQuery{_MockCommon: _MockCommon{Kind: "Query", SQL: sql}}
+	mock.expect(e)
+	return e
+}
+
+// ExpectExec expects a statement matching sql that affects rows
+func (mock *Mock) ExpectExec(sql string) *ExpectedExec {
+	e := &ExpectedExec{_MockCommon: _MockCommon{Kind: "Exec", SQL: sql}}
+	mock.expect(e)
+	return e
+}
+
+// ExpectBegin expects a transaction to be started
+func (mock *Mock) ExpectBegin() *ExpectedCommand {
+	return mock.expectCommand("Begin")
+}
+
+// ExpectCommit expects a transaction to be committed
+func (mock *Mock) ExpectCommit() *ExpectedCommand {
+	return mock.expectCommand("Commit")
+}
+
+// ExpectRollback expects a transaction to be rolled back
+func (mock *Mock) ExpectRollback() *ExpectedCommand {
+	return mock.expectCommand("Rollback")
+}
+
+func (mock *Mock) expectCommand(kind string) *ExpectedCommand {
+	e := &ExpectedCommand{_MockCommon: _MockCommon{Kind: kind}}
+	mock.expect(e)
+	return e
+}
+
+func (mock *Mock) expect(e _MockExpectation) {
+	mock.Lock()
+	mock.Expected = append(mock.Expected, e)
+	mock.Unlock()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ExpectationsWereMet returns an error listing the expectations that haven't been met, nil if they all have
+func (mock *Mock) ExpectationsWereMet() error {
+
+	// maintain concurrency
+	mock.Lock()
+	defer mock.Unlock()
+
+	unmet := []string{}
+	for _, e := range mock.Expected {
+		if c := e.common(); !c.Fulfilled {
+			unmet = append(unmet, c.describe())
+		}
+	}
+	if len(unmet) > 0 {
+		return fmt.Errorf("there are unfulfilled expectations:\n  %s", strings.Join(unmet, "\n  "))
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// WithArgs expects the query to be called with these arguments, compared as text unless they're an Argument
+func (e *ExpectedQuery) WithArgs(args ...interface{}) *ExpectedQuery {
+	e.Args, e.HasArgs = args, true
+	return e
+}
+
+// WillReturnRows answers the query with the rows
+func (e *ExpectedQuery) WillReturnRows(rows *Rows) *ExpectedQuery {
+	e.Rows = rows
+	return e
+}
+
+// WillReturnError answers the query with the error, sent as it is if it's a *PgError
+func (e *ExpectedQuery) WillReturnError(err error) *ExpectedQuery {
+	e.Err = err
+	return e
+}
+
+// WillDelayFor waits before answering the query, giving up if the query is cancelled
+func (e *ExpectedQuery) WillDelayFor(delay time.Duration) *ExpectedQuery {
+	e.Delay = delay
+	return e
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// WithArgs expects the statement to be called with these arguments, compared as text unless they're an Argument
+func (e *ExpectedExec) WithArgs(args ...interface{}) *ExpectedExec {
+	e.Args, e.HasArgs = args, true
+	return e
+}
+
+// WillReturnResult answers the statement with the number of rows affected
+func (e *ExpectedExec) WillReturnResult(affected int64) *ExpectedExec {
+	e.Affected = affected
+	return e
+}
+
+// WillReturnError answers the statement with the error, sent as it is if it's a *PgError
+func (e *ExpectedExec) WillReturnError(err error) *ExpectedExec {
+	e.Err = err
+	return e
+}
+
+// WillDelayFor waits before answering the statement, giving up if it's cancelled
+func (e *ExpectedExec) WillDelayFor(delay time.Duration) *ExpectedExec {
+	e.Delay = delay
+	return e
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// WillReturnError fails the command with the error, sent as it is if it's a *PgError
+func (e *ExpectedCommand) WillReturnError(err error) *ExpectedCommand {
+	e.Err = err
+	return e
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// NewRows starts off the rows for an expected query
+func NewRows(columns []string) *Rows {
+	return &Rows{Columns: columns}
+}
+
+// AddRow adds a row of values, nil for NULL
+func (rows *Rows) AddRow(values ...interface{}) *Rows {
+	rows.Values = append(rows.Values, values)
+	return rows
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type _AnyArg struct{}
+
+func (_AnyArg) Match(*string) bool { return true }
+
+// AnyArg matches any argument, NULL included
+func AnyArg() Argument {
+	return _AnyArg{}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// handle answers a query with the expectation it meets, or fails it if it wasn't expected
+func (mock *Mock) handle(ctx context.Context, query *Query) (*Result, error) {
+
+	kind := "Query"
+	if cmd := parseSessionCommand(query.SQL); cmd != nil {
+		switch cmd.Kind {
+		case sessionCommandBegin:
+			kind = "Begin"
+		case sessionCommandCommit:
+			kind = "Commit"
+		case sessionCommandRollback:
+			kind = "Rollback"
+		default:
+			// SET and the like aren't something sqlmock knows about, they're answered as usual
+			return nil, nil
+		}
+	}
+
+	e, err := mock.next(kind, query)
+	if err != nil {
+		return nil, err
+	}
+	c := e.common()
+	if c.Delay > 0 {
+		select {
+		case <-time.After(c.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	switch e := e.(type) {
+	case *ExpectedQuery:
+		if e.Rows == nil {
+			return nil, nil
+		}
+		return &Result{Columns: e.Rows.columns(), Rows: e.Rows.Values}, nil
+
+	case *ExpectedExec:
+		tag := emptyTag(query.SQL)
+		if strings.HasSuffix(tag, " 0") {
+			tag = fmt.Sprintf("%s %d", strings.TrimSuffix(tag, " 0"), e.Affected)
+		}
+		return &Result{Tag: tag}, nil
+	}
+
+	return nil, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describe gives the columns of the expected query a statement will meet so it can be described before it's bound,
+// the arguments aren't known yet so they aren't checked
+func (mock *Mock) describe(sql string) []Column {
+
+	if parseSessionCommand(sql) != nil {
+		return nil
+	}
+
+	// maintain concurrency
+	mock.Lock()
+	defer mock.Unlock()
+
+	for _, e := range mock.Expected {
+		c := e.common()
+		if c.Fulfilled {
+			continue
+		}
+		if e, ok := e.(*ExpectedQuery); ok && e.Rows != nil && mock.matchesSQL(c, sql) == nil {
+			return e.Rows.columns()
+		}
+		if !mock.Unordered {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// columns are the rows' columns, just a name is a text column
+func (rows *Rows) columns() []Column {
+	columns := []Column{}
+	for _, name := range rows.Columns {
+		column := Column{Name: name, Type: "text"}
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			column = Column{Name: name[:i], Type: name[i+1:]}
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// next finds the expectation the query meets and marks it fulfilled. Queries can meet either a query or an exec, the
+// wire protocol doesn't say which the client wanted.
+func (mock *Mock) next(kind string, query *Query) (_MockExpectation, error) {
+
+	// maintain concurrency
+	mock.Lock()
+	defer mock.Unlock()
+
+	for _, e := range mock.Expected {
+		c := e.common()
+		if c.Fulfilled {
+			continue
+		}
+		if err := mock.meets(c, kind, query); err != nil {
+			if mock.Unordered {
+				continue
+			}
+			return nil, &PgError{Code: SQLStateCodeDataException, Message: err.Error()}
+		}
+		c.Fulfilled = true
+		return e, nil
+	}
+
+	return nil, &PgError{Code: SQLStateCodeDataException, Message: fmt.Sprintf("call to %s '%s' with args %s was not expected", kind, query.SQL, describeParams(query.Params))}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// meets checks the query against the expectation, explaining why it doesn't meet it if it doesn't
+func (mock *Mock) meets(c *_MockCommon, kind string, query *Query) error {
+
+	if c.Kind == "Begin" || c.Kind == "Commit" || c.Kind == "Rollback" || kind != "Query" {
+		if c.Kind != kind {
+			return fmt.Errorf("call to %s '%s' was not expected, next expectation is: %s", kind, query.SQL, c.describe())
+		}
+		return nil
+	}
+
+	if err := mock.matchesSQL(c, query.SQL); err != nil {
+		return err
+	}
+
+	if !c.HasArgs {
+		return nil
+	}
+	if len(c.Args) != len(query.Params) {
+		return fmt.Errorf("query '%s' has %d args, the next expectation wants %d: %s", query.SQL, len(query.Params), len(c.Args), c.describe())
+	}
+	for i, arg := range c.Args {
+		if !argMatches(arg, query.Params[i]) {
+			return fmt.Errorf("query '%s' arg %d is %s, the next expectation wants %v: %s", query.SQL, i+1, describeParams(query.Params[i:i+1]), arg, c.describe())
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// matchesSQL checks the query's sql against the expectation's with the mock's QueryMatcher
+func (mock *Mock) matchesSQL(c *_MockCommon, sql string) error {
+
+	matched := false
+	switch mock.QueryMatcher {
+	case MatchRegex, "":
+		pattern, err := regexp.Compile(c.SQL)
+		if err != nil {
+			return fmt.Errorf("expected query %s isn't a valid regular expression, err: %s", c.SQL, err)
+		}
+		matched = pattern.MatchString(sql)
+	default:
+		expected, _ := matchKey(mock.QueryMatcher, c.SQL)
+		actual, _ := matchKey(mock.QueryMatcher, sql)
+		matched = expected == actual
+	}
+	if !matched {
+		return fmt.Errorf("query '%s' does not match the next expectation: %s", sql, c.describe())
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// argMatches compares an expected argument against the text value the query was called with
+func argMatches(expected interface{}, value *string) bool {
+	switch expected := expected.(type) {
+	case Argument:
+		return expected.Match(value)
+	case nil:
+		return value == nil
+	case []byte:
+		return value != nil && *value == string(expected)
+	case time.Time:
+		if value == nil {
+			return false
+		}
+		t, err := parseTimestamp(*value)
+		return err == nil && t.Equal(expected)
+	case bool:
+		// t, true and 1 all mean true, whichever way the driver sent it
+		if value == nil {
+			return false
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(*value))
+		return err == nil && b == expected
+	case int, int8, int16, int32, int64:
+		if value == nil {
+			return false
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(*value), 10, 64)
+		return err == nil && n == reflect.ValueOf(expected).Int()
+	case uint, uint8, uint16, uint32, uint64:
+		if value == nil {
+			return false
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(*value), 10, 64)
+		return err == nil && n == reflect.ValueOf(expected).Uint()
+	case float32, float64:
+		// numbers are compared as numbers, 1e+06 and 1000000 are the same
+		if value == nil {
+			return false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(*value), reflect.TypeOf(expected).Bits())
+		return err == nil && f == reflect.ValueOf(expected).Float()
+	default:
+		return value != nil && *value == fmt.Sprint(expected)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describe says what the expectation is waiting for
+func (c *_MockCommon) describe() string {
+	switch {
+	case c.SQL == "":
+		return fmt.Sprintf("Expected%s", c.Kind)
+	case c.HasArgs:
+		return fmt.Sprintf("Expected%s '%s' with args %v", c.Kind, c.SQL, c.Args)
+	default:
+		return fmt.Sprintf("Expected%s '%s'", c.Kind, c.SQL)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describeParams lists the arguments, NULLs as NULL
+func describeParams(params []*string) string {
+	texts := []string{}
+	for _, p := range params {
+		if p == nil {
+			texts = append(texts, "NULL")
+			continue
+		}
+		texts = append(texts, fmt.Sprintf("%q", *p))
+	}
+	return "[" + strings.Join(texts, ", ") + "]"
+}
@@ -0,0 +1,174 @@
+package pgmock
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestMock(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	mock, err := NewMock(srv)
+	Expect(err).To(BeNil())
+
+	rows := NewRows([]string{"id:int4", "name"}).AddRow(1, "alice").AddRow(2, nil)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, name FROM users WHERE id = \$1`).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectExec(`UPDATE users`).WithArgs("bob", AnyArg()).WillReturnResult(3)
+	mock.ExpectCommit()
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, bodies := c.query("BEGIN")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("BEGIN\x00"))
+
+	arg := "1"
+	ids, bodies = c.extendedQuery("SELECT id, name FROM users WHERE id = $1", &arg)
+	Expect(string(ids)).To(Equal("12TDDC"))
+	Expect(string(bodies[3][len(bodies[3])-5:])).To(Equal("alice"))
+	Expect(string(bodies[4][len(bodies[4])-4:])).To(Equal("\xff\xff\xff\xff"))
+
+	name := "bob"
+	ids, bodies = c.extendedQuery("UPDATE users SET name = $1 WHERE id = $2", &name, nil)
+	Expect(string(ids)).To(Equal("12nC"))
+	Expect(string(bodies[3])).To(Equal("UPDATE 3\x00"))
+
+	Expect(mock.ExpectationsWereMet()).ToNot(BeNil())
+	ids, bodies = c.query("COMMIT")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("COMMIT\x00"))
+	Expect(mock.ExpectationsWereMet()).To(BeNil())
+
+	// anything else wasn't expected
+	ids, bodies = c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorMessage]).To(Equal("call to Query 'SELECT 1' with args [] was not expected"))
+
+	// out of order or with the wrong args
+	mock.ExpectQuery("SELECT a").WillReturnError(&PgError{Code: "42P01", Message: "relation \"a\" does not exist"})
+	mock.ExpectQuery("SELECT b").WithArgs("2")
+	ids, bodies = c.query("SELECT b")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorMessage]).To(Equal("query 'SELECT b' does not match the next expectation: ExpectedQuery 'SELECT a'"))
+	ids, bodies = c.query("SELECT a")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal("42P01"))
+	wrong := "3"
+	ids, bodies = c.extendedQuery("SELECT b", &wrong)
+	Expect(string(ids)).To(Equal("12nE"))
+	Expect(errorFields(bodies[3])[ErrorMessage]).To(Equal("query 'SELECT b' arg 1 is [\"3\"], the next expectation wants 2: ExpectedQuery 'SELECT b' with args [2]"))
+	Expect(mock.ExpectationsWereMet().Error()).To(Equal("there are unfulfilled expectations:\n  ExpectedQuery 'SELECT b' with args [2]"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestMockUnordered(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	mock, err := NewMock(srv)
+	Expect(err).To(BeNil())
+	mock.MatchExpectationsInOrder(false)
+	mock.QueryMatcher = MatchNormalized
+	mock.ExpectExec("delete from a")
+	mock.ExpectExec("DELETE FROM b").WillReturnResult(2)
+	mock.ExpectRollback()
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, bodies := c.query("DELETE   FROM b")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("DELETE 2\x00"))
+	ids, bodies = c.query("DELETE FROM a")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(string(bodies[0])).To(Equal("DELETE 0\x00"))
+	ids, _ = c.query("SET search_path TO app")
+	Expect(string(ids)).To(Equal("C"))
+	Expect(mock.ExpectationsWereMet().Error()).To(Equal("there are unfulfilled expectations:\n  ExpectedRollback"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestMockDatabaseSQL(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	mock, err := NewMock(srv)
+	Expect(err).To(BeNil())
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, name FROM users WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(NewRows([]string{"id:int4", "name"}).AddRow(1, "alice"))
+	mock.ExpectExec(`UPDATE users`).WithArgs("bob", 1).WillReturnResult(1)
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT pg_sleep`).WillDelayFor(time.Minute)
+
+	// lib/pq describes the statement before it binds it, the mock has to say what the columns will be
+	db, err := sql.Open("postgres", "postgres://test@"+addr+"/test?sslmode=disable")
+	Expect(err).To(BeNil())
+	defer db.Close()
+
+	// assert the results
+	tx, err := db.Begin()
+	Expect(err).To(BeNil())
+	var id int
+	var name string
+	Expect(tx.QueryRow("SELECT id, name FROM users WHERE id = $1", 1).Scan(&id, &name)).To(BeNil())
+	Expect(id).To(Equal(1))
+	Expect(name).To(Equal("alice"))
+	result, err := tx.Exec("UPDATE users SET name = $1 WHERE id = $2", "bob", 1)
+	Expect(err).To(BeNil())
+	Expect(result.RowsAffected()).To(Equal(int64(1)))
+	Expect(tx.Commit()).To(BeNil())
+	Expect(mock.ExpectationsWereMet()).ToNot(BeNil())
+
+	// cancelling the context sends a cancel request, which stops the delay
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = db.QueryContext(ctx, "SELECT pg_sleep($1)", 60)
+	Expect(err).ToNot(BeNil())
+	Expect(err.Error()).To(Equal("pq: canceling statement due to user request"))
+	Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	Expect(mock.ExpectationsWereMet()).To(BeNil())
+
+	// booleans and numbers match whatever text the driver sends them as
+	mock.ExpectExec(`UPDATE accounts`).WithArgs(true, false, 1e6, float32(0.1), uint8(7)).WillReturnResult(1)
+	_, err = db.Exec("UPDATE accounts SET active = $1, locked = $2, balance = $3, rate = $4 WHERE id = $5", true, false, 1e6, 0.1, 7)
+	Expect(err).To(BeNil())
+	mock.ExpectExec(`UPDATE accounts`).WithArgs(true, 1000000).WillReturnResult(1)
+	_, err = db.Exec("UPDATE accounts SET active = $1 WHERE balance = $2", "t", "1000000")
+	Expect(err).To(BeNil())
+	Expect(mock.ExpectationsWereMet()).To(BeNil())
+
+	// and unexpected queries fail, as do the wrong arguments
+	_, err = db.Exec("DELETE FROM users")
+	Expect(err.Error()).To(ContainSubstring("was not expected"))
+	mock.ExpectExec(`UPDATE accounts`).WithArgs(true).WillReturnResult(1)
+	_, err = db.Exec("UPDATE accounts SET active = $1", "f")
+	Expect(err).ToNot(BeNil())
+}
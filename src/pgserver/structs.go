@@ -0,0 +1,357 @@
+package pgmock
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	valuerType     = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// nullTypes are the column types of the sql.Null* types, they're NULL when they aren't valid
+var nullTypes = map[reflect.Type]string{
+	reflect.TypeOf(sql.NullString{}):  "text",
+	reflect.TypeOf(sql.NullInt64{}):   "int8",
+	reflect.TypeOf(sql.NullInt32{}):   "int4",
+	reflect.TypeOf(sql.NullFloat64{}): "float8",
+	reflect.TypeOf(sql.NullBool{}):    "bool",
+	reflect.TypeOf(sql.NullTime{}):    "timestamptz",
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _StructColumn is a struct field that's sent as a column, Index is where it is in the struct
+type _StructColumn struct {
+	Name  string
+	Type  string
+	Index []int
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// StructRows turns a slice of structs, or pointers to them, into name:type columns and their rows. Columns are named
+// by the field's db tag or its lower case name, fields tagged db:"-" and unexported fields are left out and embedded
+// structs are flattened. Types are worked out from the Go type ( int64 is int8, uint64 is numeric as it won't fit,
+// time.Time is timestamptz, [16]byte is uuid, json.RawMessage and maps are jsonb, slices are arrays, sql.Null* and
+// pointers are NULL when unset ), a pgtype tag overrides it.
+func StructRows(rows interface{}) ([]string, [][]interface{}, error) {
+
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("rows must be a slice of structs, not %T", rows)
+	}
+	elem := v.Type().Elem()
+	pointers := elem.Kind() == reflect.Ptr
+	if pointers {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("rows must be a slice of structs, not %T", rows)
+	}
+
+	columns, err := structColumns(elem, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf("%s has no columns", elem)
+	}
+	cols := []string{}
+	for _, c := range columns {
+		cols = append(cols, c.Name+":"+c.Type)
+	}
+
+	values := [][]interface{}{}
+	for i := 0; i < v.Len(); i++ {
+		row := v.Index(i)
+		if pointers {
+			if row.IsNil() {
+				return nil, nil, fmt.Errorf("row %d is nil", i)
+			}
+			row = row.Elem()
+		}
+		value := []interface{}{}
+		for _, c := range columns {
+			text, err := textValue(row.FieldByIndex(c.Index))
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to convert %s of row %d, err: %s", c.Name, i, err)
+			}
+			value = append(value, text)
+		}
+		values = append(values, value)
+	}
+
+	return cols, values, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// structColumns works out the columns of the struct type, index is where the struct is when it's embedded
+func structColumns(t reflect.Type, index []int) ([]_StructColumn, error) {
+
+	columns := []_StructColumn{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("db"), ",")[0]
+		if tag == "-" || f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		fieldIndex := append(index[:len(index):len(index)], i)
+
+		// embedded structs are flattened unless they're a type in their own right
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct && f.Tag.Get("pgtype") == "" && columnType(f.Type) == "" {
+			embedded, err := structColumns(f.Type, fieldIndex)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, embedded...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := tag
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		typ := f.Tag.Get("pgtype")
+		if typ == "" {
+			typ = columnType(f.Type)
+		}
+		if typ == "" {
+			return nil, fmt.Errorf("unable to work out a column type for field %s of type %s", f.Name, f.Type)
+		}
+		if _, found := rowDescs[typ]; !found {
+			return nil, fmt.Errorf("unable to find field type %s for field %s", typ, f.Name)
+		}
+		columns = append(columns, _StructColumn{Name: name, Type: typ, Index: fieldIndex})
+	}
+
+	return columns, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// columnType is the column type a Go type is sent as, "" if there isn't one
+func columnType(t reflect.Type) string {
+
+	if t.Kind() == reflect.Ptr {
+		return columnType(t.Elem())
+	}
+	if typ, found := nullTypes[t]; found {
+		return typ
+	}
+	switch t {
+	case timeType:
+		return "timestamptz"
+	case rawMessageType:
+		return "jsonb"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		return "int2"
+	case reflect.Int32, reflect.Uint16:
+		return "int4"
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "int8"
+	case reflect.Uint, reflect.Uint64:
+		return "numeric"
+	case reflect.Float32:
+		return "float4"
+	case reflect.Float64:
+		return "float8"
+	case reflect.String:
+		return "text"
+	case reflect.Map:
+		return "jsonb"
+	case reflect.Array:
+		if isUUID(t) {
+			return "uuid"
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea"
+		}
+		if elem := columnType(t.Elem()); elem != "" && !strings.HasPrefix(elem, "_") && rowDescs["_"+elem] != nil {
+			return "_" + elem
+		}
+	}
+
+	// anything else the database/sql driver knows how to send goes as text
+	if t.Implements(valuerType) || reflect.PtrTo(t).Implements(valuerType) {
+		return "text"
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// textValue is the text format of the value, nil for NULL
+func textValue(v reflect.Value) (interface{}, error) {
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		return textValue(v.Elem())
+	}
+
+	t := v.Type()
+	switch {
+	case t == timeType:
+		return formatTimestamp(v.Interface().(time.Time)), nil
+	case t == rawMessageType:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return string(v.Bytes()), nil
+	case isUUID(t):
+		b := make([]byte, 16)
+		for i := range b {
+			b[i] = byte(v.Index(i).Uint())
+		}
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	}
+	if valuer := valuerOf(v); valuer != nil {
+		value, err := valuer.Value()
+		if err != nil {
+			return nil, err
+		}
+		return driverText(value)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return "t", nil
+		}
+		return "f", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32:
+		return formatFloat(v.Float(), 32), nil
+	case reflect.Float64:
+		return formatFloat(v.Float(), 64), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return `\x` + hex.EncodeToString(v.Bytes()), nil
+		}
+		elements := []string{}
+		for i := 0; i < v.Len(); i++ {
+			element, err := textValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			if element == nil {
+				elements = append(elements, "NULL")
+				continue
+			}
+			elements = append(elements, quoteArrayElement(element.(string)))
+		}
+		return "{" + strings.Join(elements, ",") + "}", nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// driverText is the text format of a value from a driver.Valuer
+func driverText(value driver.Value) (interface{}, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return string(value), nil
+	case int64, float64, bool, string, time.Time:
+		return textValue(reflect.ValueOf(value))
+	default:
+		return nil, errors.New("unsupported driver value")
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// valuerOf is the value as a driver.Valuer, nil if it isn't one
+func valuerOf(v reflect.Value) driver.Valuer {
+	if v.Type().Implements(valuerType) {
+		return v.Interface().(driver.Valuer)
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(valuerType) {
+		return v.Addr().Interface().(driver.Valuer)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// isUUID is true for [16]byte types, which is what the uuid packages use
+func isUUID(t reflect.Type) bool {
+	return t.Kind() == reflect.Array && t.Len() == 16 && t.Elem().Kind() == reflect.Uint8
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// formatTimestamp formats the time the way PostgreSQL sends a timestamptz, the offset minutes only when there are some
+func formatTimestamp(t time.Time) string {
+	return strings.TrimSuffix(t.Format("2006-01-02 15:04:05.999999-07:00"), ":00")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// formatFloat formats the float the way PostgreSQL does, NaN and the infinities included
+func formatFloat(f float64, bits int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(f, 'g', -1, bits)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// quoteArrayElement quotes an array element if it needs to be
+func quoteArrayElement(element string) string {
+	if element == "" || strings.EqualFold(element, "NULL") || strings.ContainsAny(element, "{}\",\\ \t\n\r\v\f") {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(element) + `"`
+	}
+	return element
+}
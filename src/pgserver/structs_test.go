@@ -0,0 +1,194 @@
+package pgmock
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type testUUID [16]byte
+
+type testAudit struct {
+	CreatedAt time.Time `db:"created_at"`
+	Deleted   *time.Time
+}
+
+type testUser struct {
+	testAudit
+	ID       int64           `db:"id"`
+	Name     string          `db:"name"`
+	Email    sql.NullString  `db:"email"`
+	Age      *int32          `db:"age"`
+	Score    float64         `db:"score"`
+	Balance  string          `db:"balance" pgtype:"numeric"`
+	Active   bool            `db:"active"`
+	Avatar   []byte          `db:"avatar"`
+	Groups   []testUUID      `db:"groups"`
+	Tags     []string        `db:"tags"`
+	Meta     json.RawMessage `db:"meta"`
+	Password string          `db:"-"`
+	internal int
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestStructRows(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.FixedZone("", 5*3600+1800))
+	age := int32(42)
+	users := []*testUser{
+		{
+			testAudit: testAudit{CreatedAt: created},
+			ID:        1, Name: "alice", Email: sql.NullString{String: "alice@example.com", Valid: true}, Age: &age, Score: 1.5,
+			Balance: "10.25", Active: true, Avatar: []byte{0xde, 0xad}, Groups: []testUUID{{0x12, 0x34, 15: 0xff}},
+			Tags: []string{"a", "b c", "", "NULL"}, Meta: json.RawMessage(`{"k":1}`), Password: "secret",
+		},
+		{ID: 2, Name: "bob"},
+	}
+
+	cols, rows, err := StructRows(users)
+
+	// assert the results
+	Expect(err).To(BeNil())
+	Expect(cols).To(Equal([]string{
+		"created_at:timestamptz", "deleted:timestamptz", "id:int8", "name:text", "email:text", "age:int4", "score:float8",
+		"balance:numeric", "active:bool", "avatar:bytea", "groups:_uuid", "tags:_text", "meta:jsonb",
+	}))
+	Expect(rows).To(Equal([][]interface{}{
+		{
+			"2020-01-02 03:04:05.6+05:30", nil, "1", "alice", "alice@example.com", "42", "1.5", "10.25", "t", `\xdead`,
+			"{12340000-0000-0000-0000-0000000000ff}", `{a,"b c","","NULL"}`, `{"k":1}`,
+		},
+		{"0001-01-01 00:00:00+00", nil, "2", "bob", nil, nil, "0", "", "f", nil, nil, nil, nil},
+	}))
+
+	// unsigned ints too big for int8 are numeric and floats can be special
+	cols, rows, err = StructRows([]struct {
+		Big  uint64
+		Half float32
+		Odd  float64
+	}{{math.MaxUint64, float32(math.Inf(-1)), math.NaN()}, {1, float32(math.Inf(1)), 0.25}})
+	Expect(err).To(BeNil())
+	Expect(cols).To(Equal([]string{"big:numeric", "half:float4", "odd:float8"}))
+	Expect(rows).To(Equal([][]interface{}{{"18446744073709551615", "-Infinity", "NaN"}, {"1", "Infinity", "0.25"}}))
+
+	_, _, err = StructRows(testUser{})
+	Expect(err).ToNot(BeNil())
+	_, _, err = StructRows([]struct{ C chan int }{})
+	Expect(err.Error()).To(Equal("unable to work out a column type for field C of type chan int"))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestInjectRows(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	type account struct {
+		ID    int64  `db:"id"`
+		Owner string `db:"owner"`
+	}
+	err := srv.InjectRows("SELECT id, owner FROM accounts", []account{{ID: 7, Owner: "carol"}})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, bodies := c.query("SELECT id, owner FROM accounts")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(string(bodies[0])).To(ContainSubstring("id\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x14\x00\x08"))
+	Expect(string(bodies[1][len(bodies[1])-5:])).To(Equal("carol"))
+	Expect(string(bodies[2])).To(Equal("SELECT 1\x00"))
+	entries, _ := srv.Journal(JournalFilter{SQL: "SELECT id, owner FROM accounts"})
+	Expect(entries).ToNot(BeEmpty())
+	Expect(entries[0].FixtureID).ToNot(BeEmpty())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestInjectRowsBinary(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	type row struct {
+		Active  bool            `db:"active"`
+		Avatar  []byte          `db:"avatar"`
+		Small   int16           `db:"small"`
+		ID      int32           `db:"id"`
+		Big     int64           `db:"big"`
+		Ratio   float32         `db:"ratio"`
+		Score   float64         `db:"score"`
+		Key     testUUID        `db:"key"`
+		Meta    json.RawMessage `db:"meta"`
+		Name    string          `db:"name"`
+		Balance uint64          `db:"balance"`
+		Created time.Time       `db:"created"`
+	}
+	err := srv.InjectRows("SELECT * FROM things", []row{{
+		Active: true, Avatar: []byte{0xbe, 0xef}, Small: -2, ID: 7, Big: 1 << 40, Ratio: 0.5, Score: math.Inf(1),
+		Key: testUUID{0x12, 15: 0x34}, Meta: json.RawMessage(`{"a":1}`), Name: "x", Balance: 5,
+		Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+
+	// ask for everything in binary
+	c.writeParse("", "SELECT * FROM things")
+	c.writeBind("", "", nil, FormatBinary)
+	c.writeDescribe(ClosePortal, "")
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	c.expectMessage(BindCompleteMessageID)
+	desc := c.expectMessage(RowDescriptionMessageID)
+	data := c.expectMessage(DataRowMessageID)
+	c.expectMessage(CommandCompleteMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// pull the format codes out of the description and the values out of the row
+	formats := []int16{}
+	for rest := desc[2:]; len(rest) > 0; {
+		end := 0
+		for rest[end] != 0 {
+			end++
+		}
+		field := rest[end+1 : end+19]
+		formats = append(formats, int16(binary.BigEndian.Uint16(field[16:])))
+		rest = rest[end+19:]
+	}
+	values := [][]byte{}
+	for rest := data[2:]; len(rest) > 0; {
+		n := int(binary.BigEndian.Uint32(rest))
+		values = append(values, rest[4:4+n])
+		rest = rest[4+n:]
+	}
+
+	// assert the results
+	Expect(formats).To(Equal([]int16{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}))
+	Expect(values).To(Equal([][]byte{
+		{1}, {0xbe, 0xef}, {0xff, 0xfe}, {0, 0, 0, 7}, {0, 0, 1, 0, 0, 0, 0, 0}, {0x3f, 0, 0, 0},
+		{0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, {0x12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x34}, append([]byte{1}, `{"a":1}`...),
+		[]byte("x"), {0, 1, 0, 0, 0, 0, 0, 0, 0, 5}, {0, 2, 62, 30, 54, 239, 19, 64},
+	}))
+}
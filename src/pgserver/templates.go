@@ -0,0 +1,201 @@
+package pgmock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// TemplateData is what row templates are evaluated against. Params are the query's arguments, NULLs as empty strings,
+// with Captures holding the named groups of regex fixtures.
+type TemplateData struct {
+	Params   []string
+	Captures map[string]string
+	User     string
+	Database string
+	Settings map[string]string
+	nulls    []bool
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// templateFuncs are the helpers available to every template
+var templateFuncs = template.FuncMap{
+	"uuid": templateUUID,
+	"now":  templateNow,
+	"add": func(a, b interface{}) (float64, error) {
+		return templateMath(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b interface{}) (float64, error) {
+		return templateMath(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b interface{}) (float64, error) {
+		return templateMath(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b interface{}) (float64, error) {
+		return templateMath(a, b, func(x, y float64) float64 { return x / y })
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+
+	// these depend on the query, they're replaced when the template is run
+	"seq":    func(string) int64 { return 0 },
+	"param":  func(int) string { return "" },
+	"isNull": func(int) bool { return false },
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// compileTemplates parses the string cells of the rows as templates, keeping them alongside the response so they can
+// be evaluated for each query
+func compileTemplates(response *_QueryResponse, rows [][]interface{}) error {
+
+	response.Templates = make([][]*template.Template, len(rows))
+	for i, row := range rows {
+		response.Templates[i] = make([]*template.Template, len(row))
+		for j, cell := range row {
+			text, ok := cell.(string)
+			if !ok || !strings.Contains(text, "{{") {
+				continue
+			}
+			tmpl, err := template.New(fmt.Sprintf("row %d column %d", i+1, j+1)).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+			if err != nil {
+				return fmt.Errorf("invalid template, err: %s", err)
+			}
+			response.Templates[i][j] = tmpl
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// render evaluates the response's templates for the match, returning a copy of the response with the rows filled in
+// or an error response if a template fails. The caller must hold the lock.
+func (res *_Responder) render(response *_QueryResponse, match *_QueryMatch, session *_Session) *_QueryResponse {
+
+	if response.Templates == nil {
+		return response
+	}
+
+	data := &TemplateData{Captures: match.Captures, Params: make([]string, len(match.Params)), nulls: make([]bool, len(match.Params))}
+	for i, p := range match.Params {
+		if p == nil {
+			data.nulls[i] = true
+			continue
+		}
+		data.Params[i] = *p
+	}
+	if session != nil {
+		data.User, data.Database = session.Parameters["user"], session.Parameters["database"]
+		data.Settings = session.settings()
+	}
+
+	// the per query helpers
+	funcs := template.FuncMap{
+		"seq": res.nextSequence,
+		"param": func(n int) string {
+			if n < 1 || n > len(data.Params) {
+				return ""
+			}
+			return data.Params[n-1]
+		},
+		"isNull": func(n int) bool { return n < 1 || n > len(data.nulls) || data.nulls[n-1] },
+	}
+
+	// everything but the rows carries over as it is
+	copied := *response
+	rendered := &copied
+	rendered.Rows, rendered.Templates = nil, nil
+	for i, row := range response.Rows {
+		out := &_DataRow{Columns: make([]*_DataRowColumn, len(row.Columns))}
+		for j, col := range row.Columns {
+			out.Columns[j] = col
+			if i >= len(response.Templates) || j >= len(response.Templates[i]) || response.Templates[i][j] == nil {
+				continue
+			}
+			var b bytes.Buffer
+			tmpl, _ := response.Templates[i][j].Clone()
+			if err := tmpl.Funcs(funcs).Execute(&b, data); err != nil {
+				log.Warnf("unable to render template, err: %s", err)
+				return &_QueryResponse{Columns: response.Columns, Error: &PgError{Code: SQLStateCodeDataException, Message: fmt.Sprintf("fixture template failed, err: %s", err)}}
+			}
+			out.Columns[j] = &_DataRowColumn{Value: b.Bytes()}
+		}
+		rendered.Rows = append(rendered.Rows, out)
+	}
+
+	return rendered
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// nextSequence counts up from 1 for each named sequence, the caller must hold the lock
+func (res *_Responder) nextSequence(name string) int64 {
+	if res.Sequences == nil {
+		res.Sequences = map[string]int64{}
+	}
+	res.Sequences[name]++
+	return res.Sequences[name]
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// templateUUID generates a random version 4 uuid
+func templateUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// templateNow is the current time formatted as postgres formats a timestamptz, or using the layout if there is one
+func templateNow(layout ...string) string {
+	if len(layout) > 0 {
+		return time.Now().Format(layout[0])
+	}
+	return time.Now().Format("2006-01-02 15:04:05.999999-07")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// templateMath applies op to two numbers, which can be given as strings as params are
+func templateMath(a, b interface{}, op func(x, y float64) float64) (float64, error) {
+
+	x, err := templateNumber(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := templateNumber(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return op(x, y), nil
+}
+
+func templateNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
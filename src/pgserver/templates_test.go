@@ -0,0 +1,107 @@
+package pgmock
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestTemplates(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// one fixture answering for any user id, echoing it back
+	_, err := srv.AddFixture(Fixture{
+		Query:    "SELECT id, name, email, seq, uid FROM users WHERE id = $1",
+		Match:    MatchFingerprint,
+		Template: true,
+		Columns:  []string{"id:int4", "name:text", "email:text", "seq:int4", "uid:text"},
+		Rows:     [][]interface{}{{"{{param 1}}", "user {{add (param 1) 1000}}", "{{.User}}@{{.Settings.application_name}}", `{{seq "users"}}`, "{{uuid}}"}},
+	})
+	Expect(err).To(BeNil())
+	_, err = srv.AddFixture(Fixture{
+		Query:    `^SELECT (?P<col>\w+) FROM things$`,
+		Match:    MatchRegex,
+		Template: true,
+		Columns:  []string{"value:text"},
+		Rows:     [][]interface{}{{"{{upper .Captures.col}}"}, {"static"}},
+	})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "bob", "application_name": "api"})
+	defer c.Conn.Close()
+
+	// assert the results
+	values := func(body []byte) []string {
+		m := newMessenger(bytes.NewBuffer(body))
+		out := []string{}
+		for n := m.readInt16(); n > 0; n-- {
+			out = append(out, string(m.readBytes(m.readInt32())))
+		}
+		return out
+	}
+
+	ids, bodies := c.query("SELECT id, name, email, seq, uid FROM users WHERE id = 7")
+	Expect(string(ids)).To(Equal("TDC"))
+	row := values(bodies[1])
+	Expect(row[:4]).To(Equal([]string{"7", "user 1007", "bob@api", "1"}))
+	Expect(row[4]).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+
+	// bind parameters work the same way, and the sequence carries on
+	id := "42"
+	c.writeParse("", "SELECT id, name, email, seq, uid FROM users WHERE id = $1")
+	c.writeBind("", "", []*string{&id})
+	c.writeExecute("", 0)
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	c.expectMessage(BindCompleteMessageID)
+	Expect(values(c.expectMessage(DataRowMessageID))[:4]).To(Equal([]string{"42", "user 1042", "bob@api", "2"}))
+	c.expectMessage(CommandCompleteMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	ids, bodies = c.query("SELECT name FROM things")
+	Expect(string(ids)).To(Equal("TDDC"))
+	Expect(values(bodies[1])).To(Equal([]string{"NAME"}))
+	Expect(values(bodies[2])).To(Equal([]string{"static"}))
+
+	// templates that fail to run are errors, ones that don't parse are refused
+	_, err = srv.AddFixture(Fixture{Query: "SELECT broken", Template: true, Columns: []string{"n:text"}, Rows: [][]interface{}{{`{{add "x" 1}}`}}})
+	Expect(err).To(BeNil())
+	ids, bodies = c.query("SELECT broken")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeDataException))
+
+	_, err = srv.AddFixture(Fixture{Query: "SELECT 1", Template: true, Columns: []string{"n:text"}, Rows: [][]interface{}{{"{{nope}}"}}})
+	Expect(err).ToNot(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestTemplatesKeepResponse(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	response, err := buildQueryResponse([]string{"n:text"}, [][]interface{}{{"{{param 1}}"}})
+	Expect(err).To(BeNil())
+	Expect(compileTemplates(response, [][]interface{}{{"{{param 1}}"}})).To(BeNil())
+	response.Tag, response.Times, response.Webhook = "SELECT 99", 2, "http://localhost/answer"
+
+	value := "x"
+	rendered := (&_Responder{}).render(response, &_QueryMatch{Params: []*string{&value}}, nil)
+
+	// assert the results
+	Expect(string(rendered.Rows[0].Columns[0].Value)).To(Equal("x"))
+	Expect(rendered.Tag).To(Equal("SELECT 99"))
+	Expect(rendered.Times).To(Equal(2))
+	Expect(rendered.Webhook).To(Equal("http://localhost/answer"))
+	Expect(rendered.Templates).To(BeNil())
+	Expect(string(response.Rows[0].Columns[0].Value)).To(Equal("{{param 1}}"))
+}
@@ -0,0 +1,132 @@
+package pgmock
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _PrefixConn replays bytes that have already been read off the connection before carrying on reading from it
+type _PrefixConn struct {
+	net.Conn
+	Prefix []byte
+}
+
+func (c *_PrefixConn) Read(b []byte) (int, error) {
+	if len(c.Prefix) > 0 {
+		n := copy(b, c.Prefix)
+		c.Prefix = c.Prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// acceptDirectTLS handles a client opening with a TLS ClientHello rather than an SSLRequest, first is the byte that
+// has already been read to spot it
+func (session *_Session) acceptDirectTLS(first byte) error {
+
+	log.Infof("read TLS handshake record, attempting direct tls negotiation")
+
+	// postgres just drops the connection if it can't do ssl
+	if session.TLSConfig == nil {
+		return fmt.Errorf("direct tls negotiation requested but tls is not configured")
+	}
+
+	// hand the byte we've already consumed back to the handshake
+	session.Conn = &_PrefixConn{Conn: session.Conn, Prefix: []byte{first}}
+	return session.upgradeTLS(true)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// upgradeTLS performs the server side of a TLS handshake on the session connection and swaps the messenger over to
+// the encrypted stream. It also records the tls-server-end-point channel binding data for SCRAM-SHA-256-PLUS. Direct
+// negotiation requires the client to have selected the postgresql ALPN protocol, as it's the only thing stopping
+// the connection being mistaken for some other protocol.
+func (session *_Session) upgradeTLS(direct bool) error {
+
+	// the certificate served has to be captured so it can be hashed for channel binding, so wrap the certificate
+	// selection on a copy of the config
+	var served *tls.Certificate
+	config := session.TLSConfig.Clone()
+	certificates, getCertificate := config.Certificates, config.GetCertificate
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if getCertificate != nil {
+			cert, err := getCertificate(hello)
+			served = cert
+			return cert, err
+		}
+		if len(certificates) == 0 {
+			return nil, errors.New("no certificates configured")
+		}
+		served = &certificates[0]
+		return served, nil
+	}
+
+	// clients offering ALPN must ask for postgresql, anything else fails the handshake
+	config.NextProtos = []string{ALPNProtocolPostgreSQL}
+
+	// do the handshake
+	conn := tls.Server(session.Conn, config)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake failed, err: %s", err)
+	}
+	state := conn.ConnectionState()
+	log.Infof("tls handshake complete, version: %x, cipher suite: %x, alpn: %s", state.Version, state.CipherSuite, state.NegotiatedProtocol)
+
+	// swap the streams over
+	session.Conn = conn
+	session.Messenger.Stream = conn
+	session.TLSState = &state
+
+	// direct negotiation without ALPN isn't allowed
+	if direct && state.NegotiatedProtocol != ALPNProtocolPostgreSQL {
+		return session.sendFatal(SQLStateCodeProtocolViolation,
+			"received direct SSL connection request without ALPN protocol negotiation extension")
+	}
+
+	// work out the channel binding data, failing here just means -PLUS won't be offered
+	if served != nil && len(served.Certificate) > 0 {
+		hash, err := tlsServerEndPoint(served.Certificate[0])
+		if err != nil {
+			log.Warnf("unable to compute tls-server-end-point channel binding, err: %s", err)
+		}
+		session.ChannelBinding = hash
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// tlsServerEndPoint hashes the DER encoded certificate as described in RFC 5929, using the hash from the certificate
+// signature algorithm, with MD5 and SHA-1 being upgraded to SHA-256
+func tlsServerEndPoint(der []byte) ([]byte, error) {
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	}
+
+	h.Write(der)
+	return h.Sum(nil), nil
+}
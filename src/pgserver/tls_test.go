@@ -0,0 +1,65 @@
+package pgmock
+
+import (
+	"crypto/tls"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestDirectTLS(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server with tls switched on
+	_, addr, stop := startTestServer(func(srv *_Server) {
+		srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{createTestCertificate()}})
+	})
+	defer stop()
+
+	// open straight away with a ClientHello asking for the postgresql protocol
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	conn := c.upgradeTLS(&tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNProtocolPostgreSQL}})
+	Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal(ALPNProtocolPostgreSQL))
+
+	// then carry on with a normal startup
+	c.writeStartup(map[string]string{"user": "test"})
+	c.expectMessage(AuthenticationOkMessageID)
+	c.expectMessage(BackendKeyDataMessageID)
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// without ALPN the client is told off and dropped
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	c.upgradeTLS(&tls.Config{InsecureSkipVerify: true})
+	fields := errorFields(c.expectMessage(ErrorResponseMessageID))
+	Expect(fields[ErrorSQLStateCode]).To(Equal(SQLStateCodeProtocolViolation))
+
+	// asking for some other protocol fails the handshake
+	c = dialTestClient(addr)
+	defer c.Conn.Close()
+	err := tls.Client(c.Conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}).Handshake()
+	Expect(err).ToNot(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestDirectTLSNotConfigured(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// start a server without tls
+	_, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// the connection is simply dropped
+	c := dialTestClient(addr)
+	defer c.Conn.Close()
+	err := tls.Client(c.Conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNProtocolPostgreSQL}}).Handshake()
+	Expect(err).ToNot(BeNil())
+}
@@ -0,0 +1,227 @@
+package pgmock
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// UnmatchedAction is what happens to a query no fixture matches
+type UnmatchedAction string
+
+const (
+	// UnmatchedError fails the query, with the policy's SQLSTATE and message if it has them
+	UnmatchedError UnmatchedAction = "error"
+	// UnmatchedEmpty succeeds with no rows and a command tag to suit the query
+	UnmatchedEmpty UnmatchedAction = "empty"
+	// UnmatchedPassthrough runs the query against a real server and relays its answer
+	UnmatchedPassthrough UnmatchedAction = "passthrough"
+	// UnmatchedBlock waits for a fixture matching the query to be added, failing if none turns up before the timeout
+	UnmatchedBlock UnmatchedAction = "block"
+	// UnmatchedHold lists the query as pending until it's answered with AnswerPending, failing if it isn't answered
+	// before the timeout
+	UnmatchedHold UnmatchedAction = "hold"
+	// UnmatchedWebhook asks the policy's URL how to answer the query
+	UnmatchedWebhook UnmatchedAction = "webhook"
+)
+
+// UnmatchedPolicy says what to do with queries no fixture matches. Code and Message replace the usual 22000 error,
+// which is also what blocked and held queries get when they time out. Passthrough connects to Upstream ( host:port )
+// as User on Database, the session's own when they're not set, authenticating with Password if it's asked for one.
+// Each session keeps its upstream connection until it ends, but transaction control is still answered by the mock so
+// queries passed through between BEGIN and COMMIT each run in their own upstream transaction.
+// Timeout is how long to block or hold for in milliseconds, 0 for as long as it takes, the query gives up early if
+// it's cancelled or the client goes. Webhooks are POSTed to URL and have Timeout to answer, 10 seconds if it's not set.
+type UnmatchedPolicy struct {
+	Action   UnmatchedAction `json:"action"`
+	Code     string          `json:"code,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Upstream string          `json:"upstream,omitempty"`
+	User     string          `json:"user,omitempty"`
+	Password string          `json:"password,omitempty"`
+	Database string          `json:"database,omitempty"`
+	Timeout  int             `json:"timeout,omitempty"`
+	URL      string          `json:"url,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// validate checks the policy has everything its action needs
+func (policy *UnmatchedPolicy) validate() error {
+	switch policy.Action {
+	case UnmatchedError, UnmatchedEmpty, UnmatchedBlock, UnmatchedHold:
+	case UnmatchedPassthrough:
+		if policy.Upstream == "" {
+			return fmt.Errorf("passthrough needs an upstream server")
+		}
+	case UnmatchedWebhook:
+		if policy.URL == "" {
+			return fmt.Errorf("webhook needs a url")
+		}
+	default:
+		return fmt.Errorf("unknown unmatched action %s", policy.Action)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// error is the error sent for an unmatched query, with the diagnostics explaining why it didn't match
+func (policy *UnmatchedPolicy) error(res *_Responder, sql string) *PgError {
+	pgErr := noResponse(sql)
+	pgErr.Detail, pgErr.Hint = res.diagnose(sql)
+	if policy.Code != "" {
+		pgErr.Code = policy.Code
+	}
+	if policy.Message != "" {
+		pgErr.Message = policy.Message
+	}
+	return pgErr
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// unmatchedPolicy returns the policy for the database, falling back to the server's and then to a plain error
+func (res *_Responder) unmatchedPolicy(database string) *UnmatchedPolicy {
+
+	// maintain concurrency
+	res.Lock()
+	defer res.Unlock()
+
+	if policy, found := res.Policies[database]; found {
+		return policy
+	}
+	if policy, found := res.Policies[""]; found {
+		return policy
+	}
+	return &UnmatchedPolicy{Action: UnmatchedError}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// changed returns a channel that's closed the next time the fixtures change, the caller must hold the lock
+func (res *_Responder) changed() chan struct{} {
+	if res.Changed == nil {
+		res.Changed = make(chan struct{})
+	}
+	return res.Changed
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// wait blocks until a fixture matching the query turns up, giving up after timeout unless it's 0 or as soon as the
+// query is cancelled or the session goes
+func (res *_Responder) wait(sql string, args []*string, session *_Session, timeout time.Duration) *_QueryMatch {
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		// grab the channel before looking so a fixture added in between isn't missed
+		res.Lock()
+		changed := res.changed()
+		res.Unlock()
+
+		if match := res.find(sql, args, session); match != nil {
+			return match
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		case <-session.context().Done():
+			return nil
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// database is the database the session connected to
+func (bh *_BaseHandler) database() string {
+	if bh.Session == nil {
+		return ""
+	}
+	return bh.Session.Parameters["database"]
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// unmatched applies the session's unmatched policy to a query no fixture matched. Passthrough queries come back as
+// a match with Upstream set rather than a response.
+func (bh *_BaseHandler) unmatched(sql string, args []*string) (*_QueryMatch, error) {
+
+	policy := bh.ResponseLoader.unmatchedPolicy(bh.database())
+
+	switch policy.Action {
+	case UnmatchedEmpty:
+		response := &_QueryResponse{Columns: &_RowDescription{}, Tag: emptyTag(sql)}
+		return &_QueryMatch{Response: response, Params: args}, nil
+
+	case UnmatchedPassthrough:
+		return &_QueryMatch{Upstream: policy, Params: args}, nil
+
+	case UnmatchedWebhook:
+		response := &_QueryResponse{Webhook: policy.URL, WebhookTimeout: time.Duration(policy.Timeout) * time.Millisecond}
+		return &_QueryMatch{Response: response, Params: args}, nil
+
+	case UnmatchedBlock:
+		if match := bh.ResponseLoader.wait(sql, args, bh.Session, time.Duration(policy.Timeout)*time.Millisecond); match != nil {
+			return match, nil
+		}
+
+	case UnmatchedHold:
+		if response := bh.ResponseLoader.hold(sql, args, bh.Session, time.Duration(policy.Timeout)*time.Millisecond); response != nil {
+			return &_QueryMatch{Response: response, Params: args}, nil
+		}
+	}
+
+	if bh.Session.context().Err() != nil {
+		return nil, queryCanceled()
+	}
+	return nil, policy.error(bh.ResponseLoader, sql)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// emptyTag makes up a plausible command tag for a query that didn't return anything
+func emptyTag(sql string) string {
+
+	words := []string{}
+	for _, t := range tokenizeSQL(sql) {
+		if t.Kind != sqlTokenWord {
+			break
+		}
+		words = append(words, strings.ToUpper(t.Text))
+	}
+	if len(words) == 0 {
+		return "SELECT 0"
+	}
+
+	switch words[0] {
+	case "SELECT", "WITH", "VALUES", "TABLE":
+		return "SELECT 0"
+	case "INSERT":
+		return "INSERT 0 0"
+	case "UPDATE", "DELETE", "MERGE", "FETCH", "MOVE", "COPY":
+		return words[0] + " 0"
+	case "CREATE", "DROP", "ALTER":
+		// skip the modifiers to get at what's being created
+		for _, w := range words[1:] {
+			switch w {
+			case "OR", "REPLACE", "UNIQUE", "TEMP", "TEMPORARY", "UNLOGGED", "GLOBAL", "LOCAL", "IF", "NOT", "EXISTS":
+				continue
+			}
+			return words[0] + " " + w
+		}
+	}
+
+	return words[0]
+}
@@ -0,0 +1,200 @@
+package pgmock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestUnmatchedPolicies(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+
+	// by default it's an error
+	c := connectTestClient(addr, map[string]string{"user": "test"})
+	defer c.Conn.Close()
+	ids, bodies := c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeDataException))
+
+	// which can be any error
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedError, Code: "42P01", Message: "relation does not exist"})).To(BeNil())
+	ids, bodies = c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal("42P01"))
+	Expect(errorFields(bodies[0])[ErrorMessage]).To(Equal("relation does not exist"))
+
+	// or an empty result for health checks against their own database
+	Expect(srv.SetUnmatchedPolicy("health", UnmatchedPolicy{Action: UnmatchedEmpty})).To(BeNil())
+	health := connectTestClient(addr, map[string]string{"user": "pooler", "database": "health"})
+	defer health.Conn.Close()
+	for sql, tag := range map[string]string{
+		"SELECT 1":                               "SELECT 0",
+		"insert into t values (1)":               "INSERT 0 0",
+		"CREATE UNIQUE INDEX i ON t (id)":        "CREATE INDEX",
+		"DROP TABLE IF EXISTS t":                 "DROP TABLE",
+		"VACUUM":                                 "VACUUM",
+		"WITH x AS (SELECT 1) DELETE FROM t":     "SELECT 0",
+		"UPDATE t SET id = 2 WHERE id = 1":       "UPDATE 0",
+		"CREATE OR REPLACE FUNCTION f() RETURNS": "CREATE FUNCTION",
+	} {
+		ids, bodies = health.query(sql)
+		Expect(string(ids)).To(Equal("C"), sql)
+		Expect(string(bodies[0])).To(Equal(tag+"\x00"), sql)
+	}
+	ids, _ = health.extendedQuery("SELECT 1")
+	Expect(string(ids)).To(Equal("12nC"))
+
+	// blocking waits for a fixture to turn up
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedBlock, Timeout: 5000})).To(BeNil())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.AddFixture(Fixture{Query: "SELECT late", Columns: []string{"n:text"}, Rows: [][]interface{}{{"here"}}})
+	}()
+	ids, _ = c.query("SELECT late")
+	Expect(string(ids)).To(Equal("TDC"))
+
+	// giving up after the timeout
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedBlock, Timeout: 20})).To(BeNil())
+	ids, _ = c.query("SELECT never")
+	Expect(string(ids)).To(Equal("E"))
+
+	// and bad policies are refused
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: "shrug"})).ToNot(BeNil())
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough})).ToNot(BeNil())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestUnmatchedPassthrough(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// another mock stands in for the real database, with a password
+	upstream, upstreamAddr, stopUpstream := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(NewMD5Authenticator(map[string]string{"app": "secret"}))
+	})
+	defer stopUpstream()
+	_, err := upstream.AddFixture(Fixture{Query: "SELECT name FROM users WHERE id = $1", Match: MatchFingerprint, Columns: []string{"name:text"}, Rows: [][]interface{}{{"upstream"}}})
+	Expect(err).To(BeNil())
+	_, err = upstream.AddFixture(Fixture{Query: "SELECT fail", Error: &PgError{Code: "42501", Message: "permission denied"}})
+	Expect(err).To(BeNil())
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough, Upstream: upstreamAddr, Password: "secret"})).To(BeNil())
+	_, err = srv.AddFixture(Fixture{Query: "SELECT name FROM users WHERE id = 1", Columns: []string{"name:text"}, Rows: [][]interface{}{{"mock"}}})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "app"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, bodies := c.query("SELECT name FROM users WHERE id = 1")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(string(bodies[1])).To(ContainSubstring("mock"))
+
+	ids, bodies = c.query("SELECT name FROM users WHERE id = 2")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(string(bodies[1])).To(ContainSubstring("upstream"))
+
+	id := "3"
+	ids, bodies = c.extendedQuery("SELECT name FROM users WHERE id = $1", &id)
+	Expect(string(ids)).To(Equal("12TDC"))
+	Expect(string(bodies[3])).To(ContainSubstring("upstream"))
+
+	// statements are described by the upstream too
+	c.writeParse("stmt", "SELECT name FROM users WHERE id = $1")
+	c.writeDescribe(CloseStatement, "stmt")
+	c.writeMessage(SyncMessageID, nil)
+	c.expectMessage(ParseCompleteMessageID)
+	Expect(c.expectMessage(ParameterDescriptionMessageID)).To(Equal([]byte{0, 1, 0, 0, 0, 25}))
+	Expect(string(c.expectMessage(RowDescriptionMessageID))).To(ContainSubstring("name"))
+	c.expectMessage(ReadyForQueryMessageID)
+
+	// a transaction's queries all go through the session's one upstream connection
+	for _, sql := range []string{"BEGIN", "SELECT name FROM users WHERE id = 4", "SELECT name FROM users WHERE id = 5", "COMMIT"} {
+		ids, _ = c.query(sql)
+		Expect(string(ids)).To(ContainSubstring("C"), sql)
+	}
+	upstreamSessions := func() int {
+		upstream.Lock()
+		defer upstream.Unlock()
+		return len(upstream.Sessions)
+	}
+	Expect(upstreamSessions()).To(Equal(1))
+
+	// cancelling a query closes the upstream connection rather than waiting on it
+	_, err = upstream.HandleFunc(Matcher{Query: "SELECT pg_sleep(60)"}, func(ctx context.Context, query *Query) (*Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	Expect(err).To(BeNil())
+	c.writeMessage(QueryMessageID, []byte("SELECT pg_sleep(60)\x00"))
+	Eventually(func() bool { return cancelRunningQuery(srv) }).Should(BeTrue())
+	Expect(errorFields(c.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeQueryCanceled))
+	c.expectMessage(ReadyForQueryMessageID)
+	Eventually(upstreamSessions).Should(Equal(0))
+
+	// with the next query connecting again
+	ids, _ = c.query("SELECT name FROM users WHERE id = 6")
+	Expect(string(ids)).To(Equal("TDC"))
+
+	// upstream errors come back as they are
+	ids, bodies = c.query("SELECT fail")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal("42501"))
+
+	// as does not being able to log in
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough, Upstream: upstreamAddr, Password: "wrong"})).To(BeNil())
+	ids, bodies = c.query("SELECT name FROM users WHERE id = 2")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidPassword))
+
+	// or reach the upstream at all
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough, Upstream: "127.0.0.1:1"})).To(BeNil())
+	ids, bodies = c.query("SELECT name FROM users WHERE id = 2")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(strings.HasPrefix(errorFields(bodies[0])[ErrorMessage], "unable to pass query through")).To(BeTrue())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestUnmatchedPassthroughSCRAM(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	upstream, upstreamAddr, stopUpstream := startTestServer(func(srv *_Server) {
+		srv.SetAuthenticator(NewSCRAMAuthenticator(map[string]string{"app": "secret"}, ChannelBindingOffer))
+	})
+	defer stopUpstream()
+	_, err := upstream.AddFixture(Fixture{Query: "SELECT 1", Columns: []string{"n:int4"}, Rows: [][]interface{}{{"1"}}})
+	Expect(err).To(BeNil())
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough, Upstream: upstreamAddr, Password: "secret"})).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "app"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, _ := c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("TDC"))
+
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedPassthrough, Upstream: upstreamAddr, Password: "wrong"})).To(BeNil())
+	ids, bodies := c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeInvalidPassword))
+}
@@ -0,0 +1,422 @@
+package pgmock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// _Upstream is a connection to a real server for passing queries through to. Each session keeps its own for as long
+// as the policy stays the same, Broken is set once it can't be trusted to carry on.
+type _Upstream struct {
+	Conn      net.Conn
+	Messenger *_Messenger
+	Policy    UnmatchedPolicy
+	Broken    bool
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// useUpstream runs use on the session's upstream connection, connecting first if it hasn't got one for the policy.
+// The connection is closed if the query is cancelled or the client goes while it's waiting on the upstream, and
+// dropped if it's broken or left in a transaction.
+func useUpstream(policy *UnmatchedPolicy, session *_Session, use func(*_Upstream) error) error {
+
+	ctx := session.context()
+	var up *_Upstream
+	if session != nil && session.Upstream != nil && session.Upstream.Policy == *policy {
+		up = session.Upstream
+	} else {
+		session.closeUpstream()
+		var err error
+		if up, err = dialUpstream(ctx, policy, session); err != nil {
+			return upstreamError(ctx, err)
+		}
+	}
+
+	stop := up.watch(ctx)
+	err := use(up)
+	stop()
+
+	if up.Broken || ctx.Err() != nil || session == nil {
+		up.close()
+		up = nil
+	}
+	if session != nil {
+		session.Upstream = up
+	}
+
+	return upstreamError(ctx, err)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// closeUpstream closes the session's upstream connection if it has one, when it's replaced or the session ends
+func (session *_Session) closeUpstream() {
+	if session != nil && session.Upstream != nil {
+		session.Upstream.close()
+		session.Upstream = nil
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// upstreamError is the error to send for err, which is down to the query being cancelled if its context is done
+func upstreamError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return queryCanceled()
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// watch closes the connection if ctx is done before the returned func is called, which waits for it to finish
+func (up *_Upstream) watch(ctx context.Context) func() {
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			up.Conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// dialUpstream connects and logs in to the policy's upstream server, supporting trust, password, md5 and
+// SCRAM-SHA-256 authentication. It gives up if ctx is done first.
+func dialUpstream(ctx context.Context, policy *UnmatchedPolicy, session *_Session) (*_Upstream, error) {
+
+	user, database := policy.User, policy.Database
+	if session != nil && user == "" {
+		user = session.Parameters["user"]
+	}
+	if session != nil && database == "" {
+		database = session.Parameters["database"]
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", policy.Upstream)
+	if err != nil {
+		return nil, upstreamFailed(err)
+	}
+	up := &_Upstream{Conn: conn, Messenger: newMessenger(conn), Policy: *policy}
+	defer up.watch(ctx)()
+
+	// startup has no message id
+	body := &bytes.Buffer{}
+	bm := newMessenger(body).writeInt32(3 << 16).writeString("user").writeString(user)
+	if database != "" {
+		bm.writeString("database").writeString(database)
+	}
+	bm.writeByte(0)
+	up.Messenger.writeInt32(int32(4 + body.Len())).writeByteArray(body.Bytes()...)
+	if up.Messenger.Error != nil {
+		up.close()
+		return nil, upstreamFailed(up.Messenger.Error)
+	}
+
+	var scram *_SCRAMClient
+	for {
+		msgID, body, err := up.read()
+		if err != nil {
+			up.close()
+			return nil, err
+		}
+
+		switch msgID {
+		case AuthenticationOkMessageID:
+			bm := newMessenger(bytes.NewBuffer(body))
+			switch authType := bm.readInt32(); authType {
+			case AuthTypeOk:
+			case AuthTypeCleartextPassword:
+				err = up.write(PasswordMessageMessageID, append([]byte(policy.Password), 0))
+			case AuthTypeMD5Password:
+				err = up.write(PasswordMessageMessageID, append([]byte(md5Password(policy.Password, user, bm.readBytes(4))), 0))
+			case AuthTypeSASL:
+				scram, err = up.startSCRAM(policy.Password, body[4:])
+			case AuthTypeSASLContinue:
+				var final []byte
+				if scram == nil {
+					err = upstreamFailed(fmt.Errorf("unexpected SASL continue"))
+				} else if final, err = scram.final(body[4:]); err != nil {
+					err = upstreamFailed(err)
+				} else {
+					err = up.write(SASLResponseMessageID, final)
+				}
+			case AuthTypeSASLFinal:
+				if scram == nil {
+					err = upstreamFailed(fmt.Errorf("unexpected SASL final"))
+				} else if err = scram.verify(body[4:]); err != nil {
+					err = upstreamFailed(err)
+				}
+			default:
+				err = upstreamFailed(fmt.Errorf("unsupported authentication type %d", authType))
+			}
+		case ErrorResponseMessageID:
+			// a FATAL upstream is only an ERROR for our client
+			pgErr := errorFromResponse(body)
+			pgErr.Severity = ""
+			err = pgErr
+		case ReadyForQueryMessageID:
+			return up, nil
+		}
+
+		if err != nil {
+			up.close()
+			return nil, err
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// startSCRAM picks SCRAM-SHA-256 from the mechanisms the upstream offers and sends the client-first-message, -PLUS
+// isn't possible as upstream connections don't use TLS
+func (up *_Upstream) startSCRAM(password string, mechanisms []byte) (*_SCRAMClient, error) {
+
+	offered := false
+	for _, mechanism := range bytes.Split(bytes.TrimRight(mechanisms, "\x00"), []byte{0}) {
+		offered = offered || string(mechanism) == SASLMechanismSCRAMSHA256
+	}
+	if !offered {
+		return nil, upstreamFailed(fmt.Errorf("no supported SASL mechanism offered"))
+	}
+
+	scram := newSCRAMClient(password)
+	first := scram.first()
+	body := &bytes.Buffer{}
+	newMessenger(body).writeString(SASLMechanismSCRAMSHA256).writeInt32(int32(len(first))).writeByteArray(first...)
+
+	return scram, up.write(SASLInitialResponseMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// upstreamFailed is the error sent when the upstream server can't be used
+func upstreamFailed(err error) *PgError {
+	return &PgError{Code: SQLStateCodeConnectionFailure, Message: fmt.Sprintf("unable to pass query through to upstream, err: %s", err)}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (up *_Upstream) read() (byte, []byte, error) {
+	m := up.Messenger
+	msgID := m.readByte()
+	msgLen := m.readInt32()
+	if m.Error == nil && msgLen < 4 {
+		up.Broken = true
+		return 0, nil, upstreamFailed(fmt.Errorf("invalid message length %d", msgLen))
+	}
+	var body []byte
+	if m.Error == nil {
+		body = m.readBytes(msgLen - 4)
+	}
+	if m.Error != nil {
+		up.Broken = true
+		return 0, nil, upstreamFailed(m.Error)
+	}
+	return msgID, body, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (up *_Upstream) write(msgID byte, body []byte) error {
+	up.Messenger.writeByte(msgID).writeInt32(int32(4 + len(body))).writeByteArray(body...)
+	if up.Messenger.Error != nil {
+		up.Broken = true
+		return upstreamFailed(up.Messenger.Error)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (up *_Upstream) close() {
+	up.write(TerminateMessageID, nil)
+	up.Conn.Close()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// relay copies the upstream's messages to the client until it's ready for the next query, leaving out the ones in
+// skip. An upstream error isn't relayed but returned so it's handled like any other. The mock answers transaction
+// control itself, so an upstream left in a transaction isn't used again.
+func (up *_Upstream) relay(m *_Messenger, skip string) error {
+
+	var pgErr error
+	for {
+		msgID, body, err := up.read()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msgID == ReadyForQueryMessageID:
+			up.Broken = up.Broken || len(body) != 1 || body[0] != ReadyForQueryIdle
+			return pgErr
+		case msgID == ErrorResponseMessageID:
+			pgErr = errorFromResponse(body)
+		case bytes.IndexByte([]byte(skip), msgID) >= 0:
+		default:
+			m.writeByte(msgID).writeInt32(int32(4 + len(body))).writeByteArray(body...)
+			if m.Error != nil {
+				// the rest of the upstream's answer is never going to be read
+				up.Broken = true
+				return m.Error
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// passthrough runs the query on the upstream server relaying the results, extended queries are sent with their
+// arguments as text
+func passthrough(m *_Messenger, match *_QueryMatch, session *_Session, sql string, extended bool, formats []int16) error {
+	return useUpstream(match.Upstream, session, func(up *_Upstream) error {
+		return up.passthrough(m, match, sql, extended, formats)
+	})
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (up *_Upstream) passthrough(m *_Messenger, match *_QueryMatch, sql string, extended bool, formats []int16) error {
+
+	log.Infof("passing query through to %s", match.Upstream.Upstream)
+
+	if !extended {
+		if err := up.write(QueryMessageID, append([]byte(sql), 0)); err != nil {
+			return err
+		}
+		return up.relay(m, "")
+	}
+
+	// the client has already had its ParseComplete and BindComplete
+	if err := up.parse(sql, nil); err != nil {
+		return err
+	}
+	if err := up.bind(match.Params, formats); err != nil {
+		return err
+	}
+	body := &bytes.Buffer{}
+	newMessenger(body).writeString("").writeInt32(0)
+	if err := up.write(ExecuteMessageID, body.Bytes()); err != nil {
+		return err
+	}
+	if err := up.write(SyncMessageID, nil); err != nil {
+		return err
+	}
+
+	return up.relay(m, string([]byte{ParseCompleteMessageID, BindCompleteMessageID}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// describeUpstream asks the upstream server to describe the query, relaying its descriptions. Portals are bound with
+// their arguments and result formats first, statements are parsed with the parameter types the client gave.
+func describeUpstream(m *_Messenger, policy *UnmatchedPolicy, session *_Session, stmt *_PreparedStatement, portal *_Portal) error {
+	return useUpstream(policy, session, func(up *_Upstream) error {
+		return up.describe(m, stmt, portal)
+	})
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (up *_Upstream) describe(m *_Messenger, stmt *_PreparedStatement, portal *_Portal) error {
+
+	log.Infof("describing query on %s", up.Policy.Upstream)
+
+	if err := up.parse(stmt.SQL, stmt.ParameterOIDs); err != nil {
+		return err
+	}
+	target := CloseStatement
+	if portal != nil {
+		if err := up.bind(portal.Match.Params, portal.ResultFormats); err != nil {
+			return err
+		}
+		target = ClosePortal
+	}
+	body := &bytes.Buffer{}
+	newMessenger(body).writeByte(target).writeString("")
+	if err := up.write(DescribeMessageID, body.Bytes()); err != nil {
+		return err
+	}
+	if err := up.write(SyncMessageID, nil); err != nil {
+		return err
+	}
+
+	return up.relay(m, string([]byte{ParseCompleteMessageID, BindCompleteMessageID}))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// parse parses sql as the upstream's unnamed statement
+func (up *_Upstream) parse(sql string, oids []int32) error {
+	body := &bytes.Buffer{}
+	bm := newMessenger(body).writeString("").writeString(sql).writeInt16(int16(len(oids)))
+	for _, oid := range oids {
+		bm.writeInt32(oid)
+	}
+	return up.write(ParseMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// bind binds the text arguments to the upstream's unnamed portal
+func (up *_Upstream) bind(params []*string, formats []int16) error {
+	body := &bytes.Buffer{}
+	bm := newMessenger(body).writeString("").writeString("").writeInt16(0).writeInt16(int16(len(params)))
+	for _, p := range params {
+		if p == nil {
+			bm.writeInt32(-1)
+			continue
+		}
+		bm.writeInt32(int32(len(*p))).writeByteArray([]byte(*p)...)
+	}
+	bm.writeInt16(int16(len(formats))).writeInt16Array(formats...)
+	return up.write(BindMessageID, body.Bytes())
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// errorFromResponse decodes an ErrorResponse body back into a PgError
+func errorFromResponse(body []byte) *PgError {
+
+	pgErr := &PgError{}
+	for len(body) > 1 {
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : end+1])
+		switch body[0] {
+		case ErrorSeverity:
+			pgErr.Severity = value
+		case ErrorSQLStateCode:
+			pgErr.Code = value
+		case ErrorMessage:
+			pgErr.Message = value
+		case ErrorDetail:
+			pgErr.Detail = value
+		case ErrorHint:
+			pgErr.Hint = value
+		}
+		body = body[end+2:]
+	}
+
+	return pgErr
+}
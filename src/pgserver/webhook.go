@@ -0,0 +1,131 @@
+package pgmock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// defaultWebhookTimeout is how long a webhook has to answer when no timeout is set
+const defaultWebhookTimeout = 10 * time.Second
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// WebhookRequest is POSTed to a webhook for each query it's asked to answer, FixtureID is the fixture that sent it
+// there if one did
+type WebhookRequest struct {
+	SQL       string      `json:"sql"`
+	Params    []*string   `json:"params"`
+	FixtureID string      `json:"fixtureId,omitempty"`
+	Session   SessionInfo `json:"session"`
+}
+
+// SessionInfo describes the session a query came from
+type SessionInfo struct {
+	ProcessID       int32             `json:"processId"`
+	User            string            `json:"user"`
+	Database        string            `json:"database"`
+	ApplicationName string            `json:"applicationName,omitempty"`
+	ClientAddr      string            `json:"clientAddr,omitempty"`
+	Settings        map[string]string `json:"settings,omitempty"`
+	TxStatus        TxStatus          `json:"txStatus"`
+}
+
+// WebhookResponse is what the webhook answers with, rows with columns given as name:type pairs or an error. Tag
+// replaces the usual SELECT n command tag.
+type WebhookResponse struct {
+	Columns []string        `json:"cols"`
+	Rows    [][]interface{} `json:"rows"`
+	Tag     string          `json:"tag,omitempty"`
+	Error   *PgError        `json:"error,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// webhookFailed is the error sent when the webhook can't be used
+func webhookFailed(url string, err error) *PgError {
+	return &PgError{Code: SQLStateCodeInternalError, Message: fmt.Sprintf("unable to get an answer from webhook %s, err: %s", url, err)}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// callWebhook asks the webhook how to answer the query, giving up after timeout or defaultWebhookTimeout if it's 0,
+// or as soon as the query is cancelled
+func callWebhook(ctx context.Context, url string, timeout time.Duration, request *WebhookRequest) (*_QueryResponse, error) {
+
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, webhookFailed(url, err)
+	}
+
+	log.Infof("asking webhook %s to answer query", url)
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(timeoutCtx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, webhookFailed(url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err == nil {
+		defer res.Body.Close()
+		body, err = ioutil.ReadAll(res.Body)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, queryCanceled()
+	}
+	if err != nil {
+		return nil, webhookFailed(url, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, webhookFailed(url, fmt.Errorf("status %d: %s", res.StatusCode, bytes.TrimSpace(body)))
+	}
+
+	answer := &WebhookResponse{}
+	if err := json.Unmarshal(body, answer); err != nil {
+		return nil, webhookFailed(url, err)
+	}
+	response, err := buildQueryResponse(answer.Columns, answer.Rows)
+	if err != nil {
+		return nil, webhookFailed(url, err)
+	}
+	response.Error, response.Tag = answer.Error, answer.Tag
+
+	return response, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// info describes the session, a nil session has nothing to say
+func (session *_Session) info() SessionInfo {
+
+	if session == nil {
+		return SessionInfo{TxStatus: TxIdle}
+	}
+
+	info := SessionInfo{
+		ProcessID: session.Key.ProcessID,
+		User:      session.Parameters["user"],
+		Database:  session.Parameters["database"],
+		Settings:  session.settings(),
+		TxStatus:  session.txStatus(),
+	}
+	info.ApplicationName, _ = session.setting("application_name")
+	if session.Conn != nil {
+		info.ClientAddr = session.Conn.RemoteAddr().String()
+	}
+
+	return info
+}
@@ -0,0 +1,101 @@
+package pgmock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func TestWebhook(t *testing.T) {
+
+	// gomega requirement
+	RegisterTestingT(t)
+
+	// echo the query and its argument back, unless it's asked for an error
+	requests := make(chan WebhookRequest, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := WebhookRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests <- request
+		switch request.SQL {
+		case "SELECT fail":
+			json.NewEncoder(w).Encode(WebhookResponse{Error: &PgError{Code: "42P01", Message: "no such table"}})
+		case "SELECT broken":
+			w.WriteHeader(500)
+		case "SELECT slow":
+			time.Sleep(200 * time.Millisecond)
+		case "SELECT hang":
+			<-r.Context().Done()
+		default:
+			row := []interface{}{request.SQL, nil}
+			if len(request.Params) > 0 {
+				row[1] = *request.Params[0]
+			}
+			json.NewEncoder(w).Encode(WebhookResponse{Columns: []string{"sql:text", "arg:text"}, Rows: [][]interface{}{row}, Tag: "SELECT 42"})
+		}
+	}))
+	defer hook.Close()
+
+	srv, addr, stop := startTestServer(nil)
+	defer stop()
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedWebhook})).ToNot(BeNil())
+	Expect(srv.SetUnmatchedPolicy("", UnmatchedPolicy{Action: UnmatchedWebhook, URL: hook.URL, Timeout: 100})).To(BeNil())
+	id, err := srv.AddFixture(Fixture{Query: "SELECT configured", Webhook: hook.URL})
+	Expect(err).To(BeNil())
+
+	c := connectTestClient(addr, map[string]string{"user": "test", "application_name": "worker"})
+	defer c.Conn.Close()
+
+	// assert the results
+	ids, bodies := c.query("SELECT 1")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect(string(bodies[2])).To(Equal("SELECT 42\x00"))
+	request := <-requests
+	Expect(request.SQL).To(Equal("SELECT 1"))
+	Expect(request.FixtureID).To(BeEmpty())
+	Expect(request.Session.User).To(Equal("test"))
+	Expect(request.Session.ApplicationName).To(Equal("worker"))
+	Expect(request.Session.TxStatus).To(Equal(TxIdle))
+
+	// extended queries send their arguments
+	arg := "hello"
+	ids, bodies = c.extendedQuery("SELECT $1", &arg)
+	Expect(string(ids)).To(Equal("12TDC"))
+	Expect(string(bodies[3][len(bodies[3])-5:])).To(Equal("hello"))
+	request = <-requests
+	Expect(request.Params).To(Equal([]*string{&arg}))
+
+	// fixtures can send their queries to a webhook too
+	ids, _ = c.query("SELECT configured")
+	Expect(string(ids)).To(Equal("TDC"))
+	Expect((<-requests).FixtureID).To(Equal(id))
+
+	// errors from the webhook, and with it, are sent back
+	ids, bodies = c.query("SELECT fail")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal("42P01"))
+	<-requests
+	ids, bodies = c.query("SELECT broken")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeInternalError))
+	<-requests
+	ids, bodies = c.query("SELECT slow")
+	Expect(string(ids)).To(Equal("E"))
+	Expect(errorFields(bodies[0])[ErrorSQLStateCode]).To(Equal(SQLStateCodeInternalError))
+	<-requests
+
+	// and cancelling the query gives up on the webhook straight away
+	_, err = srv.AddFixture(Fixture{Query: "SELECT hang", Webhook: hook.URL})
+	Expect(err).To(BeNil())
+	c.writeMessage(QueryMessageID, []byte("SELECT hang\x00"))
+	Expect((<-requests).SQL).To(Equal("SELECT hang"))
+	Expect(cancelRunningQuery(srv)).To(BeTrue())
+	Expect(errorFields(c.expectMessage(ErrorResponseMessageID))[ErrorSQLStateCode]).To(Equal(SQLStateCodeQueryCanceled))
+	c.expectMessage(ReadyForQueryMessageID)
+}